@@ -0,0 +1,79 @@
+package pggateway
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AdminConfig is an HTTP endpoint for health checks and administrative commands
+type AdminConfig struct {
+	Bind string `yaml:"bind,omitempty"`
+}
+
+type pluginHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// startAdmin serves the admin endpoint until ctx is done
+func (s *Server) startAdmin(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.config.Admin.Bind)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/cache/invalidate", s.handleInvalidateCache)
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		err := srv.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			s.plugins.LogError(nil, "error serving admin endpoint: %s", err)
+		}
+	}()
+
+	s.plugins.LogWarn(nil, "admin endpoint listening on %s", l.Addr())
+	return nil
+}
+
+// handleHealth reports the health of every plugin by listener, failing when any of them is unhealthy
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	response := make(map[string]map[string]pluginHealth)
+	for listener, plugins := range s.Health() {
+		response[listener] = make(map[string]pluginHealth)
+		for name, err := range plugins {
+			health := pluginHealth{Status: "ok"}
+			if err != nil {
+				health = pluginHealth{Status: "error", Error: err.Error()}
+				status = http.StatusServiceUnavailable
+			}
+			response[listener][name] = health
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleInvalidateCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.InvalidateCaches()
+	w.WriteHeader(http.StatusNoContent)
+}
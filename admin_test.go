@@ -0,0 +1,175 @@
+package pggateway_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+)
+
+// freeAddr returns a local address nothing is listening on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// getHealth fetches the health check of the admin endpoint at addr
+func getHealth(t *testing.T, addr string) (int, map[string]map[string]map[string]string) {
+	resp, err := http.Get("http://" + addr + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var health map[string]map[string]map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, health
+}
+
+func TestAdminEndpoint(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	admin := freeAddr(t)
+	s, err := pggateway.NewServer(&pggateway.Config{
+		Admin:   pggateway.AdminConfig{Bind: admin},
+		Logging: map[string]pggateway.ConfigMap{"collector": {}},
+		Listeners: []*pggateway.ListenerConfig{{
+			Bind:           "127.0.0.1:0",
+			Authentication: passthrough(srv),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := <-collectors
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", admin)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("admin endpoint not listening: %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Plugins are reported for the server and each of its listeners
+	status, health := getHealth(t, admin)
+	if status != http.StatusOK || len(health) != 2 || health["server"]["logging/collector"]["status"] != "ok" {
+		t.Fatalf("unexpected health %d %v", status, health)
+	}
+
+	// Any unhealthy plugin fails the check
+	c.setHealth(errors.New("disk full"))
+	status, health = getHealth(t, admin)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", status)
+	}
+	if plugin := health["server"]["logging/collector"]; plugin["status"] != "error" || plugin["error"] != "disk full" {
+		t.Fatalf("unexpected plugin health %v", plugin)
+	}
+
+	resp, err := http.Get("http://" + admin + "/cache/invalidate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET /cache/invalidate to be refused, got %d", resp.StatusCode)
+	}
+	resp, err = http.Post("http://"+admin+"/cache/invalidate", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected POST /cache/invalidate to succeed, got %d", resp.StatusCode)
+	}
+
+	// Closing the server stops the admin endpoint
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Close")
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", admin)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("admin endpoint still listening after Close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminEndpointInUse(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err := pggateway.NewServer(&pggateway.Config{
+		Admin: pggateway.AdminConfig{Bind: l.Addr().String()},
+		Listeners: []*pggateway.ListenerConfig{{
+			Bind:           "127.0.0.1:0",
+			Authentication: passthrough(srv),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Start fails instead of serving without its admin endpoint
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+	select {
+	case err := <-started:
+		if err == nil {
+			t.Fatal("expected Start to fail with the admin address in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not fail with the admin address in use")
+	}
+}
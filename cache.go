@@ -0,0 +1,485 @@
+package pggateway
+
+import (
+	"bytes"
+	"container/list"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c653labs/pgproto"
+)
+
+const (
+	defaultCacheTTL      = time.Minute
+	defaultCacheMaxBytes = 64 << 20
+)
+
+// CacheConfig
+type CacheConfig struct {
+	Enabled  bool          `yaml:"enabled,omitempty"`
+	TTL      time.Duration `yaml:"ttl,omitempty"`
+	MaxBytes int           `yaml:"max_bytes,omitempty"`
+	// Queries allowed to be cached, compared by fingerprint so literal values may differ
+	Queries []string          `yaml:"queries,omitempty"`
+	Notify  CacheNotifyConfig `yaml:"notify,omitempty"`
+}
+
+// CacheNotifyConfig is a channel to LISTEN on, any notification on it invalidates the whole cache
+type CacheNotifyConfig struct {
+	Channel  string       `yaml:"channel,omitempty"`
+	Database string       `yaml:"database,omitempty"`
+	Target   TargetConfig `yaml:"target,omitempty"`
+}
+
+type cacheEntry struct {
+	key      string
+	response []byte
+	expires  time.Time
+}
+
+// QueryCache stores the encoded responses to allowlisted simple queries and unnamed extended protocol statements
+type QueryCache struct {
+	config  CacheConfig
+	allowed map[string]bool
+	plugins *PluginRegistry
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int
+	// generation is bumped by every invalidation, so responses to statements sent before it are not stored
+	generation uint64
+
+	stop chan struct{}
+}
+
+func NewQueryCache(config CacheConfig, plugins *PluginRegistry) *QueryCache {
+	if config.TTL == 0 {
+		config.TTL = defaultCacheTTL
+	}
+	if config.MaxBytes == 0 {
+		config.MaxBytes = defaultCacheMaxBytes
+	}
+
+	c := &QueryCache{
+		config:  config,
+		allowed: make(map[string]bool),
+		plugins: plugins,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		stop:    make(chan struct{}),
+	}
+	for _, q := range config.Queries {
+		c.allowed[QueryFingerprint(q)] = true
+	}
+	if config.Notify.Channel != "" {
+		go c.listen()
+	}
+	return c
+}
+
+// normalizeQuery collapses whitespace and drops a trailing `;`, when literals is set string and numeric
+// literals are replaced by `?` and comments dropped, when lower is set everything else is lowercased
+func normalizeQuery(query string, literals bool, lower bool) string {
+	var out strings.Builder
+	space := false
+	for _, t := range Tokenize(query) {
+		switch {
+		case t.Kind == TokenSpace, t.Kind == TokenComment && literals:
+			// Comments separate tokens like whitespace
+			space = out.Len() > 0
+			continue
+		case space:
+			out.WriteByte(' ')
+			space = false
+		}
+
+		switch {
+		case literals && (t.Kind == TokenString || t.Kind == TokenNumber):
+			out.WriteByte('?')
+		case lower && t.Kind != TokenString && t.Kind != TokenQuotedIdentifier:
+			out.WriteString(strings.ToLower(t.Text))
+		default:
+			out.WriteString(t.Text)
+		}
+	}
+	return strings.TrimSuffix(strings.TrimSpace(out.String()), ";")
+}
+
+// SanitizeQuery replaces the literal values in query by `?` and drops its comments,
+// so it can be exported without the data it carries
+func SanitizeQuery(query string) string {
+	return normalizeQuery(query, true, false)
+}
+
+// QueryFingerprint identifies a query regardless of its literal values, case and whitespace
+func QueryFingerprint(query string) string {
+	return normalizeQuery(query, true, true)
+}
+
+// Key returns the cache key for query run by sess, and whether it may be cached at all
+func (c *QueryCache) Key(sess *Session, query string) (string, bool) {
+	if !c.allowed[QueryFingerprint(query)] {
+		return "", false
+	}
+	// Results depend on who runs the query, e.g. with row level security, and where. Routes and
+	// authentication plugins may send the same client user to different targets or target users.
+	key := []string{string(sess.Database), string(sess.User), sess.targetIdentity(), normalizeQuery(query, false, false)}
+	return strings.Join(key, "\x00"), true
+}
+
+// Get returns the messages cached for key
+func (c *QueryCache) Get(key string) ([]pgproto.ServerMessage, bool) {
+	c.mutex.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mutex.Unlock()
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		c.mutex.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.mutex.Unlock()
+
+	var msgs []pgproto.ServerMessage
+	r := bytes.NewReader(entry.response)
+	for r.Len() > 0 {
+		msg, err := pgproto.ParseServerMessage(r)
+		if err != nil {
+			return nil, false
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, true
+}
+
+// BatchKey returns the cache key for an unnamed Parse, Bind and Execute batch run by sess
+func (c *QueryCache) BatchKey(sess *Session, batch []pgproto.ClientMessage) (string, bool) {
+	if len(batch) < 3 {
+		return "", false
+	}
+	parse, ok := batch[0].(*pgproto.Parse)
+	if !ok {
+		return "", false
+	}
+	if _, ok := batch[len(batch)-1].(*pgproto.Execute); !ok {
+		return "", false
+	}
+	key, ok := c.Key(sess, string(parse.Query))
+	if !ok {
+		return "", false
+	}
+
+	// Parameter types and values, formats and whether rows were described all shape the response
+	var buf bytes.Buffer
+	for _, msg := range batch {
+		if _, err := pgproto.WriteMessage(msg, &buf); err != nil {
+			return "", false
+		}
+	}
+	return key + "\x00" + buf.String(), true
+}
+
+// Generation returns the current generation, to be passed to Set along with the response to a statement sent now
+func (c *QueryCache) Generation() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation
+}
+
+// Set stores the encoded response for key, evicting the least recently used entries to stay within MaxBytes,
+// unless the cache was invalidated since generation
+func (c *QueryCache) Set(key string, response []byte, generation uint64) {
+	if len(response) > c.config.MaxBytes {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:      key,
+		response: response,
+		expires:  time.Now().Add(c.config.TTL),
+	})
+	c.size += len(response)
+	for c.size > c.config.MaxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *QueryCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.response)
+}
+
+// Invalidate empties the cache
+func (c *QueryCache) Invalidate() {
+	c.mutex.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size = 0
+	c.generation++
+	c.mutex.Unlock()
+}
+
+func (c *QueryCache) Close() {
+	close(c.stop)
+}
+
+// listen invalidates the cache on notifications, reconnecting until the cache is closed
+func (c *QueryCache) listen() {
+	n := c.config.Notify
+	addr := net.JoinHostPort(n.Target.Host, strconv.Itoa(n.Target.Port))
+	if IsUnixSocketPath(n.Target.Host) {
+		addr = UnixSocketPath(n.Target.Host, n.Target.Port)
+	}
+
+	for {
+		err := c.listenOnce(addr)
+		// Notifications may have been missed while disconnected
+		c.Invalidate()
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		c.plugins.LogError(nil, "cache invalidation listener disconnected: %s", err)
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (c *QueryCache) listenOnce(addr string) error {
+	n := c.config.Notify
+	client, err := ConnectClient(addr, n.Target.User, n.Target.Password, n.Database)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	go func() {
+		<-c.stop
+		client.Close()
+	}()
+
+	_, err = client.Query("LISTEN " + quoteIdentifier(n.Channel))
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := client.Receive()
+		if err != nil {
+			return err
+		}
+		if _, ok := msg.(*pgproto.NotificationResponse); ok {
+			c.plugins.LogInfo(nil, "cache invalidated by notification on %s", n.Channel)
+			c.Invalidate()
+		}
+	}
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// cacheKey is the key a statement's response is stored under, with the cache generation it was sent in
+type cacheKey struct {
+	key        string
+	generation uint64
+}
+
+// cacheRecorder collects the encoded response to a single statement
+type cacheRecorder struct {
+	cacheKey
+	response bytes.Buffer
+	failed   bool
+}
+
+// cacheRecorder returns the recorder for statement seq, which does not record anything unless the statement is cacheable
+func (s *Session) cacheRecorder(seq int64) *cacheRecorder {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+	key, ok := s.cacheKeys[seq]
+	delete(s.cacheKeys, seq)
+	return &cacheRecorder{cacheKey: key, failed: !ok}
+}
+
+func (r *cacheRecorder) add(msg pgproto.ServerMessage) {
+	if r.failed {
+		return
+	}
+	switch msg.(type) {
+	case *pgproto.ParseComplete, *pgproto.BindComplete, *pgproto.ParameterDescription, *pgproto.NoData,
+		*pgproto.RowDescription, *pgproto.DataRow, *pgproto.CommandCompletion:
+		_, err := pgproto.WriteMessage(msg, &r.response)
+		r.failed = err != nil
+	case *pgproto.ReadyForQuery:
+	default:
+		// Errors, notices and anything else asynchronous make the response unsuitable
+		r.failed = true
+	}
+}
+
+func (r *cacheRecorder) store(c *QueryCache, status pgproto.ReadyForQueryStatus) {
+	// Statements that opened a transaction may see their own uncommitted changes
+	if r.failed || byte(status) != 'I' {
+		return
+	}
+	c.Set(r.key, r.response.Bytes(), r.generation)
+}
+
+// expectCacheable marks the response to statement seq to be stored in the cache under key
+func (s *Session) expectCacheable(seq int64, key string) {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+	if s.cacheKeys == nil {
+		s.cacheKeys = make(map[int64]cacheKey)
+	}
+	s.cacheKeys[seq] = cacheKey{key: key, generation: s.cache.Generation()}
+}
+
+// changesSettings reports whether query may change settings such as search_path or the role,
+// which cached responses would not reflect
+func changesSettings(query string) bool {
+	for _, words := range statementWords(query) {
+		switch words[0] {
+		case "SET", "RESET", "DISCARD":
+			return true
+		}
+		for _, word := range words {
+			if word == "SET_CONFIG" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// holdForCache holds msg back from the target when it continues an unnamed Parse, Bind and Execute batch
+// of an allowlisted query, optionally describing the statement and portal, which may be answered from the
+// cache once its Sync arrives
+func (s *Session) holdForCache(msg pgproto.ClientMessage) bool {
+	var last pgproto.ClientMessage
+	if len(s.cacheBatch) > 0 {
+		last = s.cacheBatch[len(s.cacheBatch)-1]
+	}
+	describes := func(objectType pgproto.ObjectType) bool {
+		d, ok := last.(*pgproto.Describe)
+		return ok && d.ObjectType == objectType
+	}
+
+	var hold bool
+	switch m := msg.(type) {
+	case *pgproto.Parse:
+		hold = last == nil && len(m.Name) == 0 && s.cache.allowed[QueryFingerprint(string(m.Query))]
+	case *pgproto.Describe:
+		_, parsed := last.(*pgproto.Parse)
+		_, bound := last.(*pgproto.Bind)
+		hold = len(m.Name) == 0 && (parsed && m.ObjectType == pgproto.ObjectTypePreparedStatement ||
+			bound && m.ObjectType == pgproto.ObjectTypePortal)
+	case *pgproto.Bind:
+		_, parsed := last.(*pgproto.Parse)
+		hold = (parsed || describes(pgproto.ObjectTypePreparedStatement)) && len(m.Portal) == 0 && len(m.Statement) == 0
+	case *pgproto.Execute:
+		_, bound := last.(*pgproto.Bind)
+		hold = (bound || describes(pgproto.ObjectTypePortal)) && len(m.Portal) == 0 && m.MaxRows == 0
+	}
+	if hold {
+		s.cacheBatch = append(s.cacheBatch, msg)
+	}
+	return hold
+}
+
+// serveFromCache answers msg from the cache when possible. Otherwise it returns the messages to forward
+// to the target, which may include held back ones or none at all, and the key to store their response under.
+func (s *Session) serveFromCache(msg pgproto.ClientMessage) (bool, []pgproto.ClientMessage, string, error) {
+	switch m := msg.(type) {
+	case *pgproto.SimpleQuery:
+		s.cacheBypassed = s.cacheBypassed || changesSettings(string(m.Query))
+	case *pgproto.Parse:
+		s.cacheBypassed = s.cacheBypassed || changesSettings(string(m.Query))
+	}
+	if !s.cacheBypassed && s.holdForCache(msg) {
+		return false, nil, "", nil
+	}
+	batch := append(s.cacheBatch, msg)
+	s.cacheBatch = nil
+	if s.cacheBypassed {
+		return false, batch, "", nil
+	}
+
+	var key string
+	var ok bool
+	switch m := msg.(type) {
+	case *pgproto.SimpleQuery:
+		key, ok = s.cache.Key(s, string(m.Query))
+	case *pgproto.Sync:
+		key, ok = s.cache.BatchKey(s, batch[:len(batch)-1])
+	}
+	if !ok {
+		return false, batch, "", nil
+	}
+	// Only idle sessions without statements in flight can be answered out of order,
+	// cached results would not reflect a transaction's own changes
+	if byte(atomic.LoadInt32(&s.txStatus)) != 'I' || s.statementSeq != atomic.LoadInt64(&s.completedSeq) {
+		return false, batch, "", nil
+	}
+
+	msgs, ok := s.cache.Get(key)
+	if !ok {
+		return false, batch, key, nil
+	}
+
+	for _, req := range batch {
+		s.statementEvent(req)
+		for _, t := range s.transformers {
+			if o, ok := t.(RequestObserver); ok {
+				o.ObserveRequest(req)
+			}
+		}
+	}
+	response := make([]pgproto.Message, 0, len(msgs)+1)
+	for _, msg := range msgs {
+		var err error
+		for _, t := range s.transformers {
+			msg, err = t.TransformResponse(msg)
+			if err != nil {
+				return false, nil, "", err
+			}
+			if msg == nil {
+				break
+			}
+		}
+		if msg == nil {
+			continue
+		}
+		response = append(response, msg)
+	}
+
+	if s.plugins.LogEnabled("debug") {
+		s.plugins.LogDebug(s.loggingContextWithMessage(batch[0]), "answered statement from cache")
+	}
+	for _, req := range batch {
+		s.recordCapture(CaptureClientMessage, req)
+	}
+	s.recordCapture(CaptureReadyForQuery, nil)
+	return true, nil, "", s.respond(response, true)
+}
@@ -0,0 +1,303 @@
+package pggateway_test
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pgproto"
+)
+
+func TestQueryCache(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	for _, id := range []string{"1", "2"} {
+		srv.SetResult("SELECT name FROM users WHERE id = "+id, pgtest.Result{Columns: []string{"name"}, Rows: [][]string{{"user " + id}}})
+	}
+	srv.SetResult("SELECT now()", pgtest.Result{Columns: []string{"now"}, Rows: [][]string{{"today"}}})
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Cache: pggateway.CacheConfig{
+			Enabled: true,
+			TTL:     time.Minute,
+			Queries: []string{"SELECT name FROM users WHERE id = 0"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	queries := []string{
+		"SELECT name FROM users WHERE id = 1",
+		"SELECT name FROM users WHERE id = 1",
+		"SELECT name FROM users WHERE id = 2",
+		"SELECT now()",
+		"SELECT now()",
+	}
+	for _, q := range queries {
+		rows, err := client.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("unexpected rows %v for %s", rows, q)
+		}
+	}
+
+	// Allowlisted queries are matched by fingerprint but cached by their literal values
+	want := []string{
+		"SELECT name FROM users WHERE id = 1",
+		"SELECT name FROM users WHERE id = 2",
+		"SELECT now()",
+		"SELECT now()",
+	}
+	if got := srv.Queries(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("target received %v, expected %v", got, want)
+	}
+
+	// Another session shares the cache
+	other, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	rows, err := other.Query("SELECT name FROM users WHERE id = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rows, [][]string{{"user 2"}}) {
+		t.Fatalf("unexpected cached rows %v", rows)
+	}
+	if got := srv.Queries(); len(got) != len(want) {
+		t.Fatalf("cached query reached the target: %v", got)
+	}
+}
+
+func TestQueryCacheKeys(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	for _, id := range []string{"1", "2"} {
+		srv.SetResult("SELECT name FROM users WHERE id = "+id, pgtest.Result{Columns: []string{"name"}, Rows: [][]string{{"user " + id}}})
+	}
+	srv.SetResult("SET search_path TO other", pgtest.Result{Tag: "SET"})
+	srv.SetResult("SELECT set_config('search_path', 'other', false)", pgtest.Result{Columns: []string{"set_config"}, Rows: [][]string{{"other"}}})
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Cache: pggateway.CacheConfig{
+			Enabled: true,
+			Queries: []string{"SELECT name FROM users WHERE id = 0"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	run := func(user string, database string, queries ...string) {
+		client, err := pgtest.Connect(gw.Addr(), user, "", database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		for _, q := range queries {
+			_, err := client.Query(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	q := "SELECT name FROM users WHERE id = 1"
+	// Every user and database has its own entries
+	run("app", "app", q)
+	run("app", "app", q)
+	run("report", "app", q)
+	run("app", "other", q)
+	if got := srv.Queries(); len(got) != 3 {
+		t.Fatalf("target received %v, expected one query per user and database", got)
+	}
+
+	// Once a session changed its settings its results may differ, even for queries cached before,
+	// and are not stored either
+	q2 := "SELECT name FROM users WHERE id = 2"
+	run("app", "app", "SET search_path TO other", q, q2)
+	run("app", "app", "SELECT set_config('search_path', 'other', false)", q)
+	run("app", "app", q, q2)
+	want := []string{
+		q, q, q,
+		"SET search_path TO other", q, q2,
+		"SELECT set_config('search_path', 'other', false)", q,
+		q2,
+	}
+	if got := srv.Queries(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("target received %v, expected %v", got, want)
+	}
+}
+
+func TestQueryCacheRoutes(t *testing.T) {
+	q := "SELECT name FROM users WHERE id = 1"
+	tenants := map[string]*pgtest.Server{"a.example.com": newSSLServer(t), "b.example.com": newSSLServer(t)}
+	var routes []*pggateway.RouteConfig
+	for name, srv := range tenants {
+		srv.SetResult(q, pgtest.Result{Columns: []string{"name"}, Rows: [][]string{{name}}})
+		routes = append(routes, &pggateway.RouteConfig{ServerName: name, Authentication: passthrough(srv)})
+	}
+	certFile, keyFile := writeCertificate(t, t.TempDir(), "gateway", "*.example.com")
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		SSL:            pggateway.SSLConfig{Enabled: true, Certificate: certFile, Key: keyFile},
+		Authentication: passthrough(tenants["a.example.com"]),
+		Routes:         routes,
+		Cache: pggateway.CacheConfig{
+			Enabled: true,
+			Queries: []string{"SELECT name FROM users WHERE id = 0"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	// The same client user and database reach a different target on every route
+	for _, name := range []string{"a.example.com", "b.example.com", "a.example.com", "b.example.com"} {
+		conn, err := dialSSL(gw.Addr(), &tls.Config{InsecureSkipVerify: true, ServerName: name}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := pgtest.ConnectConn(conn, "app", "", "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := client.Query(q)
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rows, [][]string{{name}}) {
+			t.Fatalf("route %s answered with %v", name, rows)
+		}
+	}
+	for name, srv := range tenants {
+		if got := srv.Queries(); len(got) != 1 {
+			t.Errorf("target of %s received %v, expected the query once", name, got)
+		}
+	}
+}
+
+func TestQueryCacheExtended(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	q := "SELECT name FROM users WHERE id = $1"
+	srv.SetResult(q, pgtest.Result{Columns: []string{"name"}, Rows: [][]string{{"user"}}})
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Cache: pggateway.CacheConfig{
+			Enabled: true,
+			Queries: []string{q},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	execute := func(id string, describe bool) []string {
+		msgs := []pgproto.Message{
+			&pgproto.Parse{Query: []byte(q)},
+			&pgproto.Bind{Parameters: [][]byte{[]byte(id)}},
+		}
+		if describe {
+			msgs = append(msgs, &pgproto.Describe{ObjectType: pgproto.ObjectTypePortal})
+		}
+		msgs = append(msgs, &pgproto.Execute{}, &pgproto.Sync{})
+		err := client.Send(msgs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var types []string
+		for {
+			msg, err := client.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			types = append(types, msg.AsMap()["Type"].(string))
+			if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+				return types
+			}
+		}
+	}
+
+	described := execute("1", true)
+	want := []string{"ParseComplete", "BindComplete", "RowDescription", "DataRow", "CommandCompletion", "ReadyForQuery"}
+	if !reflect.DeepEqual(described, want) {
+		t.Fatalf("unexpected response %v", described)
+	}
+	if got := execute("1", true); !reflect.DeepEqual(got, described) {
+		t.Fatalf("unexpected cached response %v", got)
+	}
+	if got := srv.Queries(); len(got) != 1 {
+		t.Fatalf("cached statement reached the target: %v", got)
+	}
+
+	// Other parameters and formats are cached separately
+	execute("2", true)
+	execute("1", false)
+	if got := srv.Queries(); len(got) != 3 {
+		t.Fatalf("target received %v, expected 3 statements", got)
+	}
+	execute("2", true)
+	execute("1", false)
+	if got := srv.Queries(); len(got) != 3 {
+		t.Fatalf("cached statements reached the target: %v", got)
+	}
+}
+
+func TestQueryCacheGeneration(t *testing.T) {
+	cache := pggateway.NewQueryCache(pggateway.CacheConfig{}, nil)
+	defer cache.Close()
+
+	generation := cache.Generation()
+	cache.Set("current", nil, generation)
+	cache.Invalidate()
+	// A response to a statement sent before the invalidation may be stale
+	cache.Set("stale", nil, generation)
+	for _, key := range []string{"current", "stale"} {
+		if _, ok := cache.Get(key); ok {
+			t.Errorf("%s entry survived invalidation", key)
+		}
+	}
+
+	cache.Set("fresh", nil, cache.Generation())
+	if _, ok := cache.Get("fresh"); !ok {
+		t.Error("fresh entry was not stored")
+	}
+}
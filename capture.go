@@ -0,0 +1,197 @@
+package pggateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pgproto"
+)
+
+// Capture files start with captureMagic and a length prefixed JSON CaptureHeader,
+// followed by records of a kind byte and a uvarint offset in nanoseconds since the session started.
+// Client message records carry the uvarint length and bytes of the message as sent to the server.
+const captureMagic = "PGGWCAP1"
+
+const (
+	CaptureClientMessage byte = 'C'
+	CaptureReadyForQuery byte = 'R'
+)
+
+// CaptureConfig
+type CaptureConfig struct {
+	Enabled   bool   `yaml:"enabled,omitempty"`
+	Directory string `yaml:"directory,omitempty"`
+}
+
+// CaptureHeader describes the captured session
+type CaptureHeader struct {
+	SessionID string    `json:"session_id"`
+	User      string    `json:"user"`
+	Database  string    `json:"database"`
+	Started   time.Time `json:"started"`
+}
+
+// CaptureRecord is a single client message, or the server becoming ready for the next query
+type CaptureRecord struct {
+	Kind    byte
+	Offset  time.Duration
+	Message []byte
+}
+
+// ClientMessage parses the message of a CaptureClientMessage record
+func (r CaptureRecord) ClientMessage() (pgproto.ClientMessage, error) {
+	return pgproto.ParseClientMessage(bytes.NewReader(r.Message))
+}
+
+type captureWriter struct {
+	mutex   sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	started time.Time
+	// err is the first write error, the capture is incomplete and no longer recorded once set
+	err error
+}
+
+func newCaptureWriter(dir string, header CaptureHeader) (*captureWriter, error) {
+	f, err := os.OpenFile(filepath.Join(dir, header.SessionID+".pgcap"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &captureWriter{
+		file:    f,
+		w:       bufio.NewWriter(f),
+		started: header.Started,
+	}
+
+	meta, err := json.Marshal(header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.w.WriteString(captureMagic)
+	c.writeUvarint(uint64(len(meta)))
+	// Errors of a bufio.Writer are sticky, the last write returns any earlier one
+	_, err = c.w.Write(meta)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *captureWriter) writeUvarint(v uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, err := c.w.Write(buf[:binary.PutUvarint(buf, v)])
+	return err
+}
+
+func (c *captureWriter) record(kind byte, msg pgproto.Message) error {
+	var encoded bytes.Buffer
+	if msg != nil {
+		_, err := pgproto.WriteMessage(msg, &encoded)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return nil
+	}
+	c.w.WriteByte(kind)
+	err := c.writeUvarint(uint64(time.Since(c.started)))
+	if kind == CaptureClientMessage {
+		c.writeUvarint(uint64(encoded.Len()))
+		_, err = c.w.Write(encoded.Bytes())
+	}
+	// Only the first error is returned, the capture is disabled from then on
+	c.err = err
+	return err
+}
+
+func (c *captureWriter) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// A failed capture was already reported
+	err := c.w.Flush()
+	if c.err != nil {
+		err = nil
+	}
+	if e := c.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// CaptureReader reads back a capture file
+type CaptureReader struct {
+	Header CaptureHeader
+	r      *bufio.Reader
+}
+
+func NewCaptureReader(in io.Reader) (*CaptureReader, error) {
+	r := bufio.NewReader(in)
+	magic := make([]byte, len(captureMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+	if string(magic) != captureMagic {
+		return nil, fmt.Errorf("not a pggateway capture file")
+	}
+
+	meta, err := readCaptureBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	c := &CaptureReader{r: r}
+	err = json.Unmarshal(meta, &c.Header)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func readCaptureBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// Next returns the next record, or io.EOF at the end of the capture
+func (c *CaptureReader) Next() (CaptureRecord, error) {
+	var rec CaptureRecord
+	kind, err := c.r.ReadByte()
+	if err != nil {
+		return rec, err
+	}
+	offset, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return rec, err
+	}
+	rec.Kind = kind
+	rec.Offset = time.Duration(offset)
+
+	switch kind {
+	case CaptureClientMessage:
+		rec.Message, err = readCaptureBytes(c.r)
+	case CaptureReadyForQuery:
+	default:
+		err = fmt.Errorf("unknown capture record kind %q", kind)
+	}
+	return rec, err
+}
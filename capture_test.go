@@ -0,0 +1,92 @@
+package pggateway_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pgproto"
+)
+
+func TestCapture(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	dir := t.TempDir()
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Capture:        pggateway.CaptureConfig{Enabled: true, Directory: dir},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		_, err = client.Query("SELECT 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+	// Closing the gateway waits for the session to end and its capture to be flushed
+	gw.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pgcap"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected a single capture, got %v %v", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	capture, err := pggateway.NewCaptureReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capture.Header.User != "app" || capture.Header.Database != "app" {
+		t.Fatalf("unexpected header %+v", capture.Header)
+	}
+
+	// Every query is recorded before the ReadyForQuery answering it,
+	// the first ReadyForQuery ends the startup
+	queries, ready := 0, -1
+	for {
+		rec, err := capture.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch rec.Kind {
+		case pggateway.CaptureClientMessage:
+			msg, err := rec.ClientMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := msg.(*pgproto.SimpleQuery); ok {
+				queries++
+			}
+		case pggateway.CaptureReadyForQuery:
+			ready++
+			if ready > queries {
+				t.Fatalf("ReadyForQuery %d recorded before its query", ready)
+			}
+		}
+	}
+	if queries != 20 || ready != 20 {
+		t.Fatalf("recorded %d queries and %d ReadyForQuery, expected 20 of each", queries, ready)
+	}
+}
@@ -0,0 +1,219 @@
+package pggateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultCertificateReloadInterval = time.Minute
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+type certificateEntry struct {
+	hosts    []string
+	certFile string
+	keyFile  string
+
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// certificateStore keeps the listener's certificates in memory,
+// reloading them when their files change on disk
+type certificateStore struct {
+	mutex    sync.RWMutex
+	entries  []*certificateEntry
+	fallback *certificateEntry
+
+	plugins  *PluginRegistry
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newCertificateStore(config SSLConfig, plugins *PluginRegistry) (*certificateStore, error) {
+	s := &certificateStore{
+		plugins: plugins,
+		stop:    make(chan struct{}),
+	}
+
+	for _, c := range config.Certificates {
+		s.entries = append(s.entries, &certificateEntry{
+			hosts:    c.Hosts,
+			certFile: c.Certificate,
+			keyFile:  c.Key,
+		})
+	}
+	if config.Certificate != "" {
+		s.fallback = &certificateEntry{certFile: config.Certificate, keyFile: config.Key}
+		s.entries = append(s.entries, s.fallback)
+	} else if len(s.entries) > 0 {
+		s.fallback = s.entries[0]
+	} else {
+		return nil, fmt.Errorf("ssl is enabled but no certificate is configured")
+	}
+
+	for _, e := range s.entries {
+		_, err := s.reloadEntry(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	interval := config.ReloadInterval
+	if interval == 0 {
+		interval = defaultCertificateReloadInterval
+	}
+	if interval > 0 {
+		go s.watch(interval)
+	}
+	return s, nil
+}
+
+// reloadEntry loads the certificate of e again if its files changed since they were last loaded
+func (s *certificateStore) reloadEntry(e *certificateEntry) (bool, error) {
+	var modTimes [2]time.Time
+	for i, name := range []string{e.certFile, e.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	s.mutex.RLock()
+	unchanged := e.cert != nil && modTimes == e.modTimes
+	s.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cer, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	s.mutex.Lock()
+	e.cert = &cer
+	e.modTimes = modTimes
+	s.mutex.Unlock()
+	return true, nil
+}
+
+func (s *certificateStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, e := range s.entries {
+			// A certificate mid-rotation fails to load, keep serving the last good one
+			reloaded, err := s.reloadEntry(e)
+			if err != nil {
+				s.plugins.LogError(nil, "error reloading certificate %s: %s", e.certFile, err)
+			} else if reloaded {
+				s.plugins.LogWarn(nil, "reloaded certificate %s", e.certFile)
+			}
+		}
+	}
+}
+
+func (s *certificateStore) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// getCertificate picks the certificate for the server name the client asked for,
+// falling back to the listener's default certificate
+func (s *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if hello.ServerName != "" {
+		for _, e := range s.entries {
+			for _, host := range e.hosts {
+				if MatchServerName(host, hello.ServerName) {
+					return e.cert, nil
+				}
+			}
+		}
+	}
+	return s.fallback.cert, nil
+}
+
+// newServerTLSConfig builds the tls.Config shared by all of a listener's SSL connections
+func newServerTLSConfig(config SSLConfig, certs *certificateStore) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		NextProtos:     []string{alpnProtocol},
+	}
+
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown ssl min_version %#v, expected '1.0', '1.1', '1.2' or '1.3'", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(config.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range config.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure ssl cipher suite %#v", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	for _, name := range config.Curves {
+		curve, ok := tlsCurves[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown ssl curve %#v, expected 'X25519', 'P256', 'P384' or 'P521'", name)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+
+	if config.ClientCA != "" {
+		pem, err := ioutil.ReadFile(config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ssl client_ca %s", config.ClientCA)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.ClientCertRequired {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if config.ClientCertRequired {
+		return nil, fmt.Errorf("ssl client_cert_required needs a client_ca")
+	}
+
+	return tlsConfig, nil
+}
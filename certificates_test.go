@@ -0,0 +1,105 @@
+package pggateway_test
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+)
+
+// replaceFile overwrites name with contents, moving its modification time by age
+func replaceFile(t *testing.T, name string, contents []byte, age time.Duration) {
+	err := os.WriteFile(name, contents, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(age)
+	err = os.Chtimes(name, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// presentedCertificate returns the common name of the certificate the gateway at addr presents
+func presentedCertificate(t *testing.T, addr string) string {
+	conn, err := dialSSL(addr, &tls.Config{InsecureSkipVerify: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	srv := newSSLServer(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "gateway", "localhost")
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		SSL:            pggateway.SSLConfig{Enabled: true, Certificate: certFile, Key: keyFile, ReloadInterval: 20 * time.Millisecond},
+		Authentication: passthrough(srv),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+	if cn := presentedCertificate(t, gw.Addr()); cn != "gateway" {
+		t.Fatalf("expected the gateway certificate, got %s", cn)
+	}
+
+	// Sessions opened before the reload keep working
+	conn, err := dialSSL(gw.Addr(), &tls.Config{InsecureSkipVerify: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pgtest.ConnectConn(conn, "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	renewedCert, renewedKey := writeCertificate(t, t.TempDir(), "renewed", "localhost")
+	for _, files := range [][2]string{{renewedCert, certFile}, {renewedKey, keyFile}} {
+		contents, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		replaceFile(t, files[1], contents, time.Second)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for presentedCertificate(t, gw.Addr()) != "renewed" {
+		if time.Now().After(deadline) {
+			t.Fatal("the renewed certificate was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A certificate that fails to load, e.g. mid-rotation, leaves the last good one in place
+	replaceFile(t, certFile, []byte("not a certificate"), 2*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	if cn := presentedCertificate(t, gw.Addr()); cn != "renewed" {
+		t.Fatalf("expected the last good certificate, got %s", cn)
+	}
+}
+
+func TestCertificateInvalid(t *testing.T) {
+	srv := newSSLServer(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "gateway", "localhost")
+	replaceFile(t, certFile, []byte("not a certificate"), 0)
+
+	// Unlike reloads, the first load must succeed
+	_, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		SSL:            pggateway.SSLConfig{Enabled: true, Certificate: certFile, Key: keyFile},
+		Authentication: passthrough(srv),
+	})
+	if err == nil {
+		t.Fatal("expected an invalid certificate to be refused")
+	}
+}
@@ -0,0 +1,192 @@
+package pggateway
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/c653labs/pgproto"
+	"github.com/xdg/scram"
+)
+
+// Client is a minimal PostgreSQL client, used to talk to targets on the gateway's own behalf
+type Client struct {
+	conn net.Conn
+}
+
+// ConnectClient opens a session to addr, a host:port or Unix socket path, authenticating
+// with whichever of cleartext, md5 or SCRAM-SHA-256 the server asks for
+func ConnectClient(addr string, user string, password string, database string) (*Client, error) {
+	network := "tcp"
+	if IsUnixSocketPath(addr) {
+		network = "unix"
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, user, password, database)
+}
+
+// NewClient opens a session on an established connection, e.g. one already speaking TLS
+func NewClient(conn net.Conn, user string, password string, database string) (*Client, error) {
+	c := &Client{conn: conn}
+	err := c.startup(user, password, database)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) startup(user string, password string, database string) error {
+	err := writeMessages(c.conn, &pgproto.StartupMessage{
+		Options: map[string][]byte{
+			"user":     []byte(user),
+			"database": []byte(database),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := pgproto.ParseServerMessage(c.conn)
+		if err != nil {
+			return err
+		}
+
+		switch m := msg.(type) {
+		case *pgproto.AuthenticationRequest:
+			err = c.authenticate(m, user, password)
+			if err != nil {
+				return err
+			}
+		case *pgproto.Error:
+			return fmt.Errorf("%s", m.Message)
+		case *pgproto.ReadyForQuery:
+			return nil
+		}
+	}
+}
+
+func (c *Client) authenticate(auth *pgproto.AuthenticationRequest, user string, password string) error {
+	switch auth.Method {
+	case pgproto.AuthenticationMethodOK:
+		return nil
+	case pgproto.AuthenticationMethodPlaintext:
+		return writeMessages(c.conn, &pgproto.PasswordMessage{HeaderMessage: []byte(password)})
+	case pgproto.AuthenticationMethodMD5:
+		passwdReq := &pgproto.PasswordMessage{}
+		passwdReq.SetPassword([]byte(user), []byte(password), auth.Salt)
+		return writeMessages(c.conn, passwdReq)
+	case pgproto.AuthenticationMethodSASL:
+		return c.scramAuthenticate(user, password)
+	}
+	return fmt.Errorf("unsupported authentication method %v", auth.Method)
+}
+
+func (c *Client) scramAuthenticate(user string, password string) error {
+	client, err := scram.SHA256.NewClient(user, password, "")
+	if err != nil {
+		return err
+	}
+	conv := client.NewConversation()
+
+	clientFirst, err := conv.Step("")
+	if err != nil {
+		return err
+	}
+	serverFirst, err := c.saslExchange(&pgproto.PasswordMessage{
+		HeaderMessage: []byte(pgproto.SASLMechanismScramSHA256),
+		BodyMessage:   []byte(clientFirst),
+	})
+	if err != nil {
+		return err
+	}
+
+	clientFinal, err := conv.Step(string(serverFirst))
+	if err != nil {
+		return err
+	}
+	serverFinal, err := c.saslExchange(&pgproto.PasswordMessage{BodyMessage: []byte(clientFinal)})
+	if err != nil {
+		return err
+	}
+
+	_, err = conv.Step(string(serverFinal))
+	return err
+}
+
+func (c *Client) saslExchange(msg *pgproto.PasswordMessage) ([]byte, error) {
+	err := writeMessages(c.conn, msg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := pgproto.ParseServerMessage(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	switch m := resp.(type) {
+	case *pgproto.AuthenticationRequest:
+		return m.Message, nil
+	case *pgproto.Error:
+		return nil, fmt.Errorf("%s", m.Message)
+	}
+	return nil, fmt.Errorf("unexpected %T during SASL authentication", resp)
+}
+
+// Query runs query with the simple query protocol, returning its rows as text
+func (c *Client) Query(query string) ([][]string, error) {
+	err := writeMessages(c.conn, &pgproto.SimpleQuery{Query: []byte(query)})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	var errs []string
+	for {
+		msg, err := pgproto.ParseServerMessage(c.conn)
+		if err != nil {
+			return nil, err
+		}
+
+		switch m := msg.(type) {
+		case *pgproto.DataRow:
+			row := make([]string, len(m.Fields))
+			for i, field := range m.Fields {
+				row[i] = string(field)
+			}
+			rows = append(rows, row)
+		case *pgproto.Error:
+			errs = append(errs, string(m.Message))
+		case *pgproto.ReadyForQuery:
+			if len(errs) > 0 {
+				return rows, fmt.Errorf("%s", strings.Join(errs, "; "))
+			}
+			return rows, nil
+		}
+	}
+}
+
+// Send writes msgs to the server as they are
+func (c *Client) Send(msgs ...pgproto.Message) error {
+	return writeMessages(c.conn, msgs...)
+}
+
+// Receive reads the next message from the server
+func (c *Client) Receive() (pgproto.ServerMessage, error) {
+	return pgproto.ParseServerMessage(c.conn)
+}
+
+// Close terminates the session
+func (c *Client) Close() error {
+	writeMessages(c.conn, &pgproto.Termination{})
+	return c.conn.Close()
+}
+
+func writeMessages(w io.Writer, msgs ...pgproto.Message) error {
+	_, err := pgproto.WriteMessages(msgs, w)
+	return err
+}
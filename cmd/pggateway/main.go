@@ -9,13 +9,18 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
+	"syscall"
 
 	"github.com/c653labs/pggateway"
 	_ "github.com/c653labs/pggateway/plugins/cloudwatchlogs-logging"
 	_ "github.com/c653labs/pggateway/plugins/file-logging"
 	_ "github.com/c653labs/pggateway/plugins/iam-authentication"
+	_ "github.com/c653labs/pggateway/plugins/masking-response"
 	_ "github.com/c653labs/pggateway/plugins/passthrough-authentication"
+	_ "github.com/c653labs/pggateway/plugins/pgaudit-hooks"
+	_ "github.com/c653labs/pggateway/plugins/syslog-logging"
 	_ "github.com/c653labs/pggateway/plugins/virtualuser-authentication"
+	_ "github.com/c653labs/pggateway/plugins/webhook-authentication"
 )
 
 var (
@@ -31,6 +36,10 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
 	if traceFile != "" {
@@ -88,6 +97,32 @@ func main() {
 	}()
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
-	<-sig
+	signal.Notify(sig, os.Interrupt, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	for received := range sig {
+		if received == syscall.SIGUSR1 {
+			// Log files were moved by an external log rotation
+			s.ReopenLogs()
+			continue
+		}
+		if received == syscall.SIGUSR2 {
+			s.InvalidateCaches()
+			continue
+		}
+		if received != syscall.SIGHUP {
+			break
+		}
+
+		// Reload the config file and apply it to the running server
+		c := pggateway.NewConfig()
+		cf, err := ioutil.ReadFile(configFilename)
+		if err == nil {
+			err = c.Unmarshal(cf)
+		}
+		if err == nil {
+			err = s.Reload(c)
+		}
+		if err != nil {
+			log.Printf("error reloading config: %v", err)
+		}
+	}
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+)
+
+type replayReport struct {
+	file       string
+	statements int
+	errors     []string
+	original   time.Duration
+	replayed   time.Duration
+}
+
+// replay runs `pggateway replay [flags] capture...`, replaying each captured session
+// concurrently against a target and reporting errors and latency differences
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := flags.String("target", "127.0.0.1:5432", "target address to replay against")
+	user := flags.String("user", "", "user to connect as, default the captured user")
+	password := flags.String("password", "", "password to authenticate with")
+	database := flags.String("database", "", "database to connect to, default the captured database")
+	speed := flags.Float64("speed", 1, "replay speed multiplier, 0 replays as fast as possible")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		log.Fatal("no capture files given")
+	}
+
+	// Sessions start as far apart as they did when they were captured
+	started := make([]time.Time, flags.NArg())
+	var first time.Time
+	for i, name := range flags.Args() {
+		var err error
+		started[i], err = captureStarted(name)
+		if err != nil {
+			log.Fatalf("%s: %s", name, err)
+		}
+		if first.IsZero() || started[i].Before(first) {
+			first = started[i]
+		}
+	}
+
+	start := time.Now()
+	reports := make([]*replayReport, flags.NArg())
+	var wg sync.WaitGroup
+	for i, name := range flags.Args() {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			report, err := replayFile(name, *target, *user, *password, *database, *speed, start, started[i].Sub(first))
+			if err != nil {
+				report.errors = append(report.errors, err.Error())
+			}
+			reports[i] = report
+		}(i, name)
+	}
+	wg.Wait()
+
+	failed := false
+	for _, r := range reports {
+		fmt.Printf("%s: %d statements, %d errors", r.file, r.statements, len(r.errors))
+		if r.statements > 0 {
+			original := r.original / time.Duration(r.statements)
+			replayed := r.replayed / time.Duration(r.statements)
+			fmt.Printf(", mean latency %s original, %s replayed (%+s)", original, replayed, replayed-original)
+		}
+		fmt.Println()
+		for _, e := range r.errors {
+			fmt.Printf("  error: %s\n", e)
+		}
+		failed = failed || len(r.errors) > 0
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func captureStarted(name string) (time.Time, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	capture, err := pggateway.NewCaptureReader(f)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return capture.Header.Started, nil
+}
+
+// replayFile replays a captured session, offset from start by delay, the time it started after the first one
+func replayFile(name string, target string, user string, password string, database string, speed float64, start time.Time, delay time.Duration) (*replayReport, error) {
+	report := &replayReport{file: name}
+	// Keep the original pacing of the sessions, scaled by speed
+	wait := func(offset time.Duration) {
+		if speed > 0 {
+			wait := time.Duration(float64(delay+offset)/speed) - time.Since(start)
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+
+	capture, err := pggateway.NewCaptureReader(f)
+	if err != nil {
+		return report, err
+	}
+	if user == "" {
+		user = capture.Header.User
+	}
+	if database == "" {
+		database = capture.Header.Database
+	}
+
+	wait(0)
+	client, err := pggateway.ConnectClient(target, user, password, database)
+	if err != nil {
+		return report, err
+	}
+	defer client.Close()
+
+	var pending []time.Time
+	var pendingOriginal []time.Duration
+	for {
+		rec, err := capture.Next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+
+		if rec.Kind == pggateway.CaptureReadyForQuery {
+			if len(pending) == 0 {
+				continue
+			}
+			report.original += rec.Offset - pendingOriginal[0]
+			pendingOriginal = pendingOriginal[1:]
+
+			// Wait for the matching ReadyForQuery from the replay target
+			errs, err := receiveUntilReady(client)
+			if err != nil {
+				return report, err
+			}
+			report.replayed += time.Since(pending[0])
+			report.statements++
+			report.errors = append(report.errors, errs...)
+			pending = pending[1:]
+			continue
+		}
+
+		msg, err := rec.ClientMessage()
+		if err != nil {
+			return report, err
+		}
+
+		wait(rec.Offset)
+		if _, ok := msg.(*pgproto.Termination); ok {
+			return report, nil
+		}
+		err = client.Send(msg)
+		if err != nil {
+			return report, err
+		}
+
+		switch msg.(type) {
+		case *pgproto.SimpleQuery, *pgproto.Sync:
+			pending = append(pending, time.Now())
+			pendingOriginal = append(pendingOriginal, rec.Offset)
+		}
+	}
+}
+
+func receiveUntilReady(client *pggateway.Client) ([]string, error) {
+	var errs []string
+	for {
+		msg, err := client.Receive()
+		if err != nil {
+			return errs, err
+		}
+		switch m := msg.(type) {
+		case *pgproto.Error:
+			errs = append(errs, string(m.Message))
+		case *pgproto.ReadyForQuery:
+			return errs, nil
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package pggateway
 
 import (
+	"fmt"
+	"time"
+
 	"gopkg.in/yaml.v3"
 )
 
@@ -8,6 +11,8 @@ type Config struct {
 	Procs     int                  `yaml:"procs,omitempty"`
 	Logging   map[string]ConfigMap `yaml:"logging,omitempty"`
 	Listeners []*ListenerConfig    `yaml:"listeners,omitempty"`
+	Tracing   TracingConfig        `yaml:"tracing,omitempty"`
+	Admin     AdminConfig          `yaml:"admin,omitempty"`
 }
 
 // TargetConfig
@@ -18,6 +23,10 @@ type TargetConfig struct {
 	User      string   `yaml:"user,omitempty"`
 	Password  string   `yaml:"password,omitempty"`
 	Databases []string `yaml:"databases,omitempty"`
+	// ProxyProtocol is the PROXY protocol version, "v1" or "v2", to send when dialing the target
+	ProxyProtocol string `yaml:"proxy_protocol,omitempty" json:"proxy_protocol,omitempty"`
+	// SSLNegotiation is "postgres" (SSLRequest, the default) or "direct" (PostgreSQL 17+)
+	SSLNegotiation string `yaml:"sslnegotiation,omitempty" json:"sslnegotiation,omitempty"`
 }
 
 // SSLConfig
@@ -26,6 +35,18 @@ type SSLConfig struct {
 	Required    bool   `yaml:"required,omitempty"`
 	Certificate string `yaml:"certificate,omitempty"`
 	Key         string `yaml:"key,omitempty"`
+
+	Certificates []SSLCertificateConfig `yaml:"certificates,omitempty"`
+
+	MinVersion     string        `yaml:"min_version,omitempty"`
+	CipherSuites   []string      `yaml:"cipher_suites,omitempty"`
+	Curves         []string      `yaml:"curves,omitempty"`
+	ReloadInterval time.Duration `yaml:"reload_interval,omitempty"`
+
+	// ClientCA verifies the certificates clients present, which are requested once it is set
+	ClientCA string `yaml:"client_ca,omitempty"`
+	// ClientCertRequired rejects clients without a certificate signed by ClientCA
+	ClientCertRequired bool `yaml:"client_cert_required,omitempty"`
 }
 
 type ConfigMap map[string]interface{}
@@ -72,11 +93,57 @@ func (c ConfigMap) BoolDefault(name string, d bool) bool {
 	return b
 }
 
+func (c ConfigMap) Int(name string) (int, bool) {
+	v, ok := c[name]
+	if !ok {
+		return 0, false
+	}
+
+	i, ok := v.(int)
+	if !ok {
+		return 0, false
+	}
+	return i, true
+}
+
+func (c ConfigMap) IntDefault(name string, d int) int {
+	i, ok := c.Int(name)
+	if !ok {
+		return d
+	}
+	return i
+}
+
+// Duration parses a duration string such as "5s"
+func (c ConfigMap) Duration(name string) (time.Duration, bool) {
+	s, ok := c.String(name)
+	if !ok {
+		return 0, false
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, false
+	}
+	return d, true
+}
+
+func (c ConfigMap) DurationDefault(name string, d time.Duration) time.Duration {
+	v, ok := c.Duration(name)
+	if !ok {
+		return d
+	}
+	return v
+}
+
 func (c ConfigMap) Map(name string) (ConfigMap, bool) {
 	raw, ok := c[name]
 	if !ok {
 		return nil, false
 	}
+	if value, ok := raw.(map[string]interface{}); ok {
+		return ConfigMap(value), true
+	}
 	value, ok := raw.(map[interface{}]interface{})
 	if !ok {
 		return nil, false
@@ -95,10 +162,31 @@ func (c ConfigMap) Map(name string) (ConfigMap, bool) {
 
 // ListenerConfig
 type ListenerConfig struct {
+	// Bind identifies the listener, it must be unique as reloads match listeners by it
 	Bind           string                 `yaml:"bind,omitempty"`
+	Socket         UnixSocketConfig       `yaml:"socket,omitempty"`
+	ProxyProtocol  ProxyProtocolConfig    `yaml:"proxy_protocol,omitempty"`
 	SSL            SSLConfig              `yaml:"ssl,omitempty"`
 	Authentication map[string]interface{} `yaml:"authentication,omitempty"`
 	Logging        map[string]ConfigMap   `yaml:"logging,omitempty"`
+	Limits         LimitsConfig           `yaml:"limits,omitempty"`
+	Timeouts       TimeoutsConfig         `yaml:"timeouts,omitempty"`
+	Routes         []*RouteConfig         `yaml:"routes,omitempty"`
+	Replication    bool                   `yaml:"replication,omitempty"`
+	Inspect        *bool                  `yaml:"inspect,omitempty"`
+	Capture        CaptureConfig          `yaml:"capture,omitempty"`
+	Mirror         MirrorConfig           `yaml:"mirror,omitempty"`
+	Responses      map[string]interface{} `yaml:"responses,omitempty"`
+	Cache          CacheConfig            `yaml:"cache,omitempty"`
+	Hooks          map[string]interface{} `yaml:"hooks,omitempty"`
+
+	// ReplicationUsers restricts replication connections to these users, all users may open them when empty
+	ReplicationUsers []string `yaml:"replication_users,omitempty"`
+}
+
+// InspectMessages reports whether sessions should parse messages after authentication, the default
+func (c *ListenerConfig) InspectMessages() bool {
+	return c.Inspect == nil || *c.Inspect
 }
 
 func NewConfig() *Config {
@@ -111,6 +199,18 @@ func (c *Config) Unmarshal(in []byte) error {
 	return yaml.Unmarshal(in, c)
 }
 
+// Validate checks the parts of the config the listeners rely on being consistent
+func (c *Config) Validate() error {
+	binds := make(map[string]bool)
+	for _, l := range c.Listeners {
+		if binds[l.Bind] {
+			return fmt.Errorf("listener bind %#v is configured more than once", l.Bind)
+		}
+		binds[l.Bind] = true
+	}
+	return nil
+}
+
 func (c *Config) GetListeners() []*Listener {
 	listeners := make([]*Listener, 0)
 	for _, config := range c.Listeners {
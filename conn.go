@@ -0,0 +1,35 @@
+package pggateway
+
+import (
+	"bufio"
+	"net"
+)
+
+// bufferedConn allows peeking at the first bytes sent by a client,
+// and replacing its remote address with the one sent in a PROXY header
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	if bc, ok := conn.(*bufferedConn); ok {
+		return bc
+	}
+	return &bufferedConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,41 @@
+package pggateway
+
+import (
+	"context"
+	"sync"
+)
+
+// errGroup runs goroutines until all of them return, cancelling its context
+// as soon as the first of them fails, like golang.org/x/sync/errgroup
+type errGroup struct {
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+	cancel context.CancelFunc
+}
+
+func newErrGroup(ctx context.Context) (*errGroup, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &errGroup{cancel: cancel}, ctx
+}
+
+func (g *errGroup) Go(f func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		err := f()
+		if err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// Wait blocks until all goroutines returned, and returns the first error
+func (g *errGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
@@ -0,0 +1,206 @@
+package pggateway
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/c653labs/pgproto"
+)
+
+// SessionEventType
+type SessionEventType string
+
+const (
+	// SessionConnect is sent once the startup message was read, before authentication
+	SessionConnect SessionEventType = "connect"
+	// SessionAuthenticated is sent once authentication succeeded, before any statements,
+	// for passthrough authentication once the target accepted the client's credentials
+	SessionAuthenticated SessionEventType = "authenticated"
+	// SessionStatement is sent for every simple query and every extended query Execute,
+	// once it, or for an Execute the batch it belongs to, passed the limits, or was answered from the cache
+	SessionStatement SessionEventType = "statement"
+	// SessionError is sent for every error from the target, and when the session ends with an error
+	SessionError SessionEventType = "error"
+	// SessionClose is sent once the session has ended
+	SessionClose SessionEventType = "close"
+)
+
+// SessionInfo is a read-only view of a session at the time of an event
+type SessionInfo struct {
+	ID                string
+	User              string
+	Database          string
+	ClientAddr        net.Addr
+	SSL               bool
+	ServerName        string
+	Replication       bool
+	StartupParameters map[string]string
+
+	Connected     time.Time
+	Authenticated time.Time
+	Statements    int64
+	BytesToServer int64
+	BytesToClient int64
+}
+
+// SessionEvent
+type SessionEvent struct {
+	Type    SessionEventType
+	Time    time.Time
+	Session SessionInfo
+	// Query is set for SessionStatement events
+	Query string
+	// Parameters are the Bind parameters of extended query statements, nil for NULL,
+	// ParameterFormats their format codes as sent: none for all text, a single one for all, or one each
+	Parameters       [][]byte
+	ParameterFormats []int
+	// Err is set for SessionError events
+	Err error
+}
+
+// SessionHookPlugin reacts to the events of every session
+type SessionHookPlugin interface {
+	Plugin
+	// HandleSessionEvent is called synchronously, so it should return quickly.
+	// Returning an error for SessionConnect and SessionAuthenticated events rejects the session,
+	// it is only logged for other events.
+	HandleSessionEvent(*SessionEvent) error
+}
+
+// SessionRejectedError is returned when a session hook rejected the session
+type SessionRejectedError struct {
+	Hook string
+	Err  error
+}
+
+func (e *SessionRejectedError) Error() string {
+	return fmt.Sprintf("session rejected by %s hook: %s", e.Hook, e.Err)
+}
+
+// Info returns the read-only view of s passed to session hooks
+func (s *Session) Info() SessionInfo {
+	info := SessionInfo{
+		ID:            s.ID,
+		User:          string(s.User),
+		Database:      string(s.Database),
+		SSL:           s.IsSSL,
+		ServerName:    s.ServerName,
+		Replication:   s.IsReplication,
+		Connected:     s.connected,
+		Statements:    atomic.LoadInt64(&s.statements),
+		BytesToServer: s.BytesToServer(),
+		BytesToClient: s.BytesToClient(),
+	}
+	if authenticated := atomic.LoadInt64(&s.authenticated); authenticated != 0 {
+		info.Authenticated = time.Unix(0, authenticated)
+	}
+	if s.client != nil {
+		info.ClientAddr = s.client.RemoteAddr()
+	}
+	if s.startup != nil {
+		info.StartupParameters = make(map[string]string, len(s.startup.Options))
+		for name, value := range s.startup.Options {
+			info.StartupParameters[name] = string(value)
+		}
+	}
+	return info
+}
+
+// sessionEvent sends an event to the session hooks, returning the error of the first one
+// rejecting a SessionConnect or SessionAuthenticated event
+func (s *Session) sessionEvent(event SessionEventType, query string, eventErr error) *SessionRejectedError {
+	if !s.plugins.HasSessionHooks() {
+		return nil
+	}
+
+	return s.handleSessionEvent(&SessionEvent{
+		Type:    event,
+		Time:    time.Now(),
+		Session: s.Info(),
+		Query:   query,
+		Err:     eventErr,
+	})
+}
+
+func (s *Session) handleSessionEvent(e *SessionEvent) *SessionRejectedError {
+	event := e.Type
+	for name, hook := range s.plugins.sessionHooks {
+		err := hook.HandleSessionEvent(e)
+		if err == nil {
+			continue
+		}
+		if event == SessionConnect || event == SessionAuthenticated {
+			return &SessionRejectedError{Hook: name, Err: err}
+		}
+		s.plugins.LogError(s.loggingContext(), "error handling %s event in %s hook: %s", event, name, err)
+	}
+	return nil
+}
+
+// authenticationDone records the time authentication completed and sends the SessionAuthenticated event
+func (s *Session) authenticationDone() error {
+	atomic.StoreInt64(&s.authenticated, time.Now().UnixNano())
+	if rejected := s.sessionEvent(SessionAuthenticated, "", nil); rejected != nil {
+		return s.rejectSession(rejected)
+	}
+	return nil
+}
+
+// portal is a bound statement, as far as session hooks need to know
+type portal struct {
+	query string
+	bind  *pgproto.Bind
+}
+
+// trackStatement follows the queries of prepared statements and portals, so Execute events carry them
+func (s *Session) trackStatement(msg pgproto.ClientMessage) {
+	if s.prepared == nil {
+		s.prepared = make(map[string]string)
+		s.portals = make(map[string]*portal)
+	}
+	switch m := msg.(type) {
+	case *pgproto.Parse:
+		s.prepared[string(m.Name)] = string(m.Query)
+	case *pgproto.Bind:
+		s.portals[string(m.Portal)] = &portal{query: s.prepared[string(m.Statement)], bind: m}
+	case *pgproto.Close:
+		if m.ObjectType == pgproto.ObjectTypePortal {
+			delete(s.portals, string(m.Name))
+		} else {
+			delete(s.prepared, string(m.Name))
+		}
+	}
+}
+
+// statementEvent counts the statement run by msg and sends the SessionStatement event for it
+func (s *Session) statementEvent(msg pgproto.ClientMessage) {
+	e := &SessionEvent{Type: SessionStatement}
+	switch m := msg.(type) {
+	case *pgproto.SimpleQuery:
+		e.Query = string(m.Query)
+	case *pgproto.Execute:
+		if p, ok := s.portals[string(m.Portal)]; ok {
+			e.Query = p.query
+			e.Parameters = p.bind.Parameters
+			e.ParameterFormats = p.bind.ParameterFormats
+		}
+	default:
+		return
+	}
+	atomic.AddInt64(&s.statements, 1)
+	if !s.plugins.HasSessionHooks() {
+		return
+	}
+	e.Time = time.Now()
+	e.Session = s.Info()
+	s.handleSessionEvent(e)
+}
+
+// rejectSession tells the client it was rejected by a session hook
+func (s *Session) rejectSession(err *SessionRejectedError) error {
+	s.plugins.LogWarn(s.loggingContext(), "%s", err)
+	RetunErrorfAndWritePGMsg(s.client, "connection rejected: %s", err.Err)
+	return err
+}
@@ -0,0 +1,267 @@
+package pggateway_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pgproto"
+)
+
+// recorder is a session hook keeping every event, rejecting those of its reject type
+type recorder struct {
+	reject pggateway.SessionEventType
+
+	mutex  sync.Mutex
+	events []*pggateway.SessionEvent
+}
+
+var recorders = make(chan *recorder, 1)
+
+func init() {
+	pggateway.RegisterSessionHookPlugin("recorder", func(config interface{}) (pggateway.SessionHookPlugin, error) {
+		r := &recorder{}
+		if reject, ok := config.(string); ok {
+			r.reject = pggateway.SessionEventType(reject)
+		}
+		recorders <- r
+		return r, nil
+	})
+}
+
+func (r *recorder) HandleSessionEvent(e *pggateway.SessionEvent) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, e)
+	if e.Type == r.reject {
+		return errors.New("rejected by test")
+	}
+	return nil
+}
+
+func (r *recorder) recorded() []*pggateway.SessionEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]*pggateway.SessionEvent(nil), r.events...)
+}
+
+func startRecordedGateway(t *testing.T, srv *pgtest.Server, reject string) (*pgtest.Gateway, *recorder) {
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Hooks:          map[string]interface{}{"recorder": reject},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gw, <-recorders
+}
+
+func TestSessionHooks(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	srv.SetResult("SELECT broken", pgtest.Result{Error: "broken"})
+
+	gw, r := startRecordedGateway(t, srv, "")
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Query("SELECT broken")
+	if err == nil {
+		t.Fatal("expected the target's error")
+	}
+	client.Close()
+	// Closing the gateway waits for the session to end
+	gw.Close()
+
+	var types []pggateway.SessionEventType
+	for _, e := range r.recorded() {
+		types = append(types, e.Type)
+		if e.Session.User != "app" || e.Session.Database != "app" {
+			t.Errorf("%s event for the wrong session %+v", e.Type, e.Session)
+		}
+	}
+	want := []pggateway.SessionEventType{
+		pggateway.SessionConnect,
+		pggateway.SessionAuthenticated,
+		pggateway.SessionStatement,
+		pggateway.SessionStatement,
+		pggateway.SessionError,
+	}
+	if len(types) < len(want) || !reflect.DeepEqual(types[:len(want)], want) {
+		t.Fatalf("unexpected events %v", types)
+	}
+	if types[len(types)-1] != pggateway.SessionClose {
+		t.Fatalf("last event is %s, expected %s", types[len(types)-1], pggateway.SessionClose)
+	}
+	if events := r.recorded(); events[2].Query != "SELECT 1" || events[3].Query != "SELECT broken" {
+		t.Fatalf("unexpected statements %q and %q", events[2].Query, events[3].Query)
+	}
+}
+
+func TestSessionHooksReject(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, event := range []pggateway.SessionEventType{pggateway.SessionConnect, pggateway.SessionAuthenticated} {
+		t.Run(string(event), func(t *testing.T) {
+			gw, _ := startRecordedGateway(t, srv, string(event))
+			defer gw.Close()
+
+			_, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+			if err == nil || !strings.Contains(err.Error(), "connection rejected: rejected by test") {
+				t.Fatalf("expected the session to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionHooksPassthroughAuthentication(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.AuthMethod = pgtest.AuthMD5
+	srv.Users["app"] = "secret"
+
+	gw, r := startRecordedGateway(t, srv, "")
+	_, err = pgtest.Connect(gw.Addr(), "app", "wrong", "app")
+	if err == nil {
+		t.Fatal("connected with the wrong password")
+	}
+	client, err := pgtest.Connect(gw.Addr(), "app", "secret", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	gw.Close()
+
+	// Only the session the target accepted was authenticated
+	var authenticated []pggateway.SessionEvent
+	for _, e := range r.recorded() {
+		if e.Type == pggateway.SessionAuthenticated {
+			authenticated = append(authenticated, *e)
+		}
+	}
+	if len(authenticated) != 1 {
+		t.Fatalf("%d authenticated events, expected 1", len(authenticated))
+	}
+	if authenticated[0].Session.Authenticated.IsZero() {
+		t.Fatal("authenticated event without an authentication time")
+	}
+}
+
+func TestSessionHooksExtendedStatements(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT $1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	gw, r := startRecordedGateway(t, srv, "")
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A prepared statement is reported every time it runs, not when it is parsed
+	msgs := []pgproto.Message{&pgproto.Parse{Name: []byte("s1"), Query: []byte("SELECT $1")}, &pgproto.Sync{}}
+	for _, id := range []string{"1", "2"} {
+		msgs = append(msgs,
+			&pgproto.Bind{Statement: []byte("s1"), Parameters: [][]byte{[]byte(id)}},
+			&pgproto.Execute{},
+			&pgproto.Sync{},
+		)
+	}
+	err = client.Send(msgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ready := 0; ready < 3; {
+		msg, err := client.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+			ready++
+		}
+	}
+	client.Close()
+	gw.Close()
+
+	var statements []string
+	for _, e := range r.recorded() {
+		if e.Type == pggateway.SessionStatement {
+			statements = append(statements, e.Query)
+		}
+	}
+	if want := []string{"SELECT $1", "SELECT $1"}; !reflect.DeepEqual(statements, want) {
+		t.Fatalf("statements %q, expected %q", statements, want)
+	}
+}
+
+func TestSessionHooksLimits(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	srv.SetResult("SELECT slow", pgtest.Result{Columns: []string{"slow"}, Rows: [][]string{{"done"}}, Delay: 200 * time.Millisecond})
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Limits:         pggateway.LimitsConfig{MaxConcurrent: 1, FailFast: true},
+		Hooks:          map[string]interface{}{"recorder": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-recorders
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Statements rejected by the limits, simple or extended, are not reported
+	msgs := []pgproto.Message{&pgproto.SimpleQuery{Query: []byte("SELECT slow")}}
+	msgs = append(msgs, extendedBatch("SELECT 1")...)
+	msgs = append(msgs, &pgproto.SimpleQuery{Query: []byte("SELECT 1")})
+	err = client.Send(msgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveTypes(t, client, 3)
+	_, err = client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	gw.Close()
+
+	var statements []string
+	for _, e := range r.recorded() {
+		if e.Type == pggateway.SessionStatement {
+			statements = append(statements, e.Query)
+		}
+	}
+	if want := []string{"SELECT slow", "SELECT 1"}; !reflect.DeepEqual(statements, want) {
+		t.Fatalf("statements %q, expected %q", statements, want)
+	}
+}
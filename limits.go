@@ -0,0 +1,202 @@
+package pggateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LimitsConfig caps the statements each user/database pair sends to the target through a listener,
+// statements over the limits wait for their turn unless FailFast is set
+type LimitsConfig struct {
+	// StatementsPerSecond is the token bucket rate, Burst its size
+	StatementsPerSecond float64 `yaml:"statements_per_second,omitempty"`
+	Burst               int     `yaml:"burst,omitempty"`
+	// MaxConcurrent caps the statements waiting for the target's ReadyForQuery at once
+	MaxConcurrent int `yaml:"max_concurrent,omitempty"`
+	// FailFast rejects statements over the limits with an error instead of delaying them,
+	// the messages of a rejected extended query batch are discarded up to its Sync
+	FailFast bool `yaml:"fail_fast,omitempty"`
+}
+
+var errLimiterClosed = errors.New("limiter closed")
+
+// LimitError rejects a statement over the limits, Code is the SQLSTATE sent to the client
+type LimitError struct {
+	Code   string
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return "statement limit exceeded: " + e.Reason
+}
+
+func (c LimitsConfig) Enabled() bool {
+	return c.StatementsPerSecond > 0 || c.MaxConcurrent > 0
+}
+
+type limitBucket struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// Limiter enforces statement rate and concurrency limits per user/database pair
+type Limiter struct {
+	mutex   sync.Mutex
+	config  LimitsConfig
+	buckets map[string]*limitBucket
+	// changed is closed whenever a slot is released or the limits change, waking up waiting statements
+	changed chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewLimiter(config LimitsConfig) *Limiter {
+	return &Limiter{
+		config:  config,
+		buckets: make(map[string]*limitBucket),
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (l *Limiter) Update(config LimitsConfig) {
+	l.mutex.Lock()
+	l.config = config
+	l.notify()
+	l.mutex.Unlock()
+}
+
+// Close fails the statements waiting in Acquire
+func (l *Limiter) Close() {
+	l.closeOnce.Do(func() { close(l.closed) })
+}
+
+// notify wakes up waiting statements, the caller holds the mutex
+func (l *Limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *Limiter) Config() LimitsConfig {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.config
+}
+
+func (l *Limiter) burst() float64 {
+	if l.config.Burst > 0 {
+		return float64(l.config.Burst)
+	}
+	if l.config.StatementsPerSecond < 1 {
+		return 1
+	}
+	return l.config.StatementsPerSecond
+}
+
+func (l *Limiter) bucket(key string, now time.Time) *limitBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &limitBucket{tokens: l.burst(), last: now}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// tryAcquire takes a slot for key, or returns why it can't with how long to wait before trying again,
+// zero when only a released slot or a change of limits can let it through
+func (l *Limiter) tryAcquire(key string) (time.Duration, <-chan struct{}, *LimitError) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	b := l.bucket(key, now)
+
+	if l.config.StatementsPerSecond > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * l.config.StatementsPerSecond
+		if max := l.burst(); b.tokens > max {
+			b.tokens = max
+		}
+	}
+	b.last = now
+
+	if l.config.MaxConcurrent > 0 && b.active >= l.config.MaxConcurrent {
+		return 0, l.changed, &LimitError{
+			Code:   "53300", // too_many_connections
+			Reason: fmt.Sprintf("max %d concurrent statements", l.config.MaxConcurrent),
+		}
+	}
+	if l.config.StatementsPerSecond > 0 {
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / l.config.StatementsPerSecond * float64(time.Second))
+			return wait, l.changed, &LimitError{
+				Code:   "54000", // program_limit_exceeded
+				Reason: fmt.Sprintf("max %g statements per second", l.config.StatementsPerSecond),
+			}
+		}
+		b.tokens--
+	}
+	b.active++
+	return 0, nil, nil
+}
+
+// Acquire blocks until a statement for key may be forwarded, or returns a *LimitError
+// straight away when failFast is set. Waiting ends with an error when ctx is done or the
+// limiter is closed. The returned bool reports whether the limit engaged for this statement.
+func (l *Limiter) Acquire(ctx context.Context, key string, failFast bool) (bool, error) {
+	engaged := false
+	for {
+		wait, changed, err := l.tryAcquire(key)
+		if err == nil {
+			return engaged, nil
+		}
+		engaged = true
+		if failFast {
+			return engaged, err
+		}
+
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		var done error
+		select {
+		case <-expired:
+		case <-changed:
+		case <-ctx.Done():
+			done = ctx.Err()
+		case <-l.closed:
+			done = errLimiterClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if done != nil {
+			return engaged, done
+		}
+	}
+}
+
+// Release frees a concurrency slot taken by Acquire
+func (l *Limiter) Release(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return
+	}
+	if b.active > 0 {
+		b.active--
+		l.notify()
+	}
+	if b.active == 0 && (l.config.StatementsPerSecond <= 0 || b.tokens >= l.burst()) {
+		delete(l.buckets, key)
+	}
+}
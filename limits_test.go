@@ -0,0 +1,232 @@
+package pggateway_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pgproto"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := pggateway.NewLimiter(pggateway.LimitsConfig{MaxConcurrent: 1})
+	_, err := l.Acquire(ctx, "app/app", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other users have their own slots
+	_, err = l.Acquire(ctx, "other/app", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = l.Acquire(ctx, "app/app", true)
+	if limitErr, ok := err.(*pggateway.LimitError); !ok || limitErr.Code != "53300" {
+		t.Fatalf("expected a 53300 limit error, got %v", err)
+	}
+
+	// Waiting statements go through once a slot is released
+	acquired := make(chan error, 1)
+	go func() {
+		engaged, err := l.Acquire(ctx, "app/app", false)
+		if err == nil && !engaged {
+			t.Error("statement not reported as delayed")
+		}
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquired a slot in use: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Release("app/app")
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancelling the session or closing the limiter ends the wait
+	cancelled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = l.Acquire(cancelled, "app/app", false)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		l.Close()
+	}()
+	_, err = l.Acquire(ctx, "app/app", false)
+	if err == nil {
+		t.Fatal("acquired a slot in use from a closed limiter")
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := pggateway.NewLimiter(pggateway.LimitsConfig{StatementsPerSecond: 20, Burst: 1})
+	ctx := context.Background()
+	_, err := l.Acquire(ctx, "app/app", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Release("app/app")
+	_, err = l.Acquire(ctx, "app/app", true)
+	if limitErr, ok := err.(*pggateway.LimitError); !ok || limitErr.Code != "54000" {
+		t.Fatalf("expected a 54000 limit error, got %v", err)
+	}
+
+	start := time.Now()
+	engaged, err := l.Acquire(ctx, "app/app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !engaged || time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("statement not delayed until the next token, engaged %v after %s", engaged, time.Since(start))
+	}
+
+	// Lifting the limits lets statements through straight away
+	l.Update(pggateway.LimitsConfig{})
+	_, err = l.Acquire(ctx, "app/app", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func startLimitedGateway(t *testing.T, srv *pgtest.Server, limits pggateway.LimitsConfig) *pgtest.Gateway {
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	srv.SetResult("SELECT slow", pgtest.Result{Columns: []string{"slow"}, Rows: [][]string{{"done"}}, Delay: 200 * time.Millisecond})
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Limits:         limits,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gw.Close() })
+	return gw
+}
+
+func extendedBatch(query string) []pgproto.Message {
+	return []pgproto.Message{
+		&pgproto.Parse{Query: []byte(query)},
+		&pgproto.Bind{},
+		&pgproto.Execute{},
+		&pgproto.Sync{},
+	}
+}
+
+// receiveTypes reads messages up to the count-th ReadyForQuery, returning their types
+func receiveTypes(t *testing.T, client *pgtest.Client, count int) []string {
+	var types []string
+	for count > 0 {
+		msg, err := client.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch m := msg.(type) {
+		case *pgproto.Error:
+			types = append(types, "Error "+string(m.Code))
+		case *pgproto.ReadyForQuery:
+			types = append(types, "ReadyForQuery")
+			count--
+		default:
+			types = append(types, reflect.TypeOf(msg).Elem().Name())
+		}
+	}
+	return types
+}
+
+func TestLimitsExtendedProtocol(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	gw := startLimitedGateway(t, srv, pggateway.LimitsConfig{MaxConcurrent: 1})
+
+	slow, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	slowDone := make(chan time.Time, 1)
+	go func() {
+		_, err := slow.Query("SELECT slow")
+		if err != nil {
+			t.Error(err)
+		}
+		slowDone <- time.Now()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The batch waits from its Parse, the target would run it before its Sync arrives
+	err = client.Send(extendedBatch("SELECT 1")...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := receiveTypes(t, client, 1)
+	done := time.Now()
+	expected := []string{"ParseComplete", "BindComplete", "DataRow", "CommandCompletion", "ReadyForQuery"}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+	if slowDone := <-slowDone; done.Before(slowDone) {
+		t.Fatal("extended query ran alongside the statement holding the only slot")
+	}
+	if queries := srv.Queries(); !reflect.DeepEqual(queries, []string{"SELECT slow", "SELECT 1"}) {
+		t.Fatalf("target received %v", queries)
+	}
+}
+
+func TestLimitsFailFast(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	gw := startLimitedGateway(t, srv, pggateway.LimitsConfig{MaxConcurrent: 1, FailFast: true})
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Rejections are answered after the responses to the statements pipelined before them
+	msgs := []pgproto.Message{&pgproto.SimpleQuery{Query: []byte("SELECT slow")}}
+	msgs = append(msgs, extendedBatch("SELECT 1")...)
+	msgs = append(msgs, &pgproto.SimpleQuery{Query: []byte("SELECT 1")})
+	err = client.Send(msgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := receiveTypes(t, client, 3)
+	expected := []string{
+		"RowDescription", "DataRow", "CommandCompletion", "ReadyForQuery",
+		"Error 53300", "ReadyForQuery",
+		"Error 53300", "ReadyForQuery",
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+	if queries := srv.Queries(); !reflect.DeepEqual(queries, []string{"SELECT slow"}) {
+		t.Fatalf("target received rejected statements: %v", queries)
+	}
+
+	// The session goes on once the slot is free
+	rows, err := client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0][0] != "1" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+}
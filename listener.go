@@ -1,67 +1,171 @@
 package pggateway
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"github.com/c653labs/pgproto"
 	"io"
 	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tlsHandshakeRecord = 0x16
+	alpnProtocol       = "postgresql"
 )
 
 type Listener struct {
-	l        net.Listener
-	config   *ListenerConfig
-	plugins  *PluginRegistry
-	stopping bool
+	l       net.Listener
+	config  *ListenerConfig
+	plugins *PluginRegistry
+	limiter *Limiter
+	trusted []*net.IPNet
+	routes  []*listenerRoute
+
+	certs     *certificateStore
+	tlsConfig *tls.Config
+
+	cache *QueryCache
+
+	// mutex guards cancel and the reloadable parts of config
+	mutex  sync.RWMutex
+	cancel context.CancelFunc
 }
 
 func NewListener(config *ListenerConfig) *Listener {
 	return &Listener{
-		config:   config,
-		stopping: false,
+		config:  config,
+		limiter: NewLimiter(config.Limits),
 	}
 }
 
 func (l *Listener) Listen() error {
-	l.stopping = false
 	var err error
 	l.plugins, err = NewPluginRegistry(l.config.Authentication, l.config.Logging)
 	if err != nil {
 		return err
 	}
 
-	l.l, err = net.Listen("tcp", l.config.Bind)
+	err = l.plugins.LoadResponsePlugins(l.config.Responses)
+	if err != nil {
+		return err
+	}
+	err = l.plugins.LoadSessionHookPlugins(l.config.Hooks)
+	if err != nil {
+		return err
+	}
+
+	err = l.checkInspection()
+	if err != nil {
+		return err
+	}
+	err = l.checkTimeouts(l.config.Timeouts)
+	if err != nil {
+		return err
+	}
+
+	l.trusted, err = l.config.ProxyProtocol.trustedNetworks()
 	if err != nil {
 		return err
 	}
 
+	err = l.setupRoutes()
+	if err != nil {
+		return err
+	}
+
+	if l.config.SSL.Enabled {
+		l.certs, err = newCertificateStore(l.config.SSL, l.plugins)
+		if err != nil {
+			return err
+		}
+		l.tlsConfig, err = newServerTLSConfig(l.config.SSL, l.certs)
+		if err != nil {
+			l.certs.Close()
+			return err
+		}
+	}
+
+	if IsUnixSocketPath(l.config.Bind) {
+		l.l, err = listenUnix(l.config.Bind, l.config.Socket)
+	} else {
+		l.l, err = net.Listen("tcp", l.config.Bind)
+	}
+	if err != nil {
+		if l.certs != nil {
+			l.certs.Close()
+		}
+		return err
+	}
+
+	if l.config.Cache.Enabled {
+		l.cache = NewQueryCache(l.config.Cache, l.plugins)
+	}
+
 	return nil
 }
 
+// Close stops accepting clients and ends the listener's sessions
 func (l *Listener) Close() error {
-	l.stopping = true
-	if l.l != nil {
+	l.mutex.Lock()
+	cancel := l.cancel
+	l.cancel = nil
+	l.mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
+	} else if l.l != nil {
 		l.l.Close()
 	}
 	return nil
 }
 
-func (l *Listener) Handle() error {
+// Handle accepts clients until ctx is cancelled or the listener is closed,
+// and then waits for all of its sessions to end
+func (l *Listener) Handle(ctx context.Context) error {
+	// Plugins are closed once every session has ended
+	defer l.closePlugins()
+	var sessions sync.WaitGroup
+	defer sessions.Wait()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	l.mutex.Lock()
+	l.cancel = cancel
+	l.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		l.l.Close()
+		l.limiter.Close()
+		if l.certs != nil {
+			l.certs.Close()
+		}
+		if l.cache != nil {
+			l.cache.Close()
+		}
+	}()
+
 	for {
 		conn, err := l.l.Accept()
 		if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 			continue
 		}
 		if err != nil {
-			if l.stopping {
+			if ctx.Err() != nil {
 				return nil
 			}
 			l.plugins.LogError(nil, "error accepting client: %s", err)
 			return err
 		}
 
+		sessions.Add(1)
 		go func(conn net.Conn) {
+			defer sessions.Done()
 			defer conn.Close()
-			err := l.handleClient(conn)
+			err := l.handleClient(ctx, conn)
 			if err != nil && err != io.EOF {
 				l.plugins.LogError(nil, "error handling client session: %s", err)
 			}
@@ -69,32 +173,80 @@ func (l *Listener) Handle() error {
 	}
 }
 
-func (l *Listener) handleClient(client net.Conn) error {
+func (l *Listener) handleClient(ctx context.Context, client net.Conn) error {
 
 	var err error
 	var startup *pgproto.StartupMessage
 	var isSSL bool
 
+	peer, err := getPeerCredentials(client)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.RLock()
+	timeouts := l.config.Timeouts
+	l.mutex.RUnlock()
+
+	// The authentication timeout covers everything from accepting the client, the session takes it over once there is one
+	accepted := time.Now()
+	startupTimer := startStartupTimeout(client, timeouts.Authentication)
+	defer startupTimer.stop()
+
+	// Only trusted proxies may tell us who the client really is
+	if l.config.ProxyProtocol.Enabled && isTrustedAddr(client.RemoteAddr(), l.trusted) {
+		client, err = readProxyHeader(client)
+		if err != nil {
+			return err
+		}
+	}
+
+	// PostgreSQL 17 clients using sslnegotiation=direct start with a TLS handshake record
+	// instead of a startup message, whose first byte is always zero
+	bc := newBufferedConn(client)
+	client = bc
+	first, err := bc.reader.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	if first[0] == tlsHandshakeRecord {
+		if !l.config.SSL.Enabled {
+			return fmt.Errorf("direct SSL connection attempted, but SSL is not enabled")
+		}
+		startupTimer.setConn(nil)
+		client, err = l.directSSLConnection(client)
+		if err != nil {
+			return err
+		}
+		startupTimer.setConn(client)
+		isSSL = true
+	}
+
 	startup, err = pgproto.ParseStartupMessage(client)
 	if err != nil {
 		return err
 	}
 
-	if startup.SSLRequest {
+	if startup.SSLRequest && isSSL {
+		return RetunErrorfAndWritePGMsg(client, "SSLRequest received on an SSL connection")
+	} else if startup.SSLRequest {
 		if !l.config.SSL.Enabled {
 			_, err = client.Write([]byte{'N'})
 			return err
 		}
+		startupTimer.setConn(nil)
 		client, err = l.upgradeSSLConnection(client)
 		if err != nil {
 			return err
 		}
+		startupTimer.setConn(client)
 		isSSL = true
 		startup, err = pgproto.ParseStartupMessage(client)
 		if err != nil {
 			return err
 		}
-	} else if l.config.SSL.Required {
+	} else if l.config.SSL.Required && !isSSL {
 		// SSL is required but they didn't request it, return an error
 		return RetunErrorfAndWritePGMsg(client, "server does not support SSL, but SSL was required")
 	}
@@ -108,27 +260,84 @@ func (l *Listener) handleClient(client net.Conn) error {
 		return RetunErrorfAndWritePGMsg(client, "user startup option is required")
 	}
 
+	isReplication := IsReplicationStartup(startup)
+
 	if database, ok = startup.Options["database"]; !ok {
-		// No database was provided
-		return RetunErrorfAndWritePGMsg(client, "database startup option is required")
+		if !isReplication {
+			// No database was provided
+			return RetunErrorfAndWritePGMsg(client, "database startup option is required")
+		}
+		// Physical replication clients are not connected to a database
+		database = []byte{}
 	}
 
-	sess, err := NewSession(startup, user, database, isSSL, client, nil, l.plugins)
+	// SSL clients are routed by the server name they asked for
+	var serverName string
+	if sslClient, ok := client.(*tls.Conn); ok {
+		serverName = sslClient.ConnectionState().ServerName
+	}
+	route := l.routeForServerName(serverName)
+	plugins := l.plugins
+	if route != nil {
+		plugins = route.plugins
+	}
+
+	if isReplication && !l.replicationAllowed(route, string(user)) {
+		return RetunErrorfAndWritePGMsg(client, "replication connections are not allowed for user %s", user)
+	}
+
+	sess, err := NewSession(startup, user, database, isSSL, client, nil, plugins)
 	if err != nil {
 		l.plugins.LogError(nil, "error creating new client session: %s", err)
 		client.Close()
 		return err
 	}
 
+	sess.PeerCredentials = peer
+	sess.ServerName = serverName
+	sess.Listener = l.config.Bind
+	sess.IsReplication = isReplication
+	sess.inspect = l.config.InspectMessages()
+	sess.mirrorConfig = l.config.Mirror
+	if l.config.Capture.Enabled {
+		sess.capture, err = newCaptureWriter(l.config.Capture.Directory, CaptureHeader{
+			SessionID: sess.ID,
+			User:      string(user),
+			Database:  string(database),
+			Started:   accepted,
+		})
+		if err != nil {
+			l.plugins.LogError(sess.loggingContext(), "error creating capture file: %s", err)
+		}
+	}
+	sess.limiter = l.limiter
+	sess.cache = l.cache
+	sess.timeouts = timeouts
 	defer sess.Close()
+	startupTimer.stop()
+	sess.startTimeouts(timeouts.Authentication - time.Since(accepted))
 
+	sess.connected = accepted
 	l.plugins.LogInfo(sess.loggingContext(), "new client session")
-	err = sess.Handle()
+	span := sess.startSessionSpan(ctx, accepted)
+	if rejected := sess.sessionEvent(SessionConnect, "", nil); rejected != nil {
+		err = sess.rejectSession(rejected)
+	} else {
+		err = sess.Handle(ctx)
+	}
+	sess.endSessionSpan(span, err)
+	if err != nil && err != io.EOF {
+		sess.sessionEvent(SessionError, "", err)
+	}
+	sess.sessionEvent(SessionClose, "", nil)
 
+	context := sess.loggingContext()
+	context["bytes_to_server"] = sess.BytesToServer()
+	context["bytes_to_client"] = sess.BytesToClient()
 	if err != nil && err != io.EOF {
-		l.plugins.LogError(sess.loggingContext(), "client session end: %s", err)
+		l.plugins.LogError(context, "client session end: %s", err)
 	} else {
-		l.plugins.LogInfo(sess.loggingContext(), "client session end")
+		l.plugins.LogInfo(context, "client session end")
 	}
 	return err
 }
@@ -139,20 +348,138 @@ func (l *Listener) upgradeSSLConnection(client net.Conn) (net.Conn, error) {
 		return nil, err
 	}
 
-	cer, err := tls.LoadX509KeyPair(l.config.SSL.Certificate, l.config.SSL.Key)
+	sslClient, err := l.serverSSLConnection(client)
 	if err != nil {
 		return nil, err
 	}
+	return sslClient, nil
+}
+
+// directSSLConnection completes a TLS handshake started without an SSLRequest,
+// which PostgreSQL only allows when the client negotiates the `postgresql` ALPN protocol
+func (l *Listener) directSSLConnection(client net.Conn) (net.Conn, error) {
+	sslClient, err := l.serverSSLConnection(client)
+	if err != nil {
+		return nil, err
+	}
+	if sslClient.ConnectionState().NegotiatedProtocol != alpnProtocol {
+		sslClient.Close()
+		return nil, fmt.Errorf("direct SSL connection requires the %#v ALPN protocol", alpnProtocol)
+	}
+	return sslClient, nil
+}
 
+func (l *Listener) serverSSLConnection(client net.Conn) (*tls.Conn, error) {
 	// Upgrade the client connection to a TLS connection
-	sslClient := tls.Server(client, &tls.Config{
-		Certificates: []tls.Certificate{cer},
-	})
-	err = sslClient.Handshake()
+	sslClient := tls.Server(client, l.tlsConfig)
+	err := sslClient.Handshake()
 
 	return sslClient, err
 }
 
+func (l *Listener) closePlugins() {
+	for _, route := range l.routes {
+		route.plugins.Close()
+	}
+	l.plugins.Close()
+}
+
+// Reload applies the reloadable parts of config to a running listener
+func (l *Listener) Reload(config *ListenerConfig) error {
+	err := l.checkTimeouts(config.Timeouts)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.config.Limits = config.Limits
+	l.config.Timeouts = config.Timeouts
+	l.mutex.Unlock()
+
+	l.limiter.Update(config.Limits)
+	l.plugins.LogWarn(nil, "reloaded limits and timeouts for %s", l)
+
+	err = l.plugins.Reload(config.Authentication, config.Logging, config.Responses, config.Hooks)
+	for _, route := range l.routes {
+		for _, routeConfig := range config.Routes {
+			if routeConfig.ServerName != route.config.ServerName {
+				continue
+			}
+			e := route.plugins.Reload(routeConfig.Authentication, nil, nil, nil)
+			if e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// checkInspection rejects features relying on every message being parsed for sessions forwarded as raw bytes
+func (l *Listener) checkInspection() error {
+	if l.plugins.HasResponsePlugins() && (!l.config.InspectMessages() || l.config.AllowsReplication()) {
+		return fmt.Errorf("response plugins require message inspection, disable replication and enable inspect")
+	}
+	if l.config.Cache.Enabled && (!l.config.InspectMessages() || l.config.AllowsReplication()) {
+		return fmt.Errorf("query cache requires message inspection, disable replication and enable inspect")
+	}
+
+	features := map[string]bool{
+		"limits":        l.config.Limits.Enabled(),
+		"session hooks": l.plugins.HasSessionHooks(),
+		"capture":       l.config.Capture.Enabled,
+		"mirror":        l.config.Mirror.Enabled,
+	}
+	for _, name := range []string{"limits", "session hooks", "capture", "mirror"} {
+		if !features[name] {
+			continue
+		}
+		if !l.config.InspectMessages() {
+			return fmt.Errorf("%s require message inspection, enable inspect", name)
+		}
+		if l.config.AllowsReplication() {
+			l.plugins.LogWarn(nil, "%s of %s do not apply to replication sessions", name, l)
+		}
+	}
+	return nil
+}
+
+// checkTimeouts rejects idle timeouts for sessions whose statements are not inspected, they would never fire
+func (l *Listener) checkTimeouts(timeouts TimeoutsConfig) error {
+	if !timeouts.HasIdleTimeouts() {
+		return nil
+	}
+	if !l.config.InspectMessages() {
+		return fmt.Errorf("idle timeouts require message inspection, enable inspect")
+	}
+	if l.config.AllowsReplication() && l.plugins != nil {
+		l.plugins.LogWarn(nil, "idle timeouts of %s do not apply to replication sessions", l)
+	}
+	return nil
+}
+
+// Health checks the listener's plugins, returning their errors by plugin
+func (l *Listener) Health() map[string]error {
+	health := l.plugins.Health()
+	for _, route := range l.routes {
+		for name, err := range route.plugins.Health() {
+			health[route.config.ServerName+"/"+name] = err
+		}
+	}
+	return health
+}
+
+// InvalidateCache empties the listener's query cache, if it has one
+func (l *Listener) InvalidateCache() {
+	if l.cache != nil {
+		l.cache.Invalidate()
+		l.plugins.LogWarn(nil, "invalidated query cache for %s", l)
+	}
+}
+
+// Addr is the address the listener is bound to, once listening
+func (l *Listener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
 func (l *Listener) String() string {
 	return l.config.Bind
 }
@@ -0,0 +1,180 @@
+package pggateway
+
+import (
+	"fmt"
+	"math/rand"
+	"unicode/utf8"
+)
+
+// LogFilterConfig selects the log entries a logging plugin receives, from the `filters` section of its configuration
+type LogFilterConfig struct {
+	// Include keeps only entries matching any of its matchers, when set
+	Include []LogMatcher `json:"include,omitempty"`
+	// Exclude drops entries matching any of its matchers
+	Exclude []LogMatcher `json:"exclude,omitempty"`
+	// Sample keeps entries matching a sampler at its rate, the first matching sampler applies
+	Sample []LogSampler `json:"sample,omitempty"`
+}
+
+// LogMatcher matches entries when each of its fields that is set matches,
+// a field matches when any of its values does; values are MatchPattern patterns
+type LogMatcher struct {
+	Level []string `json:"level,omitempty"`
+	// Message matches the formatted message, including its arguments
+	Message     []string `json:"message,omitempty"`
+	User        []string `json:"user,omitempty"`
+	Database    []string `json:"database,omitempty"`
+	SessionID   []string `json:"session_id,omitempty"`
+	Listener    []string `json:"listener,omitempty"`
+	MessageType []string `json:"message_type,omitempty"`
+	// Fields matches any other logging context fields
+	Fields map[string][]string `json:"fields,omitempty"`
+}
+
+// LogSampler
+type LogSampler struct {
+	LogMatcher
+	// Rate is the fraction of matching entries kept, between 0 and 1
+	Rate float64 `json:"rate"`
+}
+
+func parseLogFilter(config ConfigMap) (*LogFilterConfig, error) {
+	raw, ok := config["filters"]
+	if !ok {
+		return nil, nil
+	}
+
+	filter := &LogFilterConfig{}
+	err := FillStruct(raw, filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filters: %s", err)
+	}
+
+	for _, sampler := range filter.Sample {
+		if sampler.Rate < 0 || sampler.Rate > 1 {
+			return nil, fmt.Errorf("invalid filters: sample rate must be between 0 and 1")
+		}
+	}
+	return filter, nil
+}
+
+// allows reports whether msg passes the filter
+func (f *LogFilterConfig) allows(msg *loggingMessage) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.Include) > 0 {
+		included := false
+		for i := range f.Include {
+			if f.Include[i].matches(msg) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for i := range f.Exclude {
+		if f.Exclude[i].matches(msg) {
+			return false
+		}
+	}
+	for i := range f.Sample {
+		if f.Sample[i].matches(msg) {
+			return rand.Float64() < f.Sample[i].Rate
+		}
+	}
+	return true
+}
+
+func (m *LogMatcher) matches(msg *loggingMessage) bool {
+	if !MatchAny(m.Level, msg.level) || len(m.Message) > 0 && !MatchAny(m.Message, msg.text()) {
+		return false
+	}
+
+	fields := map[string][]string{
+		"user":       m.User,
+		"database":   m.Database,
+		"session_id": m.SessionID,
+		"listener":   m.Listener,
+	}
+	for name, values := range m.Fields {
+		fields[name] = values
+	}
+	for name, values := range fields {
+		if len(values) == 0 {
+			continue
+		}
+		value, ok := msg.context[name]
+		if !ok || !MatchAny(values, fmt.Sprint(value)) {
+			return false
+		}
+	}
+
+	if len(m.MessageType) > 0 {
+		message, _ := msg.context["message"].(map[string]interface{})
+		messageType, ok := message["Type"]
+		if !ok || !MatchAny(m.MessageType, fmt.Sprint(messageType)) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchAny reports whether value matches any of patterns, or patterns is empty
+func MatchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if MatchPattern(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPattern reports whether value matches pattern, in which `*` matches any sequence of characters,
+// `?` any single character and `\` escapes the next one. Unlike path.Match, `*` and `?` also match `/`.
+func MatchPattern(pattern string, value string) bool {
+	p, v := 0, 0
+	// On a mismatch the last `*` consumes one more character of value, from next
+	star, next := -1, 0
+	for v < len(value) {
+		if p < len(pattern) {
+			switch ch := pattern[p]; {
+			case ch == '*':
+				star, next = p, v
+				p++
+				continue
+			case ch == '?':
+				_, size := utf8.DecodeRuneInString(value[v:])
+				p++
+				v += size
+				continue
+			case ch == '\\' && p+1 < len(pattern):
+				if pattern[p+1] == value[v] {
+					p += 2
+					v++
+					continue
+				}
+			case ch == value[v]:
+				p++
+				v++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(value[next:])
+		next += size
+		p, v = star+1, next
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -0,0 +1,145 @@
+package pggateway_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		match   bool
+	}{
+		{"app", "app", true},
+		{"app", "apps", false},
+		{"*", "", true},
+		{"team/*", "team/app", true},
+		{"*/app", "org/team/app", true},
+		{"team?app", "team/app", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"client session end: *", "client session end: EOF", true},
+		{"?", "é", true},
+		{"??", "é", false},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{"[a]", "[a]", true},
+	}
+	for _, test := range tests {
+		if got := pggateway.MatchPattern(test.pattern, test.value); got != test.match {
+			t.Errorf("MatchPattern(%q, %q) = %v, expected %v", test.pattern, test.value, got, test.match)
+		}
+	}
+}
+
+// collector is a logging plugin keeping the formatted messages it receives. When its config holds
+// `entered` and `release` channels, every entry is announced on entered and waits for release.
+type collector struct {
+	entered chan<- struct{}
+	release <-chan struct{}
+
+	mutex    sync.Mutex
+	messages []string
+	health   error
+}
+
+var collectors = make(chan *collector, 1)
+
+func init() {
+	pggateway.RegisterLoggingPlugin("collector", func(config pggateway.ConfigMap) (pggateway.LoggingPlugin, error) {
+		c := &collector{}
+		c.entered, _ = config["entered"].(chan struct{})
+		c.release, _ = config["release"].(chan struct{})
+		collectors <- c
+		return c, nil
+	})
+}
+
+func (c *collector) log(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	if c.entered != nil {
+		c.entered <- struct{}{}
+		<-c.release
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.messages = append(c.messages, fmt.Sprintf(msg, args...))
+}
+
+func (c *collector) Health() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.health
+}
+
+func (c *collector) setHealth(err error) {
+	c.mutex.Lock()
+	c.health = err
+	c.mutex.Unlock()
+}
+
+func (c *collector) LogInfo(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	c.log(context, msg, args...)
+}
+
+func (c *collector) LogDebug(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	c.log(context, msg, args...)
+}
+
+func (c *collector) LogError(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	c.log(context, msg, args...)
+}
+
+func (c *collector) LogFatal(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	c.log(context, msg, args...)
+}
+
+func (c *collector) LogWarn(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	c.log(context, msg, args...)
+}
+
+func TestLogFilter(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Logging: map[string]pggateway.ConfigMap{
+			"collector": {
+				"level": "info",
+				"filters": map[string]interface{}{
+					// Messages are matched once formatted, the format string is "client session end: %s"
+					"include": []interface{}{map[string]interface{}{
+						"user":    []string{"team*"},
+						"message": []string{"client session end: dial *"},
+					}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := <-collectors
+
+	// Sessions fail once the target is gone
+	srv.Close()
+	for _, user := range []string{"team/app", "other"} {
+		_, err := pgtest.Connect(gw.Addr(), user, "", "app")
+		if err == nil {
+			t.Fatal("connected without a target")
+		}
+	}
+	gw.Close()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.messages) != 1 {
+		t.Fatalf("unexpected messages %q, expected the end of the team/app session", c.messages)
+	}
+}
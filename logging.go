@@ -0,0 +1,236 @@
+package pggateway
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultLogQueueSize = 1024
+
+// Overflow policies of a logging plugin's queue
+const (
+	// OverflowBlock makes callers wait for room in the queue
+	OverflowBlock = "block"
+	// OverflowDropOldest drops the oldest queued entry
+	OverflowDropOldest = "drop_oldest"
+	// OverflowDropDebug drops debug entries first, and then the oldest queued entry
+	OverflowDropDebug = "drop_debug"
+)
+
+var logLevels = map[string]int32{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+	"fatal": 4,
+}
+
+type loggingMessage struct {
+	level   string
+	context LoggingContext
+	msg     string
+	args    []interface{}
+
+	formatted *string
+}
+
+// text returns the message formatted with its arguments, formatting it only once for all filters
+func (m *loggingMessage) text() string {
+	if m.formatted == nil {
+		text := fmt.Sprintf(m.msg, m.args...)
+		m.formatted = &text
+	}
+	return *m.formatted
+}
+
+// logDispatcher queues log entries for a single logging plugin, delivered by its own worker
+// so slow plugins never hold up sessions or other plugins
+type logDispatcher struct {
+	name     string
+	plugin   LoggingPlugin
+	level    int32
+	filter   atomic.Value
+	size     int
+	overflow string
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	queue    []loggingMessage
+	busy     bool
+	closed   bool
+	dropped  uint64
+	reported uint64
+	done     chan struct{}
+}
+
+// newLogDispatcher starts the worker of plugin, the `dispatch` section of config sets its queue
+func newLogDispatcher(name string, plugin LoggingPlugin, config ConfigMap) (*logDispatcher, error) {
+	d := &logDispatcher{
+		name:     name,
+		plugin:   plugin,
+		size:     defaultLogQueueSize,
+		overflow: OverflowDropDebug,
+		done:     make(chan struct{}),
+	}
+	d.cond = sync.NewCond(&d.mutex)
+
+	err := d.configure(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if dispatch, ok := config.Map("dispatch"); ok {
+		d.size = dispatch.IntDefault("queue_size", d.size)
+		d.overflow = dispatch.StringDefault("overflow", d.overflow)
+	}
+	if d.size < 1 {
+		return nil, fmt.Errorf("logging plugin %s: dispatch queue_size must be positive", name)
+	}
+	switch d.overflow {
+	case OverflowBlock, OverflowDropOldest, OverflowDropDebug:
+	default:
+		return nil, fmt.Errorf("logging plugin %s: unknown dispatch overflow %#v, expected %#v, %#v or %#v", name, d.overflow, OverflowBlock, OverflowDropOldest, OverflowDropDebug)
+	}
+
+	go d.run()
+	return d, nil
+}
+
+// configure applies the level and filters of config, plugins check their own level,
+// this only avoids queueing entries they would discard
+func (d *logDispatcher) configure(config ConfigMap) error {
+	filter, err := parseLogFilter(config)
+	if err != nil {
+		return fmt.Errorf("logging plugin %s: %s", d.name, err)
+	}
+	name := strings.ToLower(config.StringDefault("level", "warn"))
+	level, ok := logLevels[name]
+	if !ok {
+		return fmt.Errorf("logging plugin %s: unknown logging level %#v", d.name, name)
+	}
+
+	d.filter.Store(filter)
+	atomic.StoreInt32(&d.level, level)
+	return nil
+}
+
+func (d *logDispatcher) enabled(level string) bool {
+	return logLevels[level] >= atomic.LoadInt32(&d.level)
+}
+
+// accepts reports whether msg passes the level and filters of the plugin
+func (d *logDispatcher) accepts(msg *loggingMessage) bool {
+	return d.enabled(msg.level) && d.filter.Load().(*LogFilterConfig).allows(msg)
+}
+
+func (d *logDispatcher) push(msg loggingMessage) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for len(d.queue) >= d.size && d.overflow == OverflowBlock && !d.closed {
+		d.cond.Wait()
+	}
+	if d.closed {
+		return
+	}
+
+	if len(d.queue) >= d.size {
+		if d.overflow == OverflowDropDebug {
+			if msg.level == "debug" {
+				d.dropped++
+				return
+			}
+			for i, queued := range d.queue {
+				if queued.level == "debug" {
+					d.queue = append(d.queue[:i], d.queue[i+1:]...)
+					d.dropped++
+					break
+				}
+			}
+		}
+		if len(d.queue) >= d.size {
+			d.queue = d.queue[1:]
+			d.dropped++
+		}
+	}
+	d.queue = append(d.queue, msg)
+	d.cond.Broadcast()
+}
+
+func (d *logDispatcher) run() {
+	defer close(d.done)
+	for {
+		d.mutex.Lock()
+		for len(d.queue) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(d.queue) == 0 {
+			d.mutex.Unlock()
+			return
+		}
+		batch := d.queue
+		d.queue = nil
+		d.busy = true
+		dropped, total := d.dropped-d.reported, d.dropped
+		d.reported = d.dropped
+		d.cond.Broadcast()
+		d.mutex.Unlock()
+
+		if dropped > 0 {
+			d.deliver(loggingMessage{
+				level:   "warn",
+				context: LoggingContext{"dropped": dropped, "total_dropped": total},
+				msg:     "logging queue overflowed, dropped %d log entries",
+				args:    []interface{}{dropped},
+			})
+		}
+		for _, msg := range batch {
+			d.deliver(msg)
+		}
+
+		d.mutex.Lock()
+		d.busy = false
+		d.cond.Broadcast()
+		d.mutex.Unlock()
+	}
+}
+
+func (d *logDispatcher) deliver(msg loggingMessage) {
+	switch msg.level {
+	case "info":
+		d.plugin.LogInfo(msg.context, msg.msg, msg.args...)
+	case "debug":
+		d.plugin.LogDebug(msg.context, msg.msg, msg.args...)
+	case "warn":
+		d.plugin.LogWarn(msg.context, msg.msg, msg.args...)
+	case "error":
+		d.plugin.LogError(msg.context, msg.msg, msg.args...)
+	case "fatal":
+		d.plugin.LogFatal(msg.context, msg.msg, msg.args...)
+	}
+}
+
+// flush waits until every queued entry has been delivered
+func (d *logDispatcher) flush() {
+	d.mutex.Lock()
+	for (len(d.queue) > 0 || d.busy) && !d.closed {
+		d.cond.Wait()
+	}
+	d.mutex.Unlock()
+}
+
+// close delivers the queued entries and stops the worker
+func (d *logDispatcher) close() {
+	d.mutex.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+	<-d.done
+}
+
+func (d *logDispatcher) droppedEntries() uint64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.dropped
+}
@@ -0,0 +1,144 @@
+package pggateway_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+)
+
+// startHeldCollector starts a collector behind a queue of size entries with the overflow policy,
+// holding the first entry until release is closed so the following ones queue up behind it
+func startHeldCollector(t *testing.T, size int, overflow string) (*pggateway.PluginRegistry, *collector, chan struct{}) {
+	entered, release := make(chan struct{}, 100), make(chan struct{})
+	r, err := pggateway.NewPluginRegistry(nil, map[string]pggateway.ConfigMap{
+		"collector": {
+			"level":    "debug",
+			"entered":  entered,
+			"release":  release,
+			"dispatch": map[string]interface{}{"queue_size": size, "overflow": overflow},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := <-collectors
+	t.Cleanup(func() { r.Close() })
+
+	r.LogInfo(nil, "held")
+	<-entered
+	return r, c, release
+}
+
+func (c *collector) received() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.messages...)
+}
+
+func TestLoggingUnknownLevel(t *testing.T) {
+	for _, level := range []string{"trace", "disabled"} {
+		_, err := pggateway.NewPluginRegistry(nil, map[string]pggateway.ConfigMap{"collector": {"level": level}})
+		// The plugin itself was started before its level was checked
+		<-collectors
+		if err == nil {
+			t.Errorf("expected level %q to be refused", level)
+		}
+	}
+
+	// Reloading an unknown level keeps the previous one
+	r, err := pggateway.NewPluginRegistry(nil, map[string]pggateway.ConfigMap{"collector": {"level": "info"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-collectors
+	defer r.Close()
+	err = r.Reload(nil, map[string]pggateway.ConfigMap{"collector": {"level": "trace"}}, nil, nil)
+	if err == nil {
+		t.Fatal("expected reloading level \"trace\" to fail")
+	}
+	if !r.LogEnabled("info") || r.LogEnabled("debug") {
+		t.Fatal("expected the info level to be kept")
+	}
+}
+
+func TestLoggingOverflowDropOldest(t *testing.T) {
+	r, c, release := startHeldCollector(t, 2, pggateway.OverflowDropOldest)
+	for _, msg := range []string{"first", "second", "third"} {
+		r.LogInfo(nil, "%s", msg)
+	}
+	if dropped := r.DroppedLogs()["collector"]; dropped != 1 {
+		t.Fatalf("expected 1 dropped entry, got %d", dropped)
+	}
+
+	close(release)
+	r.FlushLogs()
+	want := []string{"held", "logging queue overflowed, dropped 1 log entries", "second", "third"}
+	if got := c.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("received %q, expected %q", got, want)
+	}
+}
+
+func TestLoggingOverflowDropDebug(t *testing.T) {
+	r, c, release := startHeldCollector(t, 2, pggateway.OverflowDropDebug)
+	r.LogDebug(nil, "debug 1")
+	r.LogInfo(nil, "info 1")
+	// A queued debug entry makes room first
+	r.LogInfo(nil, "info 2")
+	// New debug entries are dropped when the queue is full
+	r.LogDebug(nil, "debug 2")
+	// Without debug entries queued the oldest one goes
+	r.LogError(nil, "error 1")
+	if dropped := r.DroppedLogs()["collector"]; dropped != 3 {
+		t.Fatalf("expected 3 dropped entries, got %d", dropped)
+	}
+
+	close(release)
+	r.FlushLogs()
+	want := []string{"held", "logging queue overflowed, dropped 3 log entries", "info 2", "error 1"}
+	if got := c.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("received %q, expected %q", got, want)
+	}
+
+	// The counter keeps its total, the next warning only reports new drops
+	r.LogInfo(nil, "after")
+	r.FlushLogs()
+	if dropped := r.DroppedLogs()["collector"]; dropped != 3 {
+		t.Fatalf("expected 3 dropped entries in total, got %d", dropped)
+	}
+	if got := c.received(); got[len(got)-1] != "after" {
+		t.Fatalf("unexpected entries %q", got)
+	}
+}
+
+func TestLoggingOverflowBlock(t *testing.T) {
+	r, c, release := startHeldCollector(t, 1, pggateway.OverflowBlock)
+	r.LogInfo(nil, "queued")
+
+	logged := make(chan struct{})
+	go func() {
+		r.LogInfo(nil, "blocked")
+		close(logged)
+	}()
+	select {
+	case <-logged:
+		t.Fatal("expected logging to wait for room in the queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-logged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging still blocked once the queue drained")
+	}
+	r.FlushLogs()
+	want := []string{"held", "queued", "blocked"}
+	if got := c.received(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("received %q, expected %q", got, want)
+	}
+	if dropped := r.DroppedLogs()["collector"]; dropped != 0 {
+		t.Fatalf("expected no dropped entries, got %d", dropped)
+	}
+}
@@ -0,0 +1,317 @@
+package pggateway
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c653labs/pgproto"
+)
+
+const defaultMirrorQueueSize = 1000
+
+// MirrorConfig
+type MirrorConfig struct {
+	Enabled bool         `yaml:"enabled,omitempty"`
+	Target  TargetConfig `yaml:"target,omitempty"`
+	// Mode is "read-only", mirroring only read-only simple queries (the default), or "all"
+	Mode      string `yaml:"mode,omitempty"`
+	QueueSize int    `yaml:"queue_size,omitempty"`
+}
+
+// statementResult summarizes the response to a statement, up to its ReadyForQuery
+type statementResult struct {
+	tags    []string
+	rows    int
+	errors  []string
+	latency time.Duration
+}
+
+func (r *statementResult) add(msg pgproto.ServerMessage) {
+	switch m := msg.(type) {
+	case *pgproto.DataRow:
+		r.rows++
+	case *pgproto.CommandCompletion:
+		r.tags = append(r.tags, string(m.Tag))
+	case *pgproto.Error:
+		r.errors = append(r.errors, string(m.Message))
+	}
+}
+
+func (r *statementResult) matches(o *statementResult) bool {
+	return r.rows == o.rows &&
+		strings.Join(r.tags, ";") == strings.Join(o.tags, ";") &&
+		len(r.errors) == len(o.errors)
+}
+
+type mirrorJob struct {
+	seq int64
+	msg pgproto.ClientMessage
+}
+
+// mirror asynchronously replays a session's statements against a secondary target,
+// comparing its responses with the primary's. It never blocks the primary session,
+// statements are dropped when its queue is full.
+type mirror struct {
+	sess   *Session
+	config MirrorConfig
+	queue  chan mirrorJob
+
+	dropped int64
+
+	mutex    sync.Mutex
+	disabled bool
+	closed   bool
+	client   *Client
+	expected map[int64]time.Time
+	primary  map[int64]*statementResult
+	mirrored map[int64]*statementResult
+}
+
+func newMirror(sess *Session, config MirrorConfig) *mirror {
+	size := config.QueueSize
+	if size <= 0 {
+		size = defaultMirrorQueueSize
+	}
+	m := &mirror{
+		sess:     sess,
+		config:   config,
+		queue:    make(chan mirrorJob, size),
+		expected: make(map[int64]time.Time),
+		primary:  make(map[int64]*statementResult),
+		mirrored: make(map[int64]*statementResult),
+	}
+	go m.run()
+	return m
+}
+
+// Words making a statement that starts like a read write or lock rows: writable CTEs,
+// SELECT INTO, locking clauses and sequence functions
+var writeWords = map[string]bool{
+	"INSERT":  true,
+	"UPDATE":  true,
+	"DELETE":  true,
+	"MERGE":   true,
+	"INTO":    true,
+	"SHARE":   true,
+	"NEXTVAL": true,
+	"SETVAL":  true,
+}
+
+// isReadOnlyStatement is a conservative check that every statement of query only reads,
+// functions with side effects other than nextval and setval are not detected
+func isReadOnlyStatement(query string) bool {
+	statements := statementWords(query)
+	if len(statements) == 0 {
+		return false
+	}
+	for _, words := range statements {
+		switch words[0] {
+		case "SELECT", "SHOW", "TABLE", "VALUES", "WITH":
+		default:
+			return false
+		}
+		for _, word := range words {
+			if writeWords[word] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// statementWords splits query into its statements, returning the upper cased keywords and unquoted
+// identifiers of each, without those in literals, quoted identifiers and comments
+func statementWords(query string) [][]string {
+	var statements [][]string
+	var words []string
+	for _, t := range Tokenize(query) {
+		switch {
+		case t.Kind == TokenPunctuation && t.Text == ";":
+			if len(words) > 0 {
+				statements = append(statements, words)
+			}
+			words = nil
+		case t.Kind == TokenWord:
+			words = append(words, strings.ToUpper(t.Text))
+		}
+	}
+	if len(words) > 0 {
+		statements = append(statements, words)
+	}
+	return statements
+}
+
+// enqueue offers a message already forwarded to the primary, seq numbers the statement it belongs to
+func (m *mirror) enqueue(seq int64, msg pgproto.ClientMessage) {
+	switch msg := msg.(type) {
+	case *pgproto.PasswordMessage, *pgproto.Termination:
+		return
+	case *pgproto.SimpleQuery:
+		if m.config.Mode != "all" && !isReadOnlyStatement(string(msg.Query)) {
+			return
+		}
+	default:
+		if m.config.Mode != "all" {
+			return
+		}
+	}
+
+	m.mutex.Lock()
+	if m.disabled {
+		m.mutex.Unlock()
+		return
+	}
+	_, isQuery := msg.(*pgproto.SimpleQuery)
+	_, isSync := msg.(*pgproto.Sync)
+
+	select {
+	case m.queue <- mirrorJob{seq: seq, msg: msg}:
+		if isQuery || isSync {
+			m.expected[seq] = time.Now()
+		}
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+	m.mutex.Unlock()
+}
+
+// primaryResult hands over the primary's response to statement seq
+func (m *mirror) primaryResult(seq int64, result *statementResult) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sent, ok := m.expected[seq]
+	if !ok {
+		return
+	}
+	delete(m.expected, seq)
+	result.latency = time.Since(sent)
+	if mirrored, ok := m.mirrored[seq]; ok {
+		delete(m.mirrored, seq)
+		go m.compare(seq, result, mirrored)
+		return
+	}
+	m.primary[seq] = result
+}
+
+func (m *mirror) mirrorResult(seq int64, result *statementResult) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if primary, ok := m.primary[seq]; ok {
+		delete(m.primary, seq)
+		go m.compare(seq, primary, result)
+		return
+	}
+	m.mirrored[seq] = result
+}
+
+func (m *mirror) compare(seq int64, primary *statementResult, mirrored *statementResult) {
+	context := m.sess.loggingContext()
+	context["mirror"] = map[string]interface{}{
+		"statement":        seq,
+		"primary_tags":     primary.tags,
+		"mirror_tags":      mirrored.tags,
+		"primary_rows":     primary.rows,
+		"mirror_rows":      mirrored.rows,
+		"primary_errors":   primary.errors,
+		"mirror_errors":    mirrored.errors,
+		"primary_latency":  primary.latency.String(),
+		"mirror_latency":   mirrored.latency.String(),
+		"dropped_messages": atomic.LoadInt64(&m.dropped),
+	}
+	if primary.matches(mirrored) {
+		m.sess.plugins.LogDebug(context, "mirrored statement matches")
+	} else {
+		m.sess.plugins.LogWarn(context, "mirrored statement mismatch")
+	}
+}
+
+func (m *mirror) disable(err error) {
+	m.mutex.Lock()
+	m.disabled = true
+	m.expected = make(map[int64]time.Time)
+	m.primary = make(map[int64]*statementResult)
+	m.mutex.Unlock()
+	m.sess.plugins.LogError(m.sess.loggingContext(), "disabling mirror: %s", err)
+}
+
+// close stops mirroring, statements still waiting for the mirror target are abandoned
+func (m *mirror) close() {
+	close(m.queue)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closed = true
+	// Unblock run when it is waiting for a response
+	if m.client != nil {
+		m.client.Close()
+	}
+}
+
+func (m *mirror) isClosed() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.closed
+}
+
+func (m *mirror) run() {
+	t := m.config.Target
+	addr := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+	if IsUnixSocketPath(t.Host) {
+		addr = UnixSocketPath(t.Host, t.Port)
+	}
+
+	client, err := ConnectClient(addr, t.User, t.Password, string(m.sess.Database))
+	if err != nil {
+		m.disable(err)
+		for range m.queue {
+		}
+		return
+	}
+	m.mutex.Lock()
+	m.client = client
+	closed := m.closed
+	m.mutex.Unlock()
+	if closed {
+		client.Close()
+	}
+
+	failed := false
+	for job := range m.queue {
+		if failed {
+			continue
+		}
+		sent := time.Now()
+		err := client.Send(job.msg)
+		if err == nil {
+			switch job.msg.(type) {
+			case *pgproto.SimpleQuery, *pgproto.Sync:
+				err = m.receive(client, job.seq, sent)
+			}
+		}
+		if err != nil {
+			failed = true
+			if !m.isClosed() {
+				m.disable(err)
+			}
+		}
+	}
+}
+
+func (m *mirror) receive(client *Client, seq int64, sent time.Time) error {
+	result := &statementResult{}
+	for {
+		msg, err := client.Receive()
+		if err != nil {
+			return err
+		}
+		if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+			result.latency = time.Since(sent)
+			m.mirrorResult(seq, result)
+			return nil
+		}
+		result.add(msg)
+	}
+}
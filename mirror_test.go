@@ -0,0 +1,96 @@
+package pggateway_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+)
+
+func TestMirrorReadOnly(t *testing.T) {
+	queries := map[string]bool{
+		"SELECT * FROM accounts":                                             true,
+		"/* report */ SELECT 'DELETE FROM accounts'":                         true,
+		"SELECT 1; SELECT 2":                                                 true,
+		"WITH recent AS (SELECT * FROM accounts) SELECT * FROM recent":       true,
+		"SELECT 1; DELETE FROM accounts":                                     false,
+		"SELECT * FROM accounts FOR UPDATE":                                  false,
+		"SELECT * FROM accounts FOR NO KEY UPDATE":                           false,
+		"SELECT * FROM accounts FOR KEY SHARE":                               false,
+		"SELECT nextval('accounts_id_seq')":                                  false,
+		"SELECT * INTO archive FROM accounts":                                false,
+		"WITH gone AS (DELETE FROM accounts RETURNING *) SELECT * FROM gone": false,
+		"UPDATE accounts SET balance = 0":                                    false,
+		"-- SELECT\nINSERT INTO accounts VALUES (1)":                         false,
+	}
+	const done = "SELECT 'done'"
+
+	primary, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	secondary, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+	for _, srv := range []*pgtest.Server{primary, secondary} {
+		for q := range queries {
+			srv.SetResult(q, pgtest.Result{Tag: "OK"})
+		}
+		srv.SetResult(done, pgtest.Result{Tag: "OK"})
+	}
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(primary),
+		Mirror: pggateway.MirrorConfig{
+			Enabled: true,
+			Target:  pggateway.TargetConfig{Host: secondary.Host(), Port: secondary.Port()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var want []string
+	for q, readOnly := range queries {
+		_, err = client.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readOnly {
+			want = append(want, q)
+		}
+	}
+	_, err = client.Query(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, done)
+
+	// Statements are mirrored in order, once the last one arrived all others did
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := secondary.Queries()
+		if len(got) > 0 && got[len(got)-1] == done {
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("mirrored %q, expected %q", got, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("mirrored %q, expected %q", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
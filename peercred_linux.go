@@ -0,0 +1,36 @@
+package pggateway
+
+import (
+	"net"
+	"syscall"
+)
+
+func getPeerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, nil
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	return &PeerCredentials{
+		PID: cred.Pid,
+		UID: cred.Uid,
+		GID: cred.Gid,
+	}, nil
+}
@@ -0,0 +1,92 @@
+package pggateway_test
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+)
+
+// peerAuth is a peer-style authentication plugin, mapping the UIDs of Unix socket clients to the users they may be
+type peerAuth struct {
+	Target pggateway.TargetConfig `json:"target"`
+	Users  map[string]string      `json:"users"`
+}
+
+func init() {
+	pggateway.RegisterAuthPlugin("peer", func(config interface{}) (pggateway.AuthenticationPlugin, error) {
+		p := &peerAuth{}
+		err := pggateway.FillStruct(config, p)
+		return p, err
+	})
+}
+
+func (p *peerAuth) Authenticate(sess *pggateway.Session) (bool, error) {
+	if sess.PeerCredentials == nil {
+		return false, sess.WriteToClientEf("peer authentication is only available over Unix sockets")
+	}
+	uid := strconv.FormatUint(uint64(sess.PeerCredentials.UID), 10)
+	if p.Users[uid] != string(sess.User) || sess.PeerCredentials.PID != int32(os.Getpid()) {
+		return false, sess.WriteToClientEf("peer authentication failed for user %s", sess.User)
+	}
+	err := sess.DialTarget(p.Target)
+	if err != nil {
+		return false, err
+	}
+	return true, sess.WriteToServer(sess.GetStartup())
+}
+
+func TestPeerCredentials(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	auth := map[string]interface{}{
+		"peer": map[string]interface{}{
+			"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port()},
+			"users":  map[string]interface{}{strconv.Itoa(os.Getuid()): "app"},
+		},
+	}
+	dir := t.TempDir()
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{Bind: dir, Authentication: auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+	addr := pggateway.UnixSocketPath(dir, 0)
+
+	client, err := pgtest.Connect(addr, "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rows, err := client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0][0] != "1" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+
+	_, err = pgtest.Connect(addr, "admin", "", "app")
+	if err == nil || !strings.Contains(err.Error(), "peer authentication failed") {
+		t.Fatalf("expected the user mapping to refuse admin, got %v", err)
+	}
+
+	// TCP clients have no peer credentials
+	tcp, err := pgtest.StartGateway(&pggateway.ListenerConfig{Authentication: auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	_, err = pgtest.Connect(tcp.Addr(), "app", "", "app")
+	if err == nil || !strings.Contains(err.Error(), "only available over Unix sockets") {
+		t.Fatalf("expected TCP clients to be refused, got %v", err)
+	}
+}
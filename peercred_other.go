@@ -0,0 +1,10 @@
+//go:build !linux
+
+package pggateway
+
+import "net"
+
+// Peer credentials are only supported on Linux
+func getPeerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	return nil, nil
+}
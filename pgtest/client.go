@@ -0,0 +1,21 @@
+package pgtest
+
+import (
+	"net"
+
+	"github.com/c653labs/pggateway"
+)
+
+// Client is a minimal PostgreSQL client speaking the simple query protocol
+type Client = pggateway.Client
+
+// Connect opens a session to addr, authenticating with whichever of cleartext, md5 or
+// SCRAM-SHA-256 the server asks for
+func Connect(addr string, user string, password string, database string) (*Client, error) {
+	return pggateway.ConnectClient(addr, user, password, database)
+}
+
+// ConnectConn opens a session on conn, e.g. a TLS connection negotiated by the test itself
+func ConnectConn(conn net.Conn, user string, password string, database string) (*Client, error) {
+	return pggateway.NewClient(conn, user, password, database)
+}
@@ -0,0 +1,50 @@
+package pgtest
+
+import (
+	"context"
+
+	"github.com/c653labs/pggateway"
+)
+
+// Gateway runs a single pggateway listener in-process
+type Gateway struct {
+	listener *pggateway.Listener
+	cancel   context.CancelFunc
+	done     chan error
+}
+
+// StartGateway listens with config, binding a random local port when config.Bind is empty.
+// Plugins used by config must be registered, usually by importing their packages.
+func StartGateway(config *pggateway.ListenerConfig) (*Gateway, error) {
+	if config.Bind == "" {
+		config.Bind = "127.0.0.1:0"
+	}
+
+	l := pggateway.NewListener(config)
+	err := l.Listen()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &Gateway{
+		listener: l,
+		cancel:   cancel,
+		done:     make(chan error, 1),
+	}
+	go func() {
+		g.done <- l.Handle(ctx)
+	}()
+	return g, nil
+}
+
+// Addr is the address clients connect to
+func (g *Gateway) Addr() string {
+	return g.listener.Addr().String()
+}
+
+// Close stops the gateway and waits for its sessions to end
+func (g *Gateway) Close() error {
+	g.cancel()
+	return <-g.done
+}
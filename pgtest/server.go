@@ -0,0 +1,500 @@
+// Package pgtest provides an in-process fake PostgreSQL server and a minimal client,
+// for testing the gateway and its plugins without a real database.
+package pgtest
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pgproto"
+	"github.com/xdg/scram"
+)
+
+// Authentication methods supported by Server
+const (
+	AuthTrust       = "trust"
+	AuthPassword    = "password"
+	AuthMD5         = "md5"
+	AuthSCRAMSHA256 = "scram-sha-256"
+)
+
+// Result is the scripted response to a query
+type Result struct {
+	Columns []string
+	// Types are the type OIDs of the columns, default text
+	Types []int
+	// TableOID is the table of the columns, numbered from 1 in order
+	TableOID int
+	Rows     [][]string
+	// Tag is the command tag, defaults to "SELECT <rows>"
+	Tag string
+	// Error, when set, is returned as an ErrorResponse instead of the rows
+	Error string
+	// Disconnect closes the connection instead of answering
+	Disconnect bool
+	// Copy sends the rows like COPY TO STDOUT instead of as a result set
+	Copy bool
+	// Delay is waited before answering, like a long running statement
+	Delay time.Duration
+}
+
+// Server is a fake PostgreSQL server answering queries with scripted results
+type Server struct {
+	// AuthMethod is one of the Auth* constants, default AuthTrust
+	AuthMethod string
+	// Users maps user names to their plaintext passwords
+	Users map[string]string
+	// TLSConfig, when set, accepts SSL both after an SSLRequest and as a direct TLS handshake
+	TLSConfig *tls.Config
+
+	l       net.Listener
+	mutex   sync.Mutex
+	results map[string]Result
+	queries []string
+	conns   map[net.Conn]bool
+	wg      sync.WaitGroup
+}
+
+// NewServer starts a fake server listening on a random local port
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		AuthMethod: AuthTrust,
+		Users:      make(map[string]string),
+		l:          l,
+		results:    make(map[string]Result),
+		conns:      make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr is the address the server is listening on
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Host and Port split Addr for use in a pggateway.TargetConfig
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// SetResult scripts the response to query, matched after trimming whitespace and a trailing `;`
+func (s *Server) SetResult(query string, result Result) {
+	s.mutex.Lock()
+	s.results[normalizeQuery(query)] = result
+	s.mutex.Unlock()
+}
+
+// Queries returns all queries received so far, in order
+func (s *Server) Queries() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// Close stops the server, closing the connections still open, and waits for them to end
+func (s *Server) Close() error {
+	err := s.l.Close()
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func normalizeQuery(query string) string {
+	return strings.TrimSuffix(strings.TrimSpace(query), ";")
+}
+
+func (s *Server) result(query string) Result {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries = append(s.queries, query)
+
+	r, ok := s.results[normalizeQuery(query)]
+	if !ok {
+		return Result{Error: fmt.Sprintf("pgtest: no result scripted for query %q", query)}
+	}
+	return r
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mutex.Lock()
+				delete(s.conns, conn)
+				s.mutex.Unlock()
+				conn.Close()
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) error {
+	pc := &peekedConn{Conn: conn, r: bufio.NewReader(conn)}
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	conn = pc
+
+	// A TLS handshake record instead of a startup message is direct SSL
+	direct := false
+	if s.TLSConfig != nil && first[0] == 0x16 {
+		// Like PostgreSQL, only for clients negotiating the postgresql ALPN protocol
+		config := s.TLSConfig.Clone()
+		config.NextProtos = []string{"postgresql"}
+		sslConn := tls.Server(conn, config)
+		err = sslConn.Handshake()
+		if err != nil {
+			return err
+		}
+		if sslConn.ConnectionState().NegotiatedProtocol != "postgresql" {
+			return fmt.Errorf("direct SSL connection without the postgresql ALPN protocol")
+		}
+		conn = sslConn
+		direct = true
+	}
+
+	startup, err := pgproto.ParseStartupMessage(conn)
+	if err != nil {
+		return err
+	}
+	if startup.SSLRequest {
+		response := []byte{'N'}
+		if s.TLSConfig != nil && !direct {
+			response[0] = 'S'
+		}
+		_, err = conn.Write(response)
+		if err != nil {
+			return err
+		}
+		if response[0] == 'S' {
+			conn = tls.Server(conn, s.TLSConfig)
+		}
+		startup, err = pgproto.ParseStartupMessage(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	user := string(startup.Options["user"])
+	err = s.authenticate(conn, user)
+	if err != nil {
+		writeMessages(conn, &pgproto.Error{Severity: []byte("FATAL"), Message: []byte(err.Error())})
+		return err
+	}
+
+	err = writeMessages(conn,
+		&pgproto.AuthenticationRequest{Method: pgproto.AuthenticationMethodOK},
+		&pgproto.ParameterStatus{Name: []byte("server_version"), Value: []byte("17.0")},
+		&pgproto.ParameterStatus{Name: []byte("client_encoding"), Value: []byte("UTF8")},
+		&pgproto.BackendKeyData{PID: 1, Key: 1},
+		readyForQuery(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return s.serveQueries(conn)
+}
+
+// peekedConn reads through r, which may hold bytes already peeked from Conn
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (s *Server) authenticate(conn net.Conn, user string) error {
+	if s.AuthMethod == "" || s.AuthMethod == AuthTrust {
+		return nil
+	}
+
+	password, ok := s.Users[user]
+	if !ok {
+		return fmt.Errorf("role %#v does not exist", user)
+	}
+
+	switch s.AuthMethod {
+	case AuthPassword:
+		msg, err := requestPassword(conn, &pgproto.AuthenticationRequest{Method: pgproto.AuthenticationMethodPlaintext})
+		if err != nil {
+			return err
+		}
+		if string(msg.HeaderMessage) != password {
+			return fmt.Errorf("password authentication failed for user %#v", user)
+		}
+		return nil
+
+	case AuthMD5:
+		salt := []byte{1, 2, 3, 4}
+		msg, err := requestPassword(conn, &pgproto.AuthenticationRequest{Method: pgproto.AuthenticationMethodMD5, Salt: salt})
+		if err != nil {
+			return err
+		}
+		if string(msg.HeaderMessage) != md5Password(user, password, salt) {
+			return fmt.Errorf("password authentication failed for user %#v", user)
+		}
+		return nil
+
+	case AuthSCRAMSHA256:
+		return scramAuthenticate(conn, user, password)
+	}
+	return fmt.Errorf("pgtest: unknown auth method %#v", s.AuthMethod)
+}
+
+func scramAuthenticate(conn net.Conn, user string, password string) error {
+	client, err := scram.SHA256.NewClient(user, password, "")
+	if err != nil {
+		return err
+	}
+	credentials := client.GetStoredCredentials(scram.KeyFactors{Salt: "pgtest-salt", Iters: 4096})
+	server, err := scram.SHA256.NewServer(func(string) (scram.StoredCredentials, error) {
+		return credentials, nil
+	})
+	if err != nil {
+		return err
+	}
+	conv := server.NewConversation()
+
+	msg, err := requestPassword(conn, &pgproto.AuthenticationRequest{
+		Method:               pgproto.AuthenticationMethodSASL,
+		SupportedScramSHA256: true,
+	})
+	if err != nil {
+		return err
+	}
+	if string(msg.HeaderMessage) != pgproto.SASLMechanismScramSHA256 {
+		return fmt.Errorf("unsupported SASL mechanism %#v", string(msg.HeaderMessage))
+	}
+
+	serverFirst, err := conv.Step(string(msg.BodyMessage))
+	if err != nil {
+		return err
+	}
+	msg, err = requestPassword(conn, &pgproto.AuthenticationRequest{
+		Method:  pgproto.AuthenticationMethodSASLContinue,
+		Message: []byte(serverFirst),
+	})
+	if err != nil {
+		return err
+	}
+
+	serverFinal, err := conv.Step(string(msg.BodyMessage))
+	if err != nil {
+		return fmt.Errorf("password authentication failed for user %#v", user)
+	}
+	return writeMessages(conn, &pgproto.AuthenticationRequest{
+		Method:  pgproto.AuthenticationMethodSASLFinal,
+		Message: []byte(serverFinal),
+	})
+}
+
+func requestPassword(conn net.Conn, auth *pgproto.AuthenticationRequest) (*pgproto.PasswordMessage, error) {
+	err := writeMessages(conn, auth)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := pgproto.ParseClientMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	pwdMsg, ok := msg.(*pgproto.PasswordMessage)
+	if !ok {
+		return nil, fmt.Errorf("expected password message, got %T", msg)
+	}
+	return pwdMsg, nil
+}
+
+// serveQueries answers simple and extended protocol queries until the client terminates.
+// The extended protocol is simplified: Bind, Describe and Execute always refer to the
+// most recently parsed statement.
+func (s *Server) serveQueries(conn net.Conn) error {
+	var parsed string
+	var failed bool
+	// status is the transaction status, following BEGIN, COMMIT, ROLLBACK and errors
+	status := byte('I')
+	for {
+		msg, err := pgproto.ParseClientMessage(conn)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Like PostgreSQL, an error discards the extended protocol messages up to the next Sync
+		if _, ok := msg.(*pgproto.Sync); failed && !ok {
+			continue
+		}
+
+		var out []pgproto.Message
+		switch m := msg.(type) {
+		case *pgproto.Termination:
+			return nil
+		case *pgproto.SimpleQuery:
+			r := s.result(string(m.Query))
+			time.Sleep(r.Delay)
+			if r.Disconnect {
+				return nil
+			}
+			if r.Error == "" && !r.Copy {
+				out = append(out, rowDescription(r))
+			}
+			out = append(out, resultMessages(r)...)
+			status = transactionStatus(status, string(m.Query), r)
+			out = append(out, &pgproto.ReadyForQuery{Status: pgproto.ReadyForQueryStatus(status)})
+		case *pgproto.Parse:
+			parsed = string(m.Query)
+			out = append(out, &pgproto.ParseComplete{})
+		case *pgproto.Bind:
+			out = append(out, &pgproto.BindComplete{})
+		case *pgproto.Describe:
+			s.mutex.Lock()
+			r, ok := s.results[normalizeQuery(parsed)]
+			s.mutex.Unlock()
+			if ok && len(r.Columns) > 0 {
+				out = append(out, rowDescription(r))
+			} else {
+				out = append(out, &pgproto.NoData{})
+			}
+		case *pgproto.Execute:
+			r := s.result(parsed)
+			time.Sleep(r.Delay)
+			failed = r.Error != ""
+			status = transactionStatus(status, parsed, r)
+			out = append(out, resultMessages(r)...)
+		case *pgproto.Sync:
+			failed = false
+			out = append(out, &pgproto.ReadyForQuery{Status: pgproto.ReadyForQueryStatus(status)})
+		default:
+			continue
+		}
+
+		err = writeMessages(conn, out...)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func rowDescription(r Result) *pgproto.RowDescription {
+	desc := &pgproto.RowDescription{}
+	for i, name := range r.Columns {
+		typeOID := 25 // text
+		if i < len(r.Types) {
+			typeOID = r.Types[i]
+		}
+		desc.Fields = append(desc.Fields, pgproto.RowField{
+			ColumnName:   []byte(name),
+			TableOID:     r.TableOID,
+			ColumnIndex:  i + 1,
+			TypeOID:      typeOID,
+			ColumnLength: -1,
+			TypeModifier: -1,
+		})
+	}
+	return desc
+}
+
+func resultMessages(r Result) []pgproto.Message {
+	if r.Error != "" {
+		return []pgproto.Message{&pgproto.Error{Severity: []byte("ERROR"), Message: []byte(r.Error)}}
+	}
+
+	var out []pgproto.Message
+	if r.Copy {
+		out = append(out, &pgproto.CopyOutResponse{Formats: make([]int, len(r.Columns))})
+		for _, row := range r.Rows {
+			out = append(out, &pgproto.CopyData{Data: []byte(strings.Join(row, "\t") + "\n")})
+		}
+		return append(out, &pgproto.CopyDone{}, &pgproto.CommandCompletion{Tag: []byte(fmt.Sprintf("COPY %d", len(r.Rows)))})
+	}
+	for _, row := range r.Rows {
+		dataRow := &pgproto.DataRow{}
+		for _, value := range row {
+			dataRow.Fields = append(dataRow.Fields, []byte(value))
+		}
+		out = append(out, dataRow)
+	}
+
+	tag := r.Tag
+	if tag == "" {
+		tag = fmt.Sprintf("SELECT %d", len(r.Rows))
+	}
+	return append(out, &pgproto.CommandCompletion{Tag: []byte(tag)})
+}
+
+// transactionStatus returns the transaction status once query answered with r ran in a transaction with status
+func transactionStatus(status byte, query string, r Result) byte {
+	fields := strings.Fields(strings.ToUpper(normalizeQuery(query)))
+	switch {
+	case len(fields) == 0:
+	case r.Error != "":
+		if status != 'I' {
+			return 'E'
+		}
+	case fields[0] == "BEGIN" || fields[0] == "START":
+		return 'T'
+	case fields[0] == "COMMIT" || fields[0] == "ROLLBACK" || fields[0] == "END":
+		return 'I'
+	}
+	return status
+}
+
+func readyForQuery() *pgproto.ReadyForQuery {
+	return &pgproto.ReadyForQuery{Status: pgproto.ReadyForQueryStatus('I')}
+}
+
+func writeMessages(w io.Writer, msgs ...pgproto.Message) error {
+	_, err := pgproto.WriteMessages(msgs, w)
+	return err
+}
+
+// md5Password is the md5 password message PostgreSQL expects from a client
+func md5Password(user string, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	innerHex := hex.EncodeToString(inner[:])
+	outer := md5.Sum(append([]byte(innerHex), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
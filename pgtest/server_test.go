@@ -0,0 +1,79 @@
+package pgtest_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pgproto"
+)
+
+func TestCloseWithOpenConnections(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pgtest.Connect(srv.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- srv.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for an open connection")
+	}
+}
+
+func TestExtendedQueryErrorSkipsToSync(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT broken", pgtest.Result{Error: "broken"})
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	client, err := pgtest.Connect(srv.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Everything after the failed Execute up to Sync is discarded
+	err = client.Send(
+		&pgproto.Parse{Query: []byte("SELECT broken")},
+		&pgproto.Bind{},
+		&pgproto.Execute{},
+		&pgproto.Parse{Query: []byte("SELECT 1")},
+		&pgproto.Bind{},
+		&pgproto.Describe{ObjectType: pgproto.ObjectTypePortal},
+		&pgproto.Execute{},
+		&pgproto.Sync{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for {
+		msg, err := client.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%T", msg))
+		if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+			break
+		}
+	}
+	want := fmt.Sprint([]string{"*pgproto.ParseComplete", "*pgproto.BindComplete", "*pgproto.Error", "*pgproto.ReadyForQuery"})
+	if fmt.Sprint(got) != want {
+		t.Fatalf("got %v, expected %v", got, want)
+	}
+}
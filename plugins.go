@@ -2,22 +2,70 @@ package pggateway
 
 import (
 	"fmt"
-	"sync"
+	"log"
+
+	"github.com/c653labs/pgproto"
 )
 
 var authPlugins = make(map[string]authPluginInitializer)
 var loggingPlugins = make(map[string]loggingPluginInitializer)
+var responsePlugins = make(map[string]responsePluginInitializer)
+var sessionHookPlugins = make(map[string]sessionHookPluginInitializer)
 
 type authPluginInitializer func(interface{}) (AuthenticationPlugin, error)
 type loggingPluginInitializer func(ConfigMap) (LoggingPlugin, error)
+type responsePluginInitializer func(interface{}) (ResponsePlugin, error)
+type sessionHookPluginInitializer func(interface{}) (SessionHookPlugin, error)
 
 type Plugin interface{}
 
+// PluginCloser is implemented by plugins holding resources, closed when pggateway stops
+type PluginCloser interface {
+	Close() error
+}
+
+// PluginReloader is implemented by plugins able to apply a new configuration while running,
+// it receives the same type of configuration as the plugin's initializer
+type PluginReloader interface {
+	Reload(interface{}) error
+}
+
+// PluginReopener is implemented by logging and session hook plugins writing to files,
+// reopened when pggateway receives SIGUSR1 after an external log rotation
+type PluginReopener interface {
+	Reopen() error
+}
+
+// PluginHealthChecker is implemented by plugins depending on external services
+type PluginHealthChecker interface {
+	Health() error
+}
+
 type AuthenticationPlugin interface {
 	Plugin
 	Authenticate(*Session) (bool, error)
 }
 
+// ResponsePlugin rewrites the messages the target sends to clients
+type ResponsePlugin interface {
+	Plugin
+	// NewResponseTransformer is called once per session, and may return nil
+	// when the session's responses are left untouched
+	NewResponseTransformer(*Session) ResponseTransformer
+}
+
+// ResponseTransformer holds the state of a ResponsePlugin for a single session
+type ResponseTransformer interface {
+	// TransformResponse returns the message sent to the client instead of msg, nil drops it
+	TransformResponse(msg pgproto.ServerMessage) (pgproto.ServerMessage, error)
+}
+
+// RequestObserver is implemented by response transformers needing to know what the responses answer,
+// ObserveRequest is called with every message forwarded to the target, concurrently with TransformResponse
+type RequestObserver interface {
+	ObserveRequest(pgproto.ClientMessage)
+}
+
 type LoggingContext map[string]interface{}
 
 type LoggingPlugin interface {
@@ -37,24 +85,32 @@ func RegisterLoggingPlugin(name string, init func(ConfigMap) (LoggingPlugin, err
 	loggingPlugins[name] = init
 }
 
-type loggingMessage struct {
-	level   string
-	context LoggingContext
-	msg     string
-	args    []interface{}
+func RegisterResponsePlugin(name string, init func(interface{}) (ResponsePlugin, error)) {
+	responsePlugins[name] = init
+}
+
+func RegisterSessionHookPlugin(name string, init func(interface{}) (SessionHookPlugin, error)) {
+	sessionHookPlugins[name] = init
 }
 
 type PluginRegistry struct {
-	authPlugins    map[string]AuthenticationPlugin
-	loggingPlugins map[string]LoggingPlugin
-	logMutex       *sync.Mutex
+	authPlugins     map[string]AuthenticationPlugin
+	loggingPlugins  map[string]LoggingPlugin
+	responsePlugins map[string]ResponsePlugin
+	sessionHooks    map[string]SessionHookPlugin
+	loggers         map[string]*logDispatcher
+
+	// parent is set for registries sharing the logging, response and session hook plugins of another
+	parent *PluginRegistry
 }
 
 func NewPluginRegistry(auth map[string]interface{}, logging map[string]ConfigMap) (*PluginRegistry, error) {
 	r := &PluginRegistry{
-		authPlugins:    make(map[string]AuthenticationPlugin),
-		loggingPlugins: make(map[string]LoggingPlugin),
-		logMutex:       &sync.Mutex{},
+		authPlugins:     make(map[string]AuthenticationPlugin),
+		loggingPlugins:  make(map[string]LoggingPlugin),
+		responsePlugins: make(map[string]ResponsePlugin),
+		sessionHooks:    make(map[string]SessionHookPlugin),
+		loggers:         make(map[string]*logDispatcher),
 	}
 
 	for name, config := range auth {
@@ -71,43 +127,281 @@ func NewPluginRegistry(auth map[string]interface{}, logging map[string]ConfigMap
 	}
 
 	for name, config := range logging {
-		init, ok := loggingPlugins[name]
-		if !ok {
-			return nil, fmt.Errorf("could not find logging plugin: %s", name)
+		p, err := NewLoggingPlugin(name, config)
+		if err != nil {
+			r.Close()
+			return nil, err
 		}
+		r.loggingPlugins[name] = p
 
-		p, err := init(config)
+		d, err := newLogDispatcher(name, p, config)
 		if err != nil {
+			r.Close()
 			return nil, err
 		}
-		r.loggingPlugins[name] = p
+		r.loggers[name] = d
 	}
 
 	return r, nil
 }
 
+// NewLoggingPlugin starts the logging plugin registered as name on its own, without a queue
+// in front of it, e.g. to test it
+func NewLoggingPlugin(name string, config ConfigMap) (LoggingPlugin, error) {
+	init, ok := loggingPlugins[name]
+	if !ok {
+		return nil, fmt.Errorf("could not find logging plugin: %s", name)
+	}
+	return init(config)
+}
+
+// withAuthentication returns a registry using the auth plugins configured by auth,
+// sharing the logging plugins of r
+func (r *PluginRegistry) withAuthentication(auth map[string]interface{}) (*PluginRegistry, error) {
+	authOnly, err := NewPluginRegistry(auth, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &PluginRegistry{
+		authPlugins:     authOnly.authPlugins,
+		loggingPlugins:  r.loggingPlugins,
+		responsePlugins: r.responsePlugins,
+		sessionHooks:    r.sessionHooks,
+		loggers:         r.loggers,
+		parent:          r,
+	}, nil
+}
+
+// LoadResponsePlugins initializes the response plugins configured by responses
+func (r *PluginRegistry) LoadResponsePlugins(responses map[string]interface{}) error {
+	for name, config := range responses {
+		init, ok := responsePlugins[name]
+		if !ok {
+			return fmt.Errorf("could not find response plugin: %s", name)
+		}
+
+		p, err := init(config)
+		if err != nil {
+			return err
+		}
+		r.responsePlugins[name] = p
+	}
+	return nil
+}
+
+// HasResponsePlugins reports whether any response plugins are configured
+func (r *PluginRegistry) HasResponsePlugins() bool {
+	return len(r.responsePlugins) > 0
+}
+
+// LoadSessionHookPlugins initializes the session hook plugins configured by hooks
+func (r *PluginRegistry) LoadSessionHookPlugins(hooks map[string]interface{}) error {
+	for name, config := range hooks {
+		init, ok := sessionHookPlugins[name]
+		if !ok {
+			return fmt.Errorf("could not find session hook plugin: %s", name)
+		}
+
+		p, err := init(config)
+		if err != nil {
+			return err
+		}
+		r.sessionHooks[name] = p
+	}
+	return nil
+}
+
+// HasSessionHooks reports whether any session hook plugins are configured
+func (r *PluginRegistry) HasSessionHooks() bool {
+	return len(r.sessionHooks) > 0
+}
+
+// NewResponseTransformers returns the response transformers for sess
+func (r *PluginRegistry) NewResponseTransformers(sess *Session) []ResponseTransformer {
+	var transformers []ResponseTransformer
+	for _, p := range r.responsePlugins {
+		t := p.NewResponseTransformer(sess)
+		if t != nil {
+			transformers = append(transformers, t)
+		}
+	}
+	return transformers
+}
+
+// LogEnabled reports whether any logging plugin emits level entries,
+// so callers can skip building expensive logging contexts
+func (r *PluginRegistry) LogEnabled(level string) bool {
+	for _, d := range r.loggers {
+		if d.enabled(level) {
+			return true
+		}
+	}
+	return false
+}
+
+// DroppedLogs is the number of log entries each logging plugin's queue dropped on overflow
+func (r *PluginRegistry) DroppedLogs() map[string]uint64 {
+	dropped := make(map[string]uint64, len(r.loggers))
+	for name, d := range r.loggers {
+		dropped[name] = d.droppedEntries()
+	}
+	return dropped
+}
+
+// FlushLogs waits for the queued log entries to be delivered
+func (r *PluginRegistry) FlushLogs() {
+	for _, d := range r.loggers {
+		d.flush()
+	}
+}
+
+// plugins returns every plugin of r by its kind and name, e.g. "logging/file";
+// a registry sharing the logging, response and session hook plugins of its parent only returns its own
+func (r *PluginRegistry) plugins() map[string]Plugin {
+	plugins := make(map[string]Plugin)
+	for name, p := range r.authPlugins {
+		plugins["authentication/"+name] = p
+	}
+	if r.parent != nil {
+		return plugins
+	}
+	for name, p := range r.loggingPlugins {
+		plugins["logging/"+name] = p
+	}
+	for name, p := range r.responsePlugins {
+		plugins["responses/"+name] = p
+	}
+	for name, p := range r.sessionHooks {
+		plugins["hooks/"+name] = p
+	}
+	return plugins
+}
+
+// Close delivers the queued log entries and closes the plugins implementing PluginCloser
+func (r *PluginRegistry) Close() error {
+	if r.parent == nil {
+		for _, d := range r.loggers {
+			d.close()
+		}
+	}
+
+	var err error
+	for name, p := range r.plugins() {
+		closer, ok := p.(PluginCloser)
+		if !ok {
+			continue
+		}
+		e := closer.Close()
+		if e != nil {
+			err = fmt.Errorf("error closing %s plugin: %s", name, e)
+			// Logging plugins may be closed already, so this goes to stderr
+			log.Println(err)
+		}
+	}
+	return err
+}
+
+// Reload passes the new configuration of each plugin to the plugins implementing PluginReloader,
+// plugins can not be added or removed without restarting
+func (r *PluginRegistry) Reload(auth map[string]interface{}, logging map[string]ConfigMap, responses map[string]interface{}, hooks map[string]interface{}) error {
+	var err error
+	configs := make(map[string]interface{})
+	for name, config := range auth {
+		configs["authentication/"+name] = config
+	}
+	if r.parent == nil {
+		for name, config := range logging {
+			configs["logging/"+name] = config
+			if d, ok := r.loggers[name]; ok {
+				e := d.configure(config)
+				if e != nil {
+					err = e
+					r.LogError(nil, "%s", e)
+				}
+			}
+		}
+		for name, config := range responses {
+			configs["responses/"+name] = config
+		}
+		for name, config := range hooks {
+			configs["hooks/"+name] = config
+		}
+	}
+
+	plugins := r.plugins()
+	for name, p := range plugins {
+		config, ok := configs[name]
+		if !ok {
+			r.LogWarn(nil, "%s plugin was removed from the config, restart to stop it", name)
+			continue
+		}
+		reloader, ok := p.(PluginReloader)
+		if !ok {
+			continue
+		}
+		e := reloader.Reload(config)
+		if e != nil {
+			err = fmt.Errorf("error reloading %s plugin: %s", name, e)
+			r.LogError(nil, "%s", err)
+		}
+	}
+	for name := range configs {
+		if _, ok := plugins[name]; !ok {
+			r.LogWarn(nil, "%s plugin was added to the config, restart to start it", name)
+		}
+	}
+	return err
+}
+
+// ReopenLogs reopens the files of the plugins implementing PluginReopener
+func (r *PluginRegistry) ReopenLogs() error {
+	var err error
+	for name, p := range r.plugins() {
+		reopener, ok := p.(PluginReopener)
+		if !ok {
+			continue
+		}
+		e := reopener.Reopen()
+		if e != nil {
+			err = fmt.Errorf("error reopening %s plugin: %s", name, e)
+			r.LogError(nil, "%s", err)
+		}
+	}
+	return err
+}
+
+// Health checks the plugins implementing PluginHealthChecker, returning their errors by plugin
+func (r *PluginRegistry) Health() map[string]error {
+	health := make(map[string]error)
+	for name, p := range r.plugins() {
+		checker, ok := p.(PluginHealthChecker)
+		if !ok {
+			continue
+		}
+		err := checker.Health()
+		if err != nil {
+			r.LogWarn(nil, "%s plugin is unhealthy: %s", name, err)
+		}
+		health[name] = err
+	}
+	return health
+}
+
 func (r *PluginRegistry) handleLog(msg loggingMessage) {
-	r.logMutex.Lock()
-	for _, p := range r.loggingPlugins {
-		switch msg.level {
-		case "info":
-			p.LogInfo(msg.context, msg.msg, msg.args...)
-		case "debug":
-			p.LogDebug(msg.context, msg.msg, msg.args...)
-		case "warn":
-			p.LogWarn(msg.context, msg.msg, msg.args...)
-		case "error":
-			p.LogError(msg.context, msg.msg, msg.args...)
-		case "fatal":
-			p.LogFatal(msg.context, msg.msg, msg.args...)
+	for _, d := range r.loggers {
+		if d.accepts(&msg) {
+			d.push(msg)
 		}
 	}
-	r.logMutex.Unlock()
+	// Fatal entries are usually followed by exiting
+	if msg.level == "fatal" {
+		r.FlushLogs()
+	}
 }
 
 func (r *PluginRegistry) Authenticate(sess *Session) (bool, error) {
-	for _, p := range r.authPlugins {
-		success, err := p.Authenticate(sess)
+	for name, p := range r.authPlugins {
+		success, err := sess.traceAuthentication(name, p)
 		if err != nil {
 			return false, err
 		}
@@ -4,10 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/c653labs/pggateway"
@@ -19,49 +24,85 @@ func init() {
 
 type logLevel int
 
+// Levels in increasing severity, events below the configured level are dropped
 const (
-	LevelFatal logLevel = iota
-	LevelError
-	LevelDebug
-	LevelWarn
+	LevelDebug logLevel = iota
 	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
 )
 
+// PutLogEvents limits
+const (
+	maxBatchEvents = 10000
+	maxBatchBytes  = 1048576
+	eventOverhead  = 26
+	maxEventBytes  = 262144 - eventOverhead
+)
+
+func parseLevel(config pggateway.ConfigMap) (logLevel, error) {
+	level := LevelWarn
+	l := config.StringDefault("level", "warn")
+	switch strings.ToLower(l) {
+	case "warn":
+		level = LevelWarn
+	case "info":
+		level = LevelInfo
+	case "error":
+		level = LevelError
+	case "debug":
+		level = LevelDebug
+	case "fatal":
+		level = LevelFatal
+	default:
+		return level, fmt.Errorf("unknown logging level: %#v", l)
+	}
+	return level, nil
+}
+
 type LoggingPlugin struct {
 	sess   *session.Session
 	log    *cloudwatchlogs.CloudWatchLogs
 	group  string
 	stream string
 	token  *string
-	level  logLevel
+	level  int32
+
+	flushInterval time.Duration
+	batchEvents   int
+	maxRetries    int
+
+	// mutex guards sending to events once it may be closed
+	mutex   sync.RWMutex
+	closed  bool
+	events  chan *cloudwatchlogs.InputLogEvent
+	flush   chan chan struct{}
+	done    chan struct{}
+	dropped int64
+
+	errMutex sync.Mutex
+	lastErr  error
 }
 
 func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, error) {
 	options := session.Options{}
 	region, ok := config.String("region")
 	if ok {
-		options.Config = aws.Config{Region: aws.String(region)}
+		options.Config.Region = aws.String(region)
+	}
+	// A different endpoint, e.g. a local stand-in for CloudWatch
+	endpoint, ok := config.String("endpoint")
+	if ok {
+		options.Config.Endpoint = aws.String(endpoint)
 	}
 
 	sess := session.Must(session.NewSessionWithOptions(options))
 	logs := cloudwatchlogs.New(sess)
 
-	// Log level
-	level := LevelWarn
-	l := config.StringDefault("level", "warn")
-	switch strings.ToLower(l) {
-	case "warn":
-		level = LevelWarn
-	case "info":
-		level = LevelInfo
-	case "error":
-		level = LevelError
-	case "debug":
-		level = LevelDebug
-	case "fatal":
-		level = LevelFatal
-	default:
-		return nil, fmt.Errorf("unknown logging level: %#v", level)
+	level, err := parseLevel(config)
+	if err != nil {
+		return nil, err
 	}
 
 	group, ok := config.String("group")
@@ -74,24 +115,29 @@ func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, erro
 		return nil, fmt.Errorf("must supply 'stream' parameter")
 	}
 
-	out, err := logs.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
-		LogGroupName:        aws.String(group),
-		LogStreamNamePrefix: aws.String(stream),
-	})
-	if err != nil {
-		return nil, err
+	batchEvents := config.IntDefault("batch_size", maxBatchEvents)
+	if batchEvents < 1 || batchEvents > maxBatchEvents {
+		return nil, fmt.Errorf("'batch_size' must be between 1 and %d", maxBatchEvents)
 	}
 
-	exists := false
-	var token *string
-	for _, s := range out.LogStreams {
-		if *s.LogStreamName == stream {
-			token = s.UploadSequenceToken
-			exists = true
-			break
-		}
+	p := &LoggingPlugin{
+		sess:          sess,
+		log:           logs,
+		level:         int32(level),
+		group:         group,
+		stream:        stream,
+		flushInterval: config.DurationDefault("flush_interval", 5*time.Second),
+		batchEvents:   batchEvents,
+		maxRetries:    config.IntDefault("max_retries", 5),
+		events:        make(chan *cloudwatchlogs.InputLogEvent, config.IntDefault("queue_size", 10000)),
+		flush:         make(chan chan struct{}),
+		done:          make(chan struct{}),
 	}
 
+	exists, err := p.refreshToken()
+	if err != nil {
+		return nil, err
+	}
 	if !exists {
 		_, err = logs.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
 			LogGroupName:  aws.String(group),
@@ -102,18 +148,136 @@ func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, erro
 		}
 	}
 
-	return &LoggingPlugin{
-		sess:   sess,
-		log:    logs,
-		level:  level,
-		group:  group,
-		stream: stream,
-		token:  token,
-	}, nil
+	go p.run()
+	return p, nil
+}
+
+// refreshToken fetches the stream's upload sequence token, reporting whether the stream exists
+func (l *LoggingPlugin) refreshToken() (bool, error) {
+	out, err := l.log.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(l.group),
+		LogStreamNamePrefix: aws.String(l.stream),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range out.LogStreams {
+		if *s.LogStreamName == l.stream {
+			l.token = s.UploadSequenceToken
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// run batches events until the plugin is closed, flushing when a batch is full or flushInterval has passed
+func (l *LoggingPlugin) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.flushInterval)
+	defer ticker.Stop()
+
+	var batch []*cloudwatchlogs.InputLogEvent
+	size := 0
+	send := func() {
+		if len(batch) > 0 {
+			l.send(batch)
+		}
+		batch, size = nil, 0
+	}
+	add := func(event *cloudwatchlogs.InputLogEvent) {
+		eventSize := len(*event.Message) + eventOverhead
+		if len(batch) >= l.batchEvents || size+eventSize > maxBatchBytes {
+			send()
+		}
+		batch = append(batch, event)
+		size += eventSize
+	}
+
+	for {
+		select {
+		case event, ok := <-l.events:
+			if !ok {
+				send()
+				return
+			}
+			add(event)
+		case <-ticker.C:
+			send()
+		case flushed := <-l.flush:
+			// Drain what was queued before the flush was requested
+			for n := len(l.events); n > 0; n-- {
+				add(<-l.events)
+			}
+			send()
+			close(flushed)
+		}
+	}
+}
+
+// send puts batch, retrying with backoff when throttled or when the sequence token is stale
+func (l *LoggingPlugin) send(batch []*cloudwatchlogs.InputLogEvent) {
+	// Events must be in chronological order within a batch
+	sort.SliceStable(batch, func(i, j int) bool {
+		return *batch[i].Timestamp < *batch[j].Timestamp
+	})
+
+	backoff := 200 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := l.putLogEvents(batch)
+		if err == nil {
+			l.setError(nil)
+			return
+		}
+
+		retry := false
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case cloudwatchlogs.ErrCodeDataAlreadyAcceptedException:
+				// A previous attempt succeeded after all, only the token is stale
+				l.refreshToken()
+				l.setError(nil)
+				return
+			case cloudwatchlogs.ErrCodeInvalidSequenceTokenException:
+				_, terr := l.refreshToken()
+				retry = terr == nil
+			case "ThrottlingException", cloudwatchlogs.ErrCodeServiceUnavailableException, cloudwatchlogs.ErrCodeOperationAbortedException:
+				retry = true
+			}
+		}
+		if !retry || attempt >= l.maxRetries {
+			log.Printf("error putting %d log events to %s/%s: %s", len(batch), l.group, l.stream, err)
+			l.setError(err)
+			return
+		}
+
+		time.Sleep(backoff)
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (l *LoggingPlugin) putLogEvents(batch []*cloudwatchlogs.InputLogEvent) error {
+	res, err := l.log.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+		LogGroupName:  aws.String(l.group),
+		LogStreamName: aws.String(l.stream),
+		SequenceToken: l.token,
+		LogEvents:     batch,
+	})
+	if err != nil {
+		return err
+	}
+
+	l.token = res.NextSequenceToken
+	if res.RejectedLogEventsInfo != nil {
+		log.Printf("rejected log events for %s/%s: %s", l.group, l.stream, res.RejectedLogEventsInfo)
+	}
+	return nil
 }
 
 func (l *LoggingPlugin) putLogEvent(level logLevel, context pggateway.LoggingContext, msg string, args ...interface{}) error {
-	if level < l.level {
+	if int32(level) < atomic.LoadInt32(&l.level) {
 		return nil
 	}
 
@@ -128,49 +292,106 @@ func (l *LoggingPlugin) putLogEvent(level logLevel, context pggateway.LoggingCon
 	if err != nil {
 		return err
 	}
+	if len(msgFormatted) > maxEventBytes {
+		// Events must be valid UTF-8, so never cut a character in half
+		n := maxEventBytes
+		for n > 0 && !utf8.RuneStart(msgFormatted[n]) {
+			n--
+		}
+		msgFormatted = msgFormatted[:n]
+	}
 
-	res, err := l.log.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
-		LogGroupName:  aws.String(l.group),
-		LogStreamName: aws.String(l.stream),
-		SequenceToken: l.token,
-		LogEvents: []*cloudwatchlogs.InputLogEvent{
-			&cloudwatchlogs.InputLogEvent{
-				Message:   aws.String(string(msgFormatted)),
-				Timestamp: aws.Int64(now),
-			},
-		},
-	})
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if l.closed {
+		return fmt.Errorf("cloudwatchlogs plugin is closed")
+	}
+
+	select {
+	case l.events <- &cloudwatchlogs.InputLogEvent{
+		Message:   aws.String(string(msgFormatted)),
+		Timestamp: aws.Int64(now),
+	}:
+		return nil
+	default:
+		// Never hold up sessions when CloudWatch can not keep up
+		dropped := atomic.AddInt64(&l.dropped, 1)
+		if dropped%1000 == 1 {
+			return fmt.Errorf("cloudwatchlogs queue is full, dropped %d log events so far", dropped)
+		}
+		return nil
+	}
+}
+
+func (l *LoggingPlugin) setError(err error) {
+	l.errMutex.Lock()
+	l.lastErr = err
+	l.errMutex.Unlock()
+}
+
+// Health reports the error of the last batch, if it could not be delivered
+func (l *LoggingPlugin) Health() error {
+	l.errMutex.Lock()
+	defer l.errMutex.Unlock()
+	return l.lastErr
+}
+
+// Reload applies a new level, other changes require a restart
+func (l *LoggingPlugin) Reload(config interface{}) error {
+	c, _ := config.(pggateway.ConfigMap)
+	level, err := parseLevel(c)
 	if err != nil {
 		return err
 	}
+	atomic.StoreInt32(&l.level, int32(level))
+	return nil
+}
 
-	if res.RejectedLogEventsInfo != nil {
-		return fmt.Errorf("rejected log events info: %#v", res.RejectedLogEventsInfo)
+// Flush sends the queued events and waits for them to be delivered
+func (l *LoggingPlugin) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case l.flush <- flushed:
+		<-flushed
+	case <-l.done:
 	}
+}
 
-	l.token = res.NextSequenceToken
+// Close flushes the queued events and stops the plugin
+func (l *LoggingPlugin) Close() error {
+	l.mutex.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.events)
+	}
+	l.mutex.Unlock()
+	<-l.done
 	return nil
 }
 
-func (l *LoggingPlugin) LogInfo(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	err := l.putLogEvent(LevelInfo, context, msg, args...)
+func (l *LoggingPlugin) logEvent(level logLevel, context pggateway.LoggingContext, msg string, args ...interface{}) {
+	err := l.putLogEvent(level, context, msg, args...)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
+func (l *LoggingPlugin) LogInfo(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	l.logEvent(LevelInfo, context, msg, args...)
+}
+
 func (l *LoggingPlugin) LogError(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	l.putLogEvent(LevelError, context, msg, args...)
+	l.logEvent(LevelError, context, msg, args...)
 }
 
 func (l *LoggingPlugin) LogDebug(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	l.putLogEvent(LevelDebug, context, msg, args...)
+	l.logEvent(LevelDebug, context, msg, args...)
 }
 
 func (l *LoggingPlugin) LogFatal(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	l.putLogEvent(LevelFatal, context, msg, args...)
+	l.logEvent(LevelFatal, context, msg, args...)
 }
 
 func (l *LoggingPlugin) LogWarn(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	l.putLogEvent(LevelWarn, context, msg, args...)
+	l.logEvent(LevelWarn, context, msg, args...)
 }
@@ -0,0 +1,229 @@
+package logging_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	_ "github.com/c653labs/pggateway/plugins/cloudwatchlogs-logging"
+	_ "github.com/c653labs/pggateway/plugins/passthrough-authentication"
+)
+
+// cloudWatch is a stand-in for the CloudWatch Logs API, holding the events put to a single stream
+type cloudWatch struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	stream bool
+	events []string
+}
+
+func newCloudWatch(t *testing.T) *cloudWatch {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	cw := &cloudWatch{}
+	cw.Server = httptest.NewServer(http.HandlerFunc(cw.serve))
+	t.Cleanup(cw.Close)
+	return cw
+}
+
+func (cw *cloudWatch) serve(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		LogStreamName string
+		LogEvents     []struct{ Message string }
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Logs_20140328.") {
+	case "DescribeLogStreams":
+		if !cw.stream {
+			w.Write([]byte(`{"logStreams":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"logStreams": []interface{}{map[string]interface{}{"logStreamName": req.LogStreamName}},
+		})
+	case "CreateLogStream":
+		cw.stream = true
+		w.Write([]byte(`{}`))
+	case "PutLogEvents":
+		for _, e := range req.LogEvents {
+			cw.events = append(cw.events, e.Message)
+		}
+		w.Write([]byte(`{"nextSequenceToken":"1"}`))
+	default:
+		http.Error(w, "unknown target", http.StatusBadRequest)
+	}
+}
+
+func (cw *cloudWatch) messages(t *testing.T) []map[string]interface{} {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	var messages []map[string]interface{}
+	for _, event := range cw.events {
+		var msg map[string]interface{}
+		err := json.Unmarshal([]byte(event), &msg)
+		if err != nil {
+			t.Fatalf("invalid event %q: %s", event, err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+// startGateway starts a gateway logging to cw at level, passing sessions through to srv
+func startGateway(t *testing.T, srv *pgtest.Server, cw *cloudWatch, level string) *pgtest.Gateway {
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{
+			"passthrough": map[string]interface{}{
+				"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port()},
+			},
+		},
+		Logging: map[string]pggateway.ConfigMap{
+			"cloudwatchlogs": {
+				"region":   "us-east-1",
+				"endpoint": cw.URL,
+				"group":    "pggateway",
+				"stream":   "test",
+				"level":    level,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gw
+}
+
+func TestCloudWatchLogging(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cw := newCloudWatch(t)
+	gw := startGateway(t, srv, cw, "info")
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	// Closing the gateway sends the batched events
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, msg := range cw.messages(t) {
+		if msg["text"] != "new client session" {
+			continue
+		}
+		context, _ := msg["context"].(map[string]interface{})
+		found = context["user"] == "app" && context["database"] == "app"
+	}
+	if !found {
+		t.Fatalf("no new client session event with the session's context in %v", cw.messages(t))
+	}
+}
+
+func TestCloudWatchLoggingLevel(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	cw := newCloudWatch(t)
+	gw := startGateway(t, srv, cw, "warn")
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	// Sessions fail once the target is gone
+	srv.Close()
+	_, err = pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err == nil {
+		t.Fatal("connected without a target")
+	}
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors are more severe than warnings, info and debug events are not
+	var errors int
+	for _, msg := range cw.messages(t) {
+		text, _ := msg["text"].(string)
+		switch {
+		case strings.HasPrefix(text, "client session end: "):
+			errors++
+		case text == "new client session", text == "client session end", text == "client request":
+			t.Errorf("event %q is below the warn level", text)
+		}
+	}
+	if errors == 0 {
+		t.Fatalf("no error event for the failed session in %v", cw.messages(t))
+	}
+}
+
+func TestCloudWatchLoggingTruncation(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// The debug event for the query carries it in its context, far beyond the event size limit
+	query := "SELECT '" + strings.Repeat("€", 100000) + "'"
+	srv.SetResult(query, pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"€"}}})
+
+	cw := newCloudWatch(t)
+	gw := startGateway(t, srv, cw, "debug")
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	var truncated bool
+	for _, event := range cw.events {
+		if len(event) > 262144-26 {
+			t.Errorf("event of %d bytes exceeds the limit", len(event))
+		}
+		if !utf8.ValidString(event) {
+			t.Errorf("event is not valid UTF-8: %q", event[len(event)-10:])
+		}
+		truncated = truncated || strings.Contains(event, "€€€") && !json.Valid([]byte(event))
+	}
+	if !truncated {
+		t.Fatal("no truncated event for the query")
+	}
+}
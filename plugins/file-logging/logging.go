@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/c653labs/pggateway"
 	"github.com/rs/zerolog"
@@ -16,13 +17,16 @@ func init() {
 }
 
 type LoggingPlugin struct {
-	log zerolog.Logger
+	mutex sync.RWMutex
+	log   zerolog.Logger
+	file  *rotatingFile
 }
 
 func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, error) {
 	var err error
 
 	var outFile io.Writer
+	var file *rotatingFile
 	outFile = os.Stdout
 	textColor := true
 	out := config.StringDefault("out", "-")
@@ -31,15 +35,23 @@ func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, erro
 		outFile = os.Stdout
 		textColor = true
 	default:
-		outFile, err = os.OpenFile(out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		rotate, err := parseRotateConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		file, err = openRotatingFile(out, rotate)
 		textColor = false
 		if err != nil {
 			return nil, err
 		}
+		outFile = file
 	}
 
 	format := strings.ToLower(config.StringDefault("format", "json"))
 	if format != "text" && format != "json" {
+		if file != nil {
+			file.Close()
+		}
 		return nil, fmt.Errorf("unknown log format %#v, expected 'text' or 'json'", format)
 	}
 
@@ -50,19 +62,60 @@ func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, erro
 		}
 	}
 
-	level := zerolog.WarnLevel
-	l := config.StringDefault("level", "warn")
-	l = strings.ToLower(l)
-	level, err = zerolog.ParseLevel(l)
+	level, err := parseLevel(config)
 	if err != nil {
+		if file != nil {
+			file.Close()
+		}
 		return nil, err
 	}
 
 	return &LoggingPlugin{
-		log: zerolog.New(outFile).Level(level).With().Timestamp().Logger(),
+		log:  zerolog.New(outFile).Level(level).With().Timestamp().Logger(),
+		file: file,
 	}, nil
 }
 
+func parseLevel(config pggateway.ConfigMap) (zerolog.Level, error) {
+	l := config.StringDefault("level", "warn")
+	return zerolog.ParseLevel(strings.ToLower(l))
+}
+
+// Reload applies a new level, changing where log entries are written requires a restart
+func (l *LoggingPlugin) Reload(config interface{}) error {
+	c, _ := config.(pggateway.ConfigMap)
+	level, err := parseLevel(c)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.log = l.log.Level(level)
+	l.mutex.Unlock()
+	return nil
+}
+
+// Reopen reopens the log file, after it was moved by an external log rotation
+func (l *LoggingPlugin) Reopen() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Reopen()
+}
+
+func (l *LoggingPlugin) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+func (l *LoggingPlugin) logger() *zerolog.Logger {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	logger := l.log
+	return &logger
+}
+
 func (l *LoggingPlugin) logMsg(e *zerolog.Event, context pggateway.LoggingContext, msg string, args ...interface{}) {
 	if !e.Enabled() {
 		return
@@ -75,21 +128,21 @@ func (l *LoggingPlugin) logMsg(e *zerolog.Event, context pggateway.LoggingContex
 }
 
 func (l *LoggingPlugin) LogInfo(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	l.logMsg(l.log.Info(), context, msg, args...)
+	l.logMsg(l.logger().Info(), context, msg, args...)
 }
 
 func (l *LoggingPlugin) LogError(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	l.logMsg(l.log.Error(), context, msg, args...)
+	l.logMsg(l.logger().Error(), context, msg, args...)
 }
 
 func (l *LoggingPlugin) LogDebug(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	l.logMsg(l.log.Debug(), context, msg, args...)
+	l.logMsg(l.logger().Debug(), context, msg, args...)
 }
 
 func (l *LoggingPlugin) LogFatal(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	l.logMsg(l.log.Fatal(), context, msg, args...)
+	l.logMsg(l.logger().Fatal(), context, msg, args...)
 }
 
 func (l *LoggingPlugin) LogWarn(context pggateway.LoggingContext, msg string, args ...interface{}) {
-	l.logMsg(l.log.Warn(), context, msg, args...)
+	l.logMsg(l.logger().Warn(), context, msg, args...)
 }
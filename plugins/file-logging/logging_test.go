@@ -0,0 +1,86 @@
+package logging_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	_ "github.com/c653labs/pggateway/plugins/file-logging"
+	_ "github.com/c653labs/pggateway/plugins/passthrough-authentication"
+)
+
+func TestFileLogging(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	out := filepath.Join(t.TempDir(), "pggateway.log")
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{
+			"passthrough": map[string]interface{}{
+				"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port()},
+			},
+		},
+		Logging: map[string]pggateway.ConfigMap{
+			"file": {"out": out, "format": "json", "level": "debug"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	// Closing the gateway delivers the queued entries
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	messages := make(map[string]map[string]interface{})
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("invalid log entry %q: %s", scanner.Text(), err)
+		}
+		// The session may still be ending when the gateway is closed
+		msg := strings.SplitN(entry["message"].(string), ":", 2)[0]
+		messages[msg] = entry
+	}
+
+	for _, msg := range []string{"new client session", "client request", "server response", "client session end"} {
+		entry, ok := messages[msg]
+		if !ok {
+			t.Errorf("no %#v entry in %v", msg, messages)
+			continue
+		}
+		context, _ := entry["context"].(map[string]interface{})
+		if context["user"] != "app" || context["database"] != "app" {
+			t.Errorf("%#v entry lacks the session context: %v", msg, entry)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pggateway"
+)
+
+const rotatedTimeFormat = "20060102T150405.000"
+
+// rotateConfig
+type rotateConfig struct {
+	// MaxSize rotates the file once it grows past this many bytes, 0 disables it
+	MaxSize int64
+	// Interval rotates the file once it is this old, 0 disables it
+	Interval time.Duration
+	// MaxBackups is the number of rotated files kept, 0 keeps all of them
+	MaxBackups int
+	Compress   bool
+}
+
+func parseRotateConfig(config pggateway.ConfigMap) (rotateConfig, error) {
+	rotate := rotateConfig{
+		MaxSize:    int64(config.IntDefault("max_size", 0)),
+		MaxBackups: config.IntDefault("max_backups", 0),
+		Compress:   config.BoolDefault("compress", false),
+	}
+	if interval, ok := config.String("rotate_interval"); ok {
+		var err error
+		rotate.Interval, err = time.ParseDuration(interval)
+		if err != nil {
+			return rotate, fmt.Errorf("invalid rotate_interval: %s", err)
+		}
+	}
+	if rotate.MaxSize < 0 || rotate.MaxBackups < 0 || rotate.Interval < 0 {
+		return rotate, fmt.Errorf("max_size, max_backups and rotate_interval must not be negative")
+	}
+	return rotate, nil
+}
+
+var (
+	filesMutex sync.Mutex
+	// files are shared by every plugin writing to the same path, so rotating one rotates all of them
+	files = make(map[string]*rotatingFile)
+)
+
+// rotatingFile is an append-only log file rotated by size and age, and reopened on request
+type rotatingFile struct {
+	path   string
+	config rotateConfig
+	refs   int
+
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	opened  time.Time
+	pending sync.WaitGroup
+	// cleanupMutex runs one cleanup at a time, so they never remove each other's files
+	cleanupMutex sync.Mutex
+}
+
+// openRotatingFile opens path, or shares it when it is already open with the same rotate config
+func openRotatingFile(path string, config rotateConfig) (*rotatingFile, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	if f, ok := files[path]; ok {
+		// Rotating a shared file by two configs would rotate it by whichever write comes first
+		if f.config != config {
+			return nil, fmt.Errorf("log file %s is already open with different rotate options", path)
+		}
+		f.refs++
+		return f, nil
+	}
+
+	f := &rotatingFile{path: path, config: config, refs: 1}
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+	files[path] = f
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// Write writes p in full to the current file, rotating it first when it is due
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.due(int64(len(p))) {
+		err := f.rotate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error rotating %s: %s\n", f.path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) due(next int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.config.MaxSize > 0 && f.size+next > f.config.MaxSize {
+		return true
+	}
+	return f.config.Interval > 0 && time.Since(f.opened) >= f.config.Interval
+}
+
+// rotate renames the current file, and opens a new one in its place
+func (f *rotatingFile) rotate() error {
+	rotated := f.path + "." + time.Now().Format(rotatedTimeFormat)
+	// Never overwrite a file rotated within the same millisecond
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s-%d", f.path, time.Now().Format(rotatedTimeFormat), i)
+	}
+	err := os.Rename(f.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	old := f.file
+	err = f.open()
+	if err != nil {
+		// Keep writing to the renamed file rather than losing entries
+		return err
+	}
+	old.Close()
+
+	f.pending.Add(1)
+	go func() {
+		defer f.pending.Done()
+		f.cleanupMutex.Lock()
+		defer f.cleanupMutex.Unlock()
+		f.cleanup(rotated)
+	}()
+	return nil
+}
+
+// cleanup compresses the rotated file and removes the oldest backups
+func (f *rotatingFile) cleanup(rotated string) {
+	if f.config.Compress {
+		err := compressFile(rotated)
+		// Files rotated in quick succession may have been removed by an earlier cleanup already
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "error compressing %s: %s\n", rotated, err)
+		}
+	}
+	if f.config.MaxBackups == 0 {
+		return
+	}
+
+	// Only match rotated files, not e.g. files moved by an external log rotation
+	backups, err := filepath.Glob(f.path + ".[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]T*")
+	if err != nil {
+		return
+	}
+	var kept []string
+	modified := make(map[string]time.Time)
+	for _, backup := range backups {
+		info, err := os.Stat(backup)
+		if err != nil || strings.HasSuffix(backup, ".gz.tmp") {
+			continue
+		}
+		kept = append(kept, backup)
+		modified[backup] = info.ModTime()
+	}
+	// Oldest first, files rotated within the same millisecond have the same name but for a counter
+	sort.Slice(kept, func(i, j int) bool {
+		if !modified[kept[i]].Equal(modified[kept[j]]) {
+			return modified[kept[i]].Before(modified[kept[j]])
+		}
+		return kept[i] < kept[j]
+	})
+	for len(kept) > f.config.MaxBackups {
+		err = os.Remove(kept[0])
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "error removing %s: %s\n", kept[0], err)
+		}
+		kept = kept[1:]
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Reopen closes and reopens the file at its path, e.g. after logrotate moved it
+func (f *rotatingFile) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	old := f.file
+	err := f.open()
+	if err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// Close closes the file once every plugin sharing it closed it
+func (f *rotatingFile) Close() error {
+	filesMutex.Lock()
+	f.refs--
+	last := f.refs == 0
+	if last {
+		delete(files, f.path)
+	}
+	filesMutex.Unlock()
+	if !last {
+		return nil
+	}
+
+	f.pending.Wait()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,209 @@
+package logging_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+)
+
+func openLog(t *testing.T, config pggateway.ConfigMap) pggateway.LoggingPlugin {
+	config["format"] = "json"
+	config["level"] = "info"
+	plugin, err := pggateway.NewLoggingPlugin("file", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plugin
+}
+
+func closeLog(t *testing.T, plugin pggateway.LoggingPlugin) {
+	err := plugin.(pggateway.PluginCloser).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// logFiles returns the rotated files of out, and the messages of every file including out
+func logFiles(t *testing.T, out string) ([]string, []string) {
+	backups, err := filepath.Glob(out + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, path := range append([]string{out}, backups...) {
+		messages = append(messages, readMessages(t, path)...)
+	}
+	sort.Strings(messages)
+	return backups, messages
+}
+
+func readMessages(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		r = gz
+	}
+
+	var messages []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var entry struct{ Message string }
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("%s: invalid log entry %q: %s", path, scanner.Text(), err)
+		}
+		messages = append(messages, entry.Message)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+	return messages
+}
+
+func entries(prefix string, from, to int) []string {
+	var messages []string
+	for i := from; i < to; i++ {
+		messages = append(messages, fmt.Sprintf("%s %02d", prefix, i))
+	}
+	return messages
+}
+
+func TestRotateSize(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "pggateway.log")
+	plugin := openLog(t, pggateway.ConfigMap{"out": out, "max_size": 200})
+	for _, msg := range entries("entry", 0, 30) {
+		plugin.LogInfo(nil, msg)
+	}
+	closeLog(t, plugin)
+
+	backups, messages := logFiles(t, out)
+	if len(backups) < 5 {
+		t.Fatalf("expected at least 5 rotated files, got %v", backups)
+	}
+	for _, path := range append(backups, out) {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%s grew to %d bytes", path, info.Size())
+		}
+	}
+	if want := entries("entry", 0, 30); !reflect.DeepEqual(messages, want) {
+		t.Fatalf("entries %v, expected %v", messages, want)
+	}
+}
+
+func TestRotateInterval(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "pggateway.log")
+	plugin := openLog(t, pggateway.ConfigMap{"out": out, "rotate_interval": "100ms"})
+	plugin.LogInfo(nil, "entry 00")
+	plugin.LogInfo(nil, "entry 01")
+	time.Sleep(150 * time.Millisecond)
+	plugin.LogInfo(nil, "entry 02")
+	closeLog(t, plugin)
+
+	backups, _ := logFiles(t, out)
+	if len(backups) != 1 {
+		t.Fatalf("expected a single rotated file, got %v", backups)
+	}
+	if messages := readMessages(t, backups[0]); !reflect.DeepEqual(messages, entries("entry", 0, 2)) {
+		t.Fatalf("rotated file has entries %v", messages)
+	}
+	if messages := readMessages(t, out); !reflect.DeepEqual(messages, entries("entry", 2, 3)) {
+		t.Fatalf("current file has entries %v", messages)
+	}
+}
+
+func TestRotateMaxBackups(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "pggateway.log")
+	plugin := openLog(t, pggateway.ConfigMap{"out": out, "max_size": 200, "max_backups": 2})
+	for _, msg := range entries("entry", 0, 30) {
+		plugin.LogInfo(nil, msg)
+	}
+	// Closing waits for the removal of the oldest backups
+	closeLog(t, plugin)
+
+	backups, messages := logFiles(t, out)
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", backups)
+	}
+	// The newest backups are kept
+	if len(messages) == 0 || !reflect.DeepEqual(messages, entries("entry", 30-len(messages), 30)) {
+		t.Fatalf("kept entries %v, expected the last ones", messages)
+	}
+}
+
+func TestRotateCompress(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "pggateway.log")
+	plugin := openLog(t, pggateway.ConfigMap{"out": out, "max_size": 200, "compress": true})
+	for _, msg := range entries("entry", 0, 30) {
+		plugin.LogInfo(nil, msg)
+	}
+	closeLog(t, plugin)
+
+	backups, messages := logFiles(t, out)
+	if len(backups) == 0 {
+		t.Fatal("no rotated files")
+	}
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".gz") {
+			t.Errorf("rotated file %s was not compressed", backup)
+		}
+	}
+	if want := entries("entry", 0, 30); !reflect.DeepEqual(messages, want) {
+		t.Fatalf("entries %v, expected %v", messages, want)
+	}
+}
+
+func TestRotateSharedPath(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "pggateway.log")
+	first := openLog(t, pggateway.ConfigMap{"out": out, "max_size": 200})
+	second := openLog(t, pggateway.ConfigMap{"out": out, "max_size": 200})
+
+	_, err := pggateway.NewLoggingPlugin("file", pggateway.ConfigMap{"out": out, "max_size": 400})
+	if err == nil || !strings.Contains(err.Error(), "already open with different rotate options") {
+		t.Fatalf("expected different rotate options to be rejected, got %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		first.LogInfo(nil, "first %02d", i)
+		second.LogInfo(nil, "second %02d", i)
+	}
+	// The file stays open for the plugins still sharing it
+	closeLog(t, first)
+	for i := 10; i < 20; i++ {
+		second.LogInfo(nil, "second %02d", i)
+	}
+	closeLog(t, second)
+
+	backups, messages := logFiles(t, out)
+	if len(backups) == 0 {
+		t.Fatal("no rotated files")
+	}
+	if want := append(entries("first", 0, 10), entries("second", 0, 20)...); !reflect.DeepEqual(messages, want) {
+		t.Fatalf("entries %v, expected %v", messages, want)
+	}
+
+	// Once closed by every plugin, the path can be opened with other options
+	closeLog(t, openLog(t, pggateway.ConfigMap{"out": out, "max_size": 400}))
+}
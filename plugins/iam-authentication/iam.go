@@ -32,7 +32,7 @@ func newIAMPlugin(config interface{}) (pggateway.AuthenticationPlugin, error) {
 func (p *IAMAuth) Authenticate(sess *pggateway.Session) (bool, error) {
 	// We are passing through IAM credentials... don't let people do silly things
 	if !sess.IsSSL {
-		return false, fmt.Errorf("IAM auth requires an SSL session")
+		return false, sess.WriteToClientEf("IAM auth requires an SSL session")
 	}
 
 	_, passwd, err := sess.GetUserPassword(pgproto.AuthenticationMethodPlaintext)
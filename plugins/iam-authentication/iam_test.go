@@ -0,0 +1,28 @@
+package iam_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	_ "github.com/c653labs/pggateway/plugins/iam-authentication"
+)
+
+func TestIAMRequiresSSL(t *testing.T) {
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{
+			"iam": map[string]interface{}{"db": "app", "password": "secret"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	// The AWS secret key is sent as the password, it must never cross the network in the clear
+	_, err = pgtest.Connect(gw.Addr(), "AKIDEXAMPLE", "secret-key", "app")
+	if err == nil || !strings.Contains(err.Error(), "requires an SSL session") {
+		t.Fatalf("expected an SSL error, got %v", err)
+	}
+}
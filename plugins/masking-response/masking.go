@@ -0,0 +1,334 @@
+package masking
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+)
+
+// Text type OIDs, whose binary format is the same as their text format
+var textTypes = map[int]bool{
+	19:   true, // name
+	25:   true, // text
+	1042: true, // bpchar
+	1043: true, // varchar
+}
+
+type ColumnRule struct {
+	// Name of the result column, as a pggateway.MatchPattern pattern. Aliases rename result columns,
+	// only TableOID and ColumnIndex identify a column whatever it is called.
+	Name string `json:"name"`
+	// TableOID restricts the rule to a single table, when set
+	TableOID int `json:"table_oid"`
+	// ColumnIndex is the attribute number of the column in TableOID, matching it even when aliased
+	ColumnIndex int `json:"column_index"`
+	// Action is one of "null", "hash", "partial" or "fake", applied to text columns;
+	// columns of other types are nulled whatever the action
+	Action string `json:"action"`
+	// Keep is the number of trailing characters left visible by "partial"
+	Keep int `json:"keep"`
+}
+
+type MaskingRule struct {
+	// Users the rule applies to, as pggateway.MatchPattern patterns, empty matching every user
+	Users   []string     `json:"users"`
+	Columns []ColumnRule `json:"columns"`
+}
+
+type Masking struct {
+	Rules []MaskingRule
+}
+
+func init() {
+	pggateway.RegisterResponsePlugin("masking", newMaskingPlugin)
+}
+
+func newMaskingPlugin(config interface{}) (pggateway.ResponsePlugin, error) {
+	plugin := &Masking{}
+	err := pggateway.FillStruct(config, &plugin.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range plugin.Rules {
+		for _, c := range rule.Columns {
+			switch c.Action {
+			case "null", "hash", "partial", "fake":
+			default:
+				return nil, fmt.Errorf("unknown masking action %#v for column %#v", c.Action, c.Name)
+			}
+			if c.Keep < 0 {
+				return nil, fmt.Errorf("masking keep must not be negative, got %d for column %#v", c.Keep, c.Name)
+			}
+			if c.Name == "" && (c.TableOID == 0 || c.ColumnIndex == 0) {
+				return nil, fmt.Errorf("masking columns need a name, or a table_oid and column_index")
+			}
+		}
+	}
+	return plugin, nil
+}
+
+func (p *Masking) NewResponseTransformer(sess *pggateway.Session) pggateway.ResponseTransformer {
+	var columns []ColumnRule
+	for _, rule := range p.Rules {
+		if pggateway.MatchAny(rule.Users, string(sess.User)) {
+			columns = append(columns, rule.Columns...)
+		}
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	return &transformer{
+		columns:    columns,
+		statements: make(map[string]*statement),
+		portals:    make(map[string]*portal),
+	}
+}
+
+// description is the shape of the rows of a statement, nil when it is not known
+type description struct {
+	// actions holds the rule of each column, nil when unmasked
+	actions []*ColumnRule
+	text    []bool
+}
+
+type statement struct {
+	description *description
+}
+
+type portal struct {
+	statement   *statement
+	description *description
+}
+
+// transformer follows the extended protocol to know the shape of every row. Statements and
+// portals are described when the client asks for it, rows of those it never described are nulled.
+type transformer struct {
+	columns []ColumnRule
+
+	mutex sync.Mutex
+	// pending are the requests whose responses did not arrive yet, in order
+	pending    []pgproto.ClientMessage
+	statements map[string]*statement
+	portals    map[string]*portal
+	// current is the shape of the rows being received
+	current *description
+	// refused is set from a refused COPY TO STDOUT up to the next ReadyForQuery
+	refused bool
+}
+
+func (t *transformer) ObserveRequest(msg pgproto.ClientMessage) {
+	switch msg.(type) {
+	case *pgproto.SimpleQuery, *pgproto.Parse, *pgproto.Bind, *pgproto.Describe, *pgproto.Execute, *pgproto.Close, *pgproto.Sync:
+		t.mutex.Lock()
+		t.pending = append(t.pending, msg)
+		t.mutex.Unlock()
+	}
+}
+
+// next returns the oldest request waiting for its response, or nil
+func (t *transformer) next() pgproto.ClientMessage {
+	if len(t.pending) == 0 {
+		return nil
+	}
+	return t.pending[0]
+}
+
+func (t *transformer) pop() {
+	if len(t.pending) > 0 {
+		t.pending = t.pending[1:]
+	}
+}
+
+func (t *transformer) TransformResponse(msg pgproto.ServerMessage) (pgproto.ServerMessage, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	switch m := msg.(type) {
+	case *pgproto.ParseComplete:
+		// The statement's shape is unknown until it is described
+		if parse, ok := t.next().(*pgproto.Parse); ok {
+			t.statements[string(parse.Name)] = &statement{}
+			t.pop()
+		}
+	case *pgproto.BindComplete:
+		if bind, ok := t.next().(*pgproto.Bind); ok {
+			t.portals[string(bind.Portal)] = &portal{statement: t.statements[string(bind.Statement)]}
+			t.pop()
+		}
+	case *pgproto.CloseComplete:
+		if c, ok := t.next().(*pgproto.Close); ok {
+			if c.ObjectType == pgproto.ObjectTypePortal {
+				delete(t.portals, string(c.Name))
+			} else {
+				delete(t.statements, string(c.Name))
+			}
+			t.pop()
+		}
+	case *pgproto.RowDescription:
+		t.described(t.describe(m))
+	case *pgproto.NoData:
+		t.described(&description{})
+	case *pgproto.DataRow:
+		if execute, ok := t.next().(*pgproto.Execute); ok {
+			t.current = t.portalDescription(string(execute.Portal))
+		}
+		t.mask(m)
+	case *pgproto.CommandCompletion, *pgproto.EmptyQueryResponse, *pgproto.PortalSuspended:
+		if _, ok := t.next().(*pgproto.Execute); ok {
+			t.pop()
+		}
+		t.current = nil
+	case *pgproto.Error:
+		// The target skips the extended protocol messages up to the next Sync
+		for req := t.next(); req != nil; req = t.next() {
+			if _, ok := req.(*pgproto.Sync); ok {
+				break
+			}
+			if _, ok := req.(*pgproto.SimpleQuery); ok {
+				break
+			}
+			t.pop()
+		}
+		t.current = nil
+	case *pgproto.CopyOutResponse:
+		// CopyData is not split into columns, masked users can not copy out at all
+		t.refused = true
+		return &pgproto.Error{
+			Severity: []byte("ERROR"),
+			Code:     []byte("42501"),
+			Message:  []byte("COPY TO STDOUT is not allowed with masking rules"),
+		}, nil
+	case *pgproto.ReadyForQuery:
+		t.pop()
+		t.current = nil
+		t.refused = false
+	}
+
+	// Once the client got the error, it only expects the ReadyForQuery
+	if t.refused {
+		return nil, nil
+	}
+	return msg, nil
+}
+
+// described handles the RowDescription or NoData answering a Describe, or preceding the rows of a simple query
+func (t *transformer) described(desc *description) {
+	describe, ok := t.next().(*pgproto.Describe)
+	if !ok {
+		t.current = desc
+		return
+	}
+	t.pop()
+	if describe.ObjectType == pgproto.ObjectTypePortal {
+		if p, ok := t.portals[string(describe.Name)]; ok {
+			p.description = desc
+		}
+		return
+	}
+	if stmt, ok := t.statements[string(describe.Name)]; ok {
+		stmt.description = desc
+	}
+}
+
+// portalDescription is the shape of the rows of a portal, from the portal or its statement being described
+func (t *transformer) portalDescription(name string) *description {
+	p, ok := t.portals[name]
+	if !ok {
+		return nil
+	}
+	if p.description != nil || p.statement == nil {
+		return p.description
+	}
+	return p.statement.description
+}
+
+func (t *transformer) describe(rows *pgproto.RowDescription) *description {
+	desc := &description{
+		actions: make([]*ColumnRule, len(rows.Fields)),
+		text:    make([]bool, len(rows.Fields)),
+	}
+	for i, field := range rows.Fields {
+		desc.text[i] = textTypes[int(field.TypeOID)]
+		name := strings.ToLower(string(field.ColumnName))
+		for j := range t.columns {
+			c := &t.columns[j]
+			if c.TableOID != 0 && c.TableOID != int(field.TableOID) {
+				continue
+			}
+			if c.ColumnIndex != 0 && c.ColumnIndex != int(field.ColumnIndex) {
+				continue
+			}
+			if c.Name != "" && !pggateway.MatchPattern(strings.ToLower(c.Name), name) {
+				continue
+			}
+			desc.actions[i] = c
+			break
+		}
+	}
+	return desc
+}
+
+func (t *transformer) mask(row *pgproto.DataRow) {
+	// Rows of an unknown shape may hold anything
+	if t.current == nil {
+		for i := range row.Fields {
+			row.Fields[i] = nil
+		}
+		return
+	}
+
+	for i, value := range row.Fields {
+		if i >= len(t.current.actions) || t.current.actions[i] == nil || value == nil {
+			continue
+		}
+		// Only text columns look the same in text and binary format,
+		// anything else can only be masked safely by nulling it
+		if !t.current.text[i] {
+			row.Fields[i] = nil
+			continue
+		}
+		row.Fields[i] = maskValue(t.current.actions[i], value)
+	}
+}
+
+func maskValue(c *ColumnRule, value []byte) []byte {
+	switch c.Action {
+	case "hash":
+		sum := sha256.Sum256(value)
+		return []byte(hex.EncodeToString(sum[:]))
+	case "partial":
+		runes := []rune(string(value))
+		for i := 0; i < len(runes)-c.Keep; i++ {
+			runes[i] = '*'
+		}
+		return []byte(string(runes))
+	case "fake":
+		return fake(value)
+	}
+	return nil
+}
+
+// fake replaces digits and letters with others derived from the value's hash,
+// keeping its length, case and punctuation, so equal values stay equal
+func fake(value []byte) []byte {
+	sum := sha256.Sum256(value)
+	runes := []rune(string(value))
+	for i, r := range runes {
+		n := sum[i%len(sum)] ^ byte(i/len(sum))
+		switch {
+		case r >= '0' && r <= '9':
+			runes[i] = '0' + rune(n%10)
+		case r >= 'a' && r <= 'z':
+			runes[i] = 'a' + rune(n%26)
+		case r >= 'A' && r <= 'Z':
+			runes[i] = 'A' + rune(n%26)
+		}
+	}
+	return []byte(string(runes))
+}
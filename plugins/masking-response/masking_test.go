@@ -0,0 +1,298 @@
+package masking_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	_ "github.com/c653labs/pggateway/plugins/masking-response"
+	_ "github.com/c653labs/pggateway/plugins/passthrough-authentication"
+	"github.com/c653labs/pgproto"
+)
+
+func startGateway(t *testing.T, srv *pgtest.Server, rules interface{}) *pgtest.Gateway {
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{
+			"passthrough": map[string]interface{}{
+				"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port()},
+			},
+		},
+		Responses: map[string]interface{}{"masking": rules},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gw.Close() })
+	return gw
+}
+
+func query(t *testing.T, gw *pgtest.Gateway, user string, q string) [][]string {
+	client, err := pgtest.Connect(gw.Addr(), user, "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rows, err := client.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestMasking(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT * FROM customers", pgtest.Result{
+		Columns: []string{"name", "email", "card", "phone", "notes"},
+		Rows:    [][]string{{"Ada", "ada@example.com", "4111111111111111", "555-0100", "vip"}},
+	})
+
+	gw := startGateway(t, srv, []interface{}{
+		map[string]interface{}{
+			"users": []string{"analyst_*"},
+			"columns": []interface{}{
+				map[string]interface{}{"name": "email", "action": "hash"},
+				map[string]interface{}{"name": "card", "action": "partial", "keep": 4},
+				map[string]interface{}{"name": "phone", "action": "fake"},
+				map[string]interface{}{"name": "no*", "action": "null"},
+			},
+		},
+	})
+
+	t.Run("masked user", func(t *testing.T) {
+		rows := query(t, gw, "analyst_1", "SELECT * FROM customers")
+		if len(rows) != 1 {
+			t.Fatalf("unexpected rows %v", rows)
+		}
+		row := rows[0]
+		sum := sha256.Sum256([]byte("ada@example.com"))
+		if row[0] != "Ada" {
+			t.Errorf("unmasked column changed to %q", row[0])
+		}
+		if row[1] != hex.EncodeToString(sum[:]) {
+			t.Errorf("email not hashed: %q", row[1])
+		}
+		if row[2] != "************1111" {
+			t.Errorf("card not partially masked: %q", row[2])
+		}
+		if len(row[3]) != len("555-0100") || row[3][3] != '-' || row[3] == "555-0100" {
+			t.Errorf("phone not faked keeping its format: %q", row[3])
+		}
+		if row[4] != "" {
+			t.Errorf("notes not nulled: %q", row[4])
+		}
+
+		// Faked values are stable, so they can still be joined and grouped on
+		again := query(t, gw, "analyst_2", "SELECT * FROM customers")
+		if !reflect.DeepEqual(rows, again) {
+			t.Errorf("masking is not deterministic: %v and %v", rows, again)
+		}
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		rows := query(t, gw, "admin", "SELECT * FROM customers")
+		want := [][]string{{"Ada", "ada@example.com", "4111111111111111", "555-0100", "vip"}}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("rows of an unmasked user changed to %v", rows)
+		}
+	})
+}
+
+// extendedQuery runs q with the extended protocol, describing the statement when describe is set
+func extendedQuery(t *testing.T, client *pgtest.Client, q string, describe bool) [][]string {
+	msgs := []pgproto.Message{&pgproto.Parse{Query: []byte(q)}}
+	if describe {
+		msgs = append(msgs, &pgproto.Describe{ObjectType: pgproto.ObjectTypePreparedStatement})
+	}
+	msgs = append(msgs, &pgproto.Bind{}, &pgproto.Execute{}, &pgproto.Sync{})
+	err := client.Send(msgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rows [][]string
+	for {
+		msg, err := client.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch m := msg.(type) {
+		case *pgproto.DataRow:
+			row := make([]string, len(m.Fields))
+			for i, field := range m.Fields {
+				if field == nil {
+					row[i] = "NULL"
+				} else {
+					row[i] = string(field)
+				}
+			}
+			rows = append(rows, row)
+		case *pgproto.Error:
+			t.Fatalf("query failed: %s", m.Message)
+		case *pgproto.ReadyForQuery:
+			return rows
+		}
+	}
+}
+
+func TestMaskingExtendedProtocol(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT name, card FROM customers", pgtest.Result{
+		Columns: []string{"name", "card"},
+		Rows:    [][]string{{"Ada", "4111111111111111"}},
+	})
+
+	gw := startGateway(t, srv, []interface{}{
+		map[string]interface{}{
+			"columns": []interface{}{map[string]interface{}{"name": "card", "action": "partial", "keep": 4}},
+		},
+	})
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	rows := extendedQuery(t, client, "SELECT name, card FROM customers", true)
+	if want := [][]string{{"Ada", "************1111"}}; !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, expected %v", rows, want)
+	}
+
+	// The statement was parsed again without being described, its rows can't be masked column by column
+	rows = extendedQuery(t, client, "SELECT name, card FROM customers", false)
+	if want := [][]string{{"NULL", "NULL"}}; !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, expected %v", rows, want)
+	}
+}
+
+func TestMaskingColumnIndex(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	// SELECT name, email AS contact, age FROM customers
+	srv.SetResult("SELECT * FROM aliased", pgtest.Result{
+		Columns:  []string{"name", "contact", "age"},
+		Types:    []int{25, 25, 23},
+		TableOID: 16384,
+		Rows:     [][]string{{"Ada", "ada@example.com", "36"}},
+	})
+
+	gw := startGateway(t, srv, []interface{}{
+		map[string]interface{}{
+			"columns": []interface{}{
+				map[string]interface{}{"table_oid": 16384, "column_index": 2, "action": "partial", "keep": 3},
+				map[string]interface{}{"name": "age", "action": "partial", "keep": 1},
+			},
+		},
+	})
+
+	rows := query(t, gw, "app", "SELECT * FROM aliased")
+	// Non-text columns are nulled whatever the action
+	if want := [][]string{{"Ada", "************com", ""}}; !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %v, expected %v", rows, want)
+	}
+}
+
+func TestMaskingRefusesCopy(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("COPY customers TO STDOUT", pgtest.Result{
+		Columns: []string{"name", "card"},
+		Rows:    [][]string{{"Ada", "4111111111111111"}},
+		Copy:    true,
+	})
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	gw := startGateway(t, srv, []interface{}{
+		map[string]interface{}{
+			"users":   []string{"analyst"},
+			"columns": []interface{}{map[string]interface{}{"name": "card", "action": "null"}},
+		},
+	})
+
+	client, err := pgtest.Connect(gw.Addr(), "analyst", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.Query("COPY customers TO STDOUT")
+	if err == nil || !strings.Contains(err.Error(), "COPY TO STDOUT is not allowed") {
+		t.Fatalf("expected COPY to be refused, got %v", err)
+	}
+	// The session goes on
+	rows, err := client.Query("SELECT 1")
+	if err != nil || !reflect.DeepEqual(rows, [][]string{{"1"}}) {
+		t.Fatalf("unexpected rows %v after a refused COPY: %v", rows, err)
+	}
+
+	// Users without masking rules may copy
+	other, err := pgtest.Connect(gw.Addr(), "admin", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	err = other.Send(&pgproto.SimpleQuery{Query: []byte("COPY customers TO STDOUT")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := other.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, ok := msg.(*pgproto.CopyData); ok && string(m.Data) != "Ada\t4111111111111111\n" {
+			t.Fatalf("unexpected copy data %q", m.Data)
+		}
+		if m, ok := msg.(*pgproto.Error); ok {
+			t.Fatalf("COPY failed: %s", m.Message)
+		}
+		if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+			break
+		}
+	}
+}
+
+func TestMaskingInvalidRules(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	tests := map[string]map[string]interface{}{
+		"unknown action": {"name": "card", "action": "scramble"},
+		"no column":      {"action": "null"},
+		"negative keep":  {"name": "card", "action": "partial", "keep": -1},
+	}
+	for name, column := range tests {
+		_, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+			Authentication: map[string]interface{}{
+				"passthrough": map[string]interface{}{
+					"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port()},
+				},
+			},
+			Responses: map[string]interface{}{"masking": []interface{}{
+				map[string]interface{}{"users": []string{"*"}, "columns": []interface{}{column}},
+			}},
+		})
+		if err == nil {
+			t.Errorf("%s: expected the rule to be refused", name)
+		}
+	}
+}
@@ -23,7 +23,7 @@ func (p *Passthrough) Authenticate(sess *pggateway.Session) (bool, error) {
 	if !pggateway.IsDatabaseAllowed(p.Target.Databases, sess.Database) {
 		return false, sess.WriteToClientEf("IsDatabaseAllowed returns False")
 	}
-	err := sess.DialToS(p.Target.Host, p.Target.Port)
+	err := sess.DialTarget(p.Target)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,86 @@
+package passthrough_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	_ "github.com/c653labs/pggateway/plugins/passthrough-authentication"
+)
+
+func startGateway(t *testing.T, srv *pgtest.Server, databases ...string) *pgtest.Gateway {
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{
+			"passthrough": map[string]interface{}{
+				"target": map[string]interface{}{
+					"host":      srv.Host(),
+					"port":      srv.Port(),
+					"databases": databases,
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gw
+}
+
+func TestPassthrough(t *testing.T) {
+	for _, method := range []string{pgtest.AuthTrust, pgtest.AuthPassword, pgtest.AuthMD5, pgtest.AuthSCRAMSHA256} {
+		t.Run(method, func(t *testing.T) {
+			srv, err := pgtest.NewServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			srv.AuthMethod = method
+			srv.Users["app"] = "secret"
+			srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+			gw := startGateway(t, srv)
+			defer gw.Close()
+
+			client, err := pgtest.Connect(gw.Addr(), "app", "secret", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			rows, err := client.Query("SELECT 1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 || rows[0][0] != "1" {
+				t.Fatalf("unexpected rows %v", rows)
+			}
+
+			if method == pgtest.AuthTrust {
+				return
+			}
+			_, err = pgtest.Connect(gw.Addr(), "app", "wrong", "app")
+			if err == nil || !strings.Contains(err.Error(), "password authentication failed") {
+				t.Fatalf("expected the target's authentication error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPassthroughDatabaseNotAllowed(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	gw := startGateway(t, srv, "app")
+	defer gw.Close()
+
+	_, err = pgtest.Connect(gw.Addr(), "app", "", "other")
+	if err == nil {
+		t.Fatal("connected to a database that is not allowed")
+	}
+	if queries := srv.Queries(); len(queries) != 0 {
+		t.Fatalf("target received queries %v", queries)
+	}
+}
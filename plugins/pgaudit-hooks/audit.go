@@ -0,0 +1,378 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pggateway"
+)
+
+const (
+	notLogged     = "<not logged>"
+	noParameters  = "<none>"
+	nullParameter = "<null>"
+	// Binary parameters are not decoded
+	binaryParameter = "<binary>"
+
+	defaultQueueSize = 1024
+)
+
+// Config
+type Config struct {
+	// Path of the audit file, "-" writes to stdout
+	Path string `json:"path"`
+	// Format is "csv", the default, or "csvlog"
+	Format string `json:"format"`
+	// Log lists the audited classes like pgaudit.log: read, write, function, role, ddl, misc, misc_set or all
+	Log []string `json:"log"`
+	// LogParameter adds the parameters of extended query statements to records, like pgaudit.log_parameter
+	LogParameter bool `json:"log_parameter"`
+	// QueueSize is the number of records queued for writing, sessions wait when it is full
+	QueueSize int `json:"queue_size"`
+}
+
+// Audit writes a pgaudit session audit record for every statement, from its own worker
+// so slow disks hold up sessions only once its queue is full
+type Audit struct {
+	format       string
+	classes      map[string]bool
+	logParameter bool
+	size         int
+
+	// mutex guards the statement IDs, a session's records are queued in their order
+	// as it sends its events one at a time
+	mutex sync.Mutex
+	// statements is the last statement ID of each session
+	statements map[string]int64
+
+	queueMutex sync.Mutex
+	cond       *sync.Cond
+	queue      [][]byte
+	closed     bool
+	done       chan struct{}
+
+	fileMutex sync.Mutex
+	path      string
+	out       io.Writer
+	file      *os.File
+	lastErr   error
+}
+
+func init() {
+	pggateway.RegisterSessionHookPlugin("pgaudit", newAuditPlugin)
+}
+
+func newAuditPlugin(config interface{}) (pggateway.SessionHookPlugin, error) {
+	c := Config{Path: "-", Format: "csv", QueueSize: defaultQueueSize}
+	if config != nil {
+		err := pggateway.FillStruct(config, &c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.Format != "csv" && c.Format != "csvlog" {
+		return nil, fmt.Errorf("unknown pgaudit format %#v, expected 'csv' or 'csvlog'", c.Format)
+	}
+	if c.QueueSize < 1 {
+		return nil, fmt.Errorf("pgaudit queue_size must be positive")
+	}
+
+	classes, err := parseClasses(c.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Audit{
+		format:       c.Format,
+		classes:      classes,
+		logParameter: c.LogParameter,
+		size:         c.QueueSize,
+		path:         c.Path,
+		out:          os.Stdout,
+		statements:   make(map[string]int64),
+		done:         make(chan struct{}),
+	}
+	a.cond = sync.NewCond(&a.queueMutex)
+	if c.Path != "-" {
+		err = a.open()
+		if err != nil {
+			return nil, err
+		}
+	}
+	go a.run()
+	return a, nil
+}
+
+func parseClasses(log []string) (map[string]bool, error) {
+	all := []string{ClassRead, ClassWrite, ClassFunction, ClassRole, ClassDDL, ClassMisc, ClassMiscSet}
+	if len(log) == 0 {
+		log = []string{"all"}
+	}
+
+	classes := make(map[string]bool)
+	for _, class := range log {
+		class = strings.ToUpper(class)
+		if class == "ALL" {
+			for _, c := range all {
+				classes[c] = true
+			}
+			continue
+		}
+		known := false
+		for _, c := range all {
+			known = known || c == class
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown pgaudit class %#v", strings.ToLower(class))
+		}
+		classes[class] = true
+	}
+	return classes, nil
+}
+
+func (a *Audit) open() error {
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	a.file = file
+	a.out = file
+	return nil
+}
+
+func (a *Audit) HandleSessionEvent(e *pggateway.SessionEvent) error {
+	switch e.Type {
+	case pggateway.SessionStatement:
+		return a.audit(e)
+	case pggateway.SessionClose:
+		a.mutex.Lock()
+		delete(a.statements, e.Session.ID)
+		a.mutex.Unlock()
+	}
+	return nil
+}
+
+func (a *Audit) audit(e *pggateway.SessionEvent) error {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	parameters := a.parameters(e)
+	statements := SplitStatements(e.Query)
+	// Only the statement IDs are taken under the mutex, push may wait for the worker
+	a.mutex.Lock()
+	id := a.statements[e.Session.ID]
+	a.statements[e.Session.ID] += int64(len(statements))
+	a.mutex.Unlock()
+
+	for _, text := range statements {
+		id++
+		statement := Classify(text)
+		if !a.classes[statement.Class] {
+			continue
+		}
+		w.Write(a.record(e, id, statement, parameters))
+	}
+	w.Flush()
+	if buf.Len() == 0 {
+		return nil
+	}
+	return a.push(buf.Bytes())
+}
+
+// parameters returns the parameters field of the records for e, the parameter values in CSV
+func (a *Audit) parameters(e *pggateway.SessionEvent) string {
+	if !a.logParameter {
+		return notLogged
+	}
+	if len(e.Parameters) == 0 {
+		return noParameters
+	}
+
+	values := make([]string, len(e.Parameters))
+	for i, value := range e.Parameters {
+		format := 0
+		if len(e.ParameterFormats) == 1 {
+			format = e.ParameterFormats[0]
+		} else if i < len(e.ParameterFormats) {
+			format = e.ParameterFormats[i]
+		}
+		switch {
+		case value == nil:
+			values[i] = nullParameter
+		case format != 0:
+			values[i] = binaryParameter
+		default:
+			values[i] = string(value)
+		}
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(values)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// push queues record for the worker, waiting while the queue is full
+func (a *Audit) push(record []byte) error {
+	a.queueMutex.Lock()
+	defer a.queueMutex.Unlock()
+	for len(a.queue) >= a.size && !a.closed {
+		a.cond.Wait()
+	}
+	if a.closed {
+		return fmt.Errorf("pgaudit plugin is closed")
+	}
+	a.queue = append(a.queue, record)
+	a.cond.Broadcast()
+	return nil
+}
+
+func (a *Audit) run() {
+	defer close(a.done)
+	for {
+		a.queueMutex.Lock()
+		for len(a.queue) == 0 && !a.closed {
+			a.cond.Wait()
+		}
+		if len(a.queue) == 0 {
+			a.queueMutex.Unlock()
+			return
+		}
+		batch := a.queue
+		a.queue = nil
+		a.cond.Broadcast()
+		a.queueMutex.Unlock()
+
+		var buf bytes.Buffer
+		for _, record := range batch {
+			buf.Write(record)
+		}
+		a.fileMutex.Lock()
+		_, a.lastErr = a.out.Write(buf.Bytes())
+		a.fileMutex.Unlock()
+	}
+}
+
+// Health reports the error of the last write, if it failed
+func (a *Audit) Health() error {
+	a.fileMutex.Lock()
+	defer a.fileMutex.Unlock()
+	return a.lastErr
+}
+
+// auditFields are the fields of a pgaudit session audit record
+func auditFields(id int64, statement Statement, parameters string) []string {
+	return []string{
+		"SESSION",
+		strconv.FormatInt(id, 10),
+		"1",
+		statement.Class,
+		statement.Command,
+		statement.ObjectType,
+		statement.ObjectName,
+		statement.Text,
+		parameters,
+	}
+}
+
+func (a *Audit) record(e *pggateway.SessionEvent, id int64, statement Statement, parameters string) []string {
+	var client string
+	if e.Session.ClientAddr != nil {
+		client = e.Session.ClientAddr.String()
+	}
+
+	if a.format == "csv" {
+		prefix := []string{
+			e.Time.UTC().Format(time.RFC3339Nano),
+			e.Session.ID,
+			e.Session.User,
+			e.Session.Database,
+			client,
+		}
+		return append(prefix, auditFields(id, statement, parameters)...)
+	}
+
+	// The message of a csvlog record is the pgaudit record, itself in CSV
+	var message bytes.Buffer
+	w := csv.NewWriter(&message)
+	w.Write(auditFields(id, statement, parameters))
+	w.Flush()
+
+	// The csvlog columns of PostgreSQL 14 and later
+	return []string{
+		e.Time.Format("2006-01-02 15:04:05.000 MST"),
+		e.Session.User,
+		e.Session.Database,
+		"",
+		client,
+		e.Session.ID,
+		strconv.FormatInt(id, 10),
+		statement.Command,
+		e.Session.Connected.Format("2006-01-02 15:04:05 MST"),
+		"",
+		"0",
+		"LOG",
+		"00000",
+		"AUDIT: " + strings.TrimSuffix(message.String(), "\n"),
+		"",
+		"",
+		"",
+		"",
+		"",
+		"",
+		"",
+		"",
+		e.Session.StartupParameters["application_name"],
+		"client backend",
+		"",
+		"0",
+	}
+}
+
+// Reopen reopens the audit file, e.g. after logrotate moved it
+func (a *Audit) Reopen() error {
+	a.fileMutex.Lock()
+	defer a.fileMutex.Unlock()
+	if a.file == nil {
+		return nil
+	}
+
+	old := a.file
+	err := a.open()
+	if err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+// Close writes the queued records and closes the audit file
+func (a *Audit) Close() error {
+	a.queueMutex.Lock()
+	if a.closed {
+		a.queueMutex.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.cond.Broadcast()
+	a.queueMutex.Unlock()
+	<-a.done
+
+	a.fileMutex.Lock()
+	defer a.fileMutex.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	a.out = ioutil.Discard
+	return err
+}
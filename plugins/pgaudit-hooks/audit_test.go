@@ -0,0 +1,169 @@
+package audit_test
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	_ "github.com/c653labs/pggateway/plugins/passthrough-authentication"
+	_ "github.com/c653labs/pggateway/plugins/pgaudit-hooks"
+	"github.com/c653labs/pgproto"
+)
+
+func TestAudit(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	srv.SetResult("INSERT INTO public.accounts VALUES (1)", pgtest.Result{Tag: "INSERT 0 1"})
+	srv.SetResult("CREATE TABLE notes (body text)", pgtest.Result{Tag: "CREATE TABLE"})
+
+	path := filepath.Join(t.TempDir(), "audit.csv")
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{
+			"passthrough": map[string]interface{}{
+				"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port()},
+			},
+		},
+		Hooks: map[string]interface{}{
+			"pgaudit": map[string]interface{}{"path": path, "log": []string{"write", "ddl"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"SELECT 1", "INSERT INTO public.accounts VALUES (1)", "CREATE TABLE notes (body text)"} {
+		_, err = client.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+	// Closing the gateway closes the audit file
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected the write and ddl statements to be audited, got %v", records)
+	}
+	for _, record := range records {
+		if record[2] != "app" || record[3] != "app" {
+			t.Errorf("record of the wrong session: %v", record)
+		}
+	}
+
+	// The statement IDs count the statements that were not audited too
+	want := [][]string{
+		{"SESSION", "2", "1", "WRITE", "INSERT", "TABLE", "public.accounts", "INSERT INTO public.accounts VALUES (1)", "<not logged>"},
+		{"SESSION", "3", "1", "DDL", "CREATE TABLE", "TABLE", "notes", "CREATE TABLE notes (body text)", "<not logged>"},
+	}
+	for i, record := range records {
+		if !reflect.DeepEqual(record[5:], want[i]) {
+			t.Errorf("unexpected audit record %v, expected %v", record[5:], want[i])
+		}
+	}
+}
+
+func TestAuditParameters(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	q := "INSERT INTO accounts VALUES ($1, $2)"
+	srv.SetResult(q, pgtest.Result{Tag: "INSERT 0 1"})
+	srv.SetResult("DELETE FROM accounts", pgtest.Result{Tag: "DELETE 2"})
+
+	path := filepath.Join(t.TempDir(), "audit.csv")
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{
+			"passthrough": map[string]interface{}{
+				"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port()},
+			},
+		},
+		Hooks: map[string]interface{}{
+			"pgaudit": map[string]interface{}{"path": path, "log_parameter": true, "queue_size": 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The prepared statement is audited every time it runs, with its parameters
+	err = client.Send(
+		&pgproto.Parse{Name: []byte("insert"), Query: []byte(q)},
+		&pgproto.Bind{Statement: []byte("insert"), Parameters: [][]byte{[]byte("1"), []byte("Ada, Countess")}},
+		&pgproto.Execute{},
+		&pgproto.Bind{Statement: []byte("insert"), Parameters: [][]byte{[]byte("2"), nil}},
+		&pgproto.Execute{},
+		&pgproto.Bind{Statement: []byte("insert"), ParameterFormats: []int{1}, Parameters: [][]byte{{0, 0, 0, 3}, []byte("x")}},
+		&pgproto.Execute{},
+		&pgproto.Sync{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := client.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := msg.(*pgproto.ReadyForQuery); ok {
+			break
+		}
+	}
+	_, err = client.Query("DELETE FROM accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	// Closing the gateway writes the queued records
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parameters []string
+	for _, record := range records {
+		parameters = append(parameters, record[len(record)-1])
+	}
+	want := []string{`1,"Ada, Countess"`, "2,<null>", "<binary>,<binary>", "<none>"}
+	if !reflect.DeepEqual(parameters, want) {
+		t.Fatalf("unexpected parameters %q, expected %q", parameters, want)
+	}
+}
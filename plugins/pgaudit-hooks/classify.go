@@ -0,0 +1,344 @@
+package audit
+
+import (
+	"strings"
+
+	"github.com/c653labs/pggateway"
+)
+
+// Statement classes, as logged by pgaudit
+const (
+	ClassRead     = "READ"
+	ClassWrite    = "WRITE"
+	ClassFunction = "FUNCTION"
+	ClassRole     = "ROLE"
+	ClassDDL      = "DDL"
+	ClassMisc     = "MISC"
+	ClassMiscSet  = "MISC_SET"
+)
+
+// Statement is a single statement of a query, classified the way pgaudit would
+type Statement struct {
+	Class      string
+	Command    string
+	ObjectType string
+	ObjectName string
+	Text       string
+}
+
+// Object types of CREATE, ALTER and DROP statements, longest first
+var objectTypes = [][]string{
+	{"FOREIGN", "DATA", "WRAPPER"},
+	{"TEXT", "SEARCH", "CONFIGURATION"},
+	{"TEXT", "SEARCH", "DICTIONARY"},
+	{"TEXT", "SEARCH", "PARSER"},
+	{"TEXT", "SEARCH", "TEMPLATE"},
+	{"MATERIALIZED", "VIEW"},
+	{"FOREIGN", "TABLE"},
+	{"EVENT", "TRIGGER"},
+	{"USER", "MAPPING"},
+	{"ACCESS", "METHOD"},
+	{"OPERATOR", "CLASS"},
+	{"OPERATOR", "FAMILY"},
+	{"DEFAULT", "PRIVILEGES"},
+	{"AGGREGATE"},
+	{"CAST"},
+	{"COLLATION"},
+	{"CONVERSION"},
+	{"DATABASE"},
+	{"DOMAIN"},
+	{"EXTENSION"},
+	{"FUNCTION"},
+	{"GROUP"},
+	{"INDEX"},
+	{"LANGUAGE"},
+	{"OPERATOR"},
+	{"POLICY"},
+	{"PROCEDURE"},
+	{"PUBLICATION"},
+	{"ROLE"},
+	{"ROUTINE"},
+	{"RULE"},
+	{"SCHEMA"},
+	{"SEQUENCE"},
+	{"SERVER"},
+	{"STATISTICS"},
+	{"SUBSCRIPTION"},
+	{"TABLE"},
+	{"TABLESPACE"},
+	{"TRIGGER"},
+	{"TYPE"},
+	{"USER"},
+	{"VIEW"},
+}
+
+// Modifiers between CREATE and the object type, e.g. CREATE OR REPLACE TEMPORARY VIEW
+var createModifiers = map[string]bool{
+	"OR":         true,
+	"REPLACE":    true,
+	"TEMP":       true,
+	"TEMPORARY":  true,
+	"UNLOGGED":   true,
+	"UNIQUE":     true,
+	"GLOBAL":     true,
+	"LOCAL":      true,
+	"RECURSIVE":  true,
+	"TRUSTED":    true,
+	"PROCEDURAL": true,
+	"CONSTRAINT": true,
+}
+
+// Keywords between the object type and its name
+var nameModifiers = map[string]bool{
+	"IF":           true,
+	"NOT":          true,
+	"EXISTS":       true,
+	"CONCURRENTLY": true,
+	"ONLY":         true,
+}
+
+// Command tags of the other DDL statements
+var ddlCommands = map[string]string{
+	"COMMENT":  "COMMENT",
+	"SECURITY": "SECURITY LABEL",
+	"IMPORT":   "IMPORT FOREIGN SCHEMA",
+	"REFRESH":  "REFRESH MATERIALIZED VIEW",
+}
+
+// token is a keyword, identifier or punctuation of a statement; strings and comments are skipped
+type token struct {
+	text string
+	// word is set for keywords and unquoted identifiers, text is then upper case
+	word bool
+	// depth is the number of parentheses the token is in
+	depth int
+}
+
+// SplitStatements splits a query into its statements, ignoring semicolons in strings and comments
+func SplitStatements(query string) []string {
+	var statements []string
+	var statement strings.Builder
+	for _, t := range pggateway.Tokenize(query) {
+		if t.Kind == pggateway.TokenPunctuation && t.Text == ";" {
+			statements = appendStatement(statements, statement.String())
+			statement.Reset()
+			continue
+		}
+		statement.WriteString(t.Text)
+	}
+	return appendStatement(statements, statement.String())
+}
+
+func appendStatement(statements []string, statement string) []string {
+	statement = strings.TrimSpace(statement)
+	if len(tokenize(statement)) == 0 {
+		return statements
+	}
+	return append(statements, statement)
+}
+
+// tokenize returns the tokens of statement without its literals, whitespace and comments
+func tokenize(statement string) []token {
+	var tokens []token
+	depth := 0
+	for _, t := range pggateway.Tokenize(statement) {
+		switch t.Kind {
+		case pggateway.TokenSpace, pggateway.TokenComment, pggateway.TokenString:
+		case pggateway.TokenWord, pggateway.TokenNumber:
+			tokens = append(tokens, token{text: strings.ToUpper(t.Text), word: true, depth: depth})
+		case pggateway.TokenPunctuation:
+			if t.Text == ")" && depth > 0 {
+				depth--
+			}
+			tokens = append(tokens, token{text: t.Text, depth: depth})
+			if t.Text == "(" {
+				depth++
+			}
+		default:
+			tokens = append(tokens, token{text: t.Text, depth: depth})
+		}
+	}
+	return tokens
+}
+
+// Classify classifies a single statement, anything not read, written, DDL, role or function related is MISC
+func Classify(statement string) Statement {
+	s := Statement{Class: ClassMisc, Text: statement}
+	tokens := tokenize(statement)
+	if len(tokens) == 0 {
+		return s
+	}
+
+	keyword := tokens[0].text
+	if keyword == "(" {
+		// Parenthesized selects, e.g. (SELECT 1) UNION (SELECT 2)
+		keyword = "SELECT"
+	}
+	if keyword == "WITH" {
+		keyword = mainCommand(tokens)
+	}
+
+	s.Command = keyword
+	switch keyword {
+	case "SELECT", "VALUES", "TABLE":
+		s.Class = ClassRead
+		s.Command = "SELECT"
+		s.setRelation(tokens, "FROM")
+		if tokens[0].text == "TABLE" && len(tokens) > 1 {
+			s.ObjectType, s.ObjectName = "TABLE", qualifiedName(tokens[1:])
+		}
+	case "INSERT", "MERGE":
+		s.Class = ClassWrite
+		s.setRelation(tokens, "INTO")
+	case "UPDATE":
+		s.Class = ClassWrite
+		s.setRelation(tokens, "UPDATE")
+	case "DELETE":
+		s.Class = ClassWrite
+		s.setRelation(tokens, "FROM")
+	case "TRUNCATE":
+		s.Class = ClassWrite
+		s.setRelation(tokens, "TRUNCATE")
+	case "COPY":
+		s.Class = ClassRead
+		for _, t := range tokens[1:] {
+			if t.depth == 0 && t.word && t.text == "FROM" {
+				s.Class = ClassWrite
+				break
+			}
+		}
+		if len(tokens) > 1 && tokens[1].text != "(" {
+			s.ObjectType, s.ObjectName = "TABLE", qualifiedName(tokens[1:])
+		}
+	case "DO", "CALL":
+		s.Class = ClassFunction
+	case "GRANT", "REVOKE":
+		s.Class = ClassRole
+	case "SET", "RESET":
+		s.Class = ClassMiscSet
+	case "CREATE", "ALTER", "DROP":
+		s.ddl(tokens)
+	case "COMMENT", "SECURITY", "IMPORT", "REFRESH":
+		s.Class = ClassDDL
+		s.Command = ddlCommands[keyword]
+	case "START":
+		s.Command = "START TRANSACTION"
+	}
+	return s
+}
+
+// mainCommand is the command of a WITH statement, after its common table expressions
+func mainCommand(tokens []token) string {
+	for _, t := range tokens[1:] {
+		if t.depth != 0 || !t.word {
+			continue
+		}
+		switch t.text {
+		case "SELECT", "INSERT", "UPDATE", "DELETE", "MERGE", "VALUES", "TABLE":
+			return t.text
+		}
+	}
+	return "SELECT"
+}
+
+// setRelation sets the relation named after the first top level keyword, if any
+func (s *Statement) setRelation(tokens []token, keyword string) {
+	for i, t := range tokens {
+		if t.depth != 0 || !t.word || t.text != keyword {
+			continue
+		}
+		rest := tokens[i+1:]
+		for len(rest) > 0 && rest[0].word && (rest[0].text == "ONLY" || rest[0].text == "TABLE" || rest[0].text == "INTO") {
+			rest = rest[1:]
+		}
+		if name := qualifiedName(rest); name != "" {
+			s.ObjectType, s.ObjectName = "TABLE", name
+		}
+		return
+	}
+}
+
+// ddl classifies CREATE, ALTER and DROP statements
+func (s *Statement) ddl(tokens []token) {
+	s.Class = ClassDDL
+	rest := tokens[1:]
+	for len(rest) > 0 && rest[0].word && createModifiers[rest[0].text] {
+		rest = rest[1:]
+	}
+
+	var objectType []string
+	for _, candidate := range objectTypes {
+		if hasWords(rest, candidate) {
+			objectType = candidate
+			rest = rest[len(candidate):]
+			break
+		}
+	}
+	if objectType == nil {
+		s.Command = commandWords(tokens, 2)
+		return
+	}
+
+	s.ObjectType = strings.Join(objectType, " ")
+	s.Command = s.Command + " " + s.ObjectType
+	switch s.ObjectType {
+	case "ROLE", "USER", "GROUP", "DEFAULT PRIVILEGES":
+		// Like GRANT and REVOKE, role statements are logged without an object
+		s.Class = ClassRole
+		s.ObjectType = ""
+		return
+	}
+	for len(rest) > 0 && rest[0].word && nameModifiers[rest[0].text] {
+		rest = rest[1:]
+	}
+	// CREATE INDEX ON table has no index name
+	if len(rest) > 0 && rest[0].word && rest[0].text == "ON" && s.ObjectType == "INDEX" {
+		return
+	}
+	s.ObjectName = qualifiedName(rest)
+}
+
+func hasWords(tokens []token, words []string) bool {
+	if len(tokens) < len(words) {
+		return false
+	}
+	for i, word := range words {
+		if !tokens[i].word || tokens[i].text != word {
+			return false
+		}
+	}
+	return true
+}
+
+// commandWords joins up to n leading keywords of tokens
+func commandWords(tokens []token, n int) string {
+	var words []string
+	for _, t := range tokens {
+		if !t.word || len(words) == n {
+			break
+		}
+		words = append(words, t.text)
+	}
+	return strings.Join(words, " ")
+}
+
+// qualifiedName is the possibly schema qualified name at the start of tokens,
+// unquoted identifiers are folded to lower case the way PostgreSQL does
+func qualifiedName(tokens []token) string {
+	var parts []string
+	for i := 0; i < len(tokens); i += 2 {
+		t := tokens[i]
+		switch {
+		case t.word:
+			parts = append(parts, strings.ToLower(t.text))
+		case strings.HasPrefix(t.text, `"`):
+			parts = append(parts, t.text)
+		default:
+			return strings.Join(parts, ".")
+		}
+		if i+1 >= len(tokens) || tokens[i+1].text != "." {
+			break
+		}
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,368 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c653labs/pggateway"
+)
+
+func init() {
+	pggateway.RegisterLoggingPlugin("syslog", newLoggingPlugin)
+}
+
+type severity int
+
+// Syslog severities, RFC 5424 section 6.2.1
+const (
+	SeverityCritical severity = 2
+	SeverityError    severity = 3
+	SeverityWarning  severity = 4
+	SeverityInfo     severity = 6
+	SeverityDebug    severity = 7
+)
+
+var levels = map[string]severity{
+	"fatal": SeverityCritical,
+	"error": SeverityError,
+	"warn":  SeverityWarning,
+	"info":  SeverityInfo,
+	"debug": SeverityDebug,
+}
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Framing of messages on stream transports, RFC 6587 section 3.4
+const (
+	FramingOctetCounting = "octet-counting"
+	FramingLF            = "lf"
+)
+
+const defaultWriteTimeout = 5 * time.Second
+
+type LoggingPlugin struct {
+	network   string
+	address   string
+	framing   string
+	tlsConfig *tls.Config
+	// writeTimeout bounds writes to stream sockets, so a stalled endpoint can't hold up logging
+	writeTimeout time.Duration
+
+	facility int
+	level    int32
+	hostname string
+	appName  string
+	procID   string
+	sdID     string
+
+	mutex    sync.Mutex
+	conn     net.Conn
+	datagram bool
+	lastErr  error
+	// closed is set by Close, writes are refused from then on instead of reconnecting
+	closed bool
+}
+
+var errClosed = errors.New("syslog logger is closed")
+
+func newLoggingPlugin(config pggateway.ConfigMap) (pggateway.LoggingPlugin, error) {
+	l := &LoggingPlugin{
+		network: strings.ToLower(config.StringDefault("network", "unix")),
+		appName: config.StringDefault("app_name", "pggateway"),
+		sdID:    config.StringDefault("sd_id", "pggateway@32473"),
+		procID:  strconv.Itoa(os.Getpid()),
+
+		writeTimeout: config.DurationDefault("write_timeout", defaultWriteTimeout),
+	}
+
+	level, err := parseLevel(config)
+	if err != nil {
+		return nil, err
+	}
+	l.level = int32(level)
+
+	var ok bool
+
+	facility := strings.ToLower(config.StringDefault("facility", "local0"))
+	if l.facility, ok = facilities[facility]; !ok {
+		return nil, fmt.Errorf("unknown syslog facility: %#v", facility)
+	}
+
+	switch l.network {
+	case "unix":
+		l.address = config.StringDefault("address", "/dev/log")
+	case "udp", "tcp", "tls":
+		if l.address, ok = config.String("address"); !ok {
+			return nil, fmt.Errorf("must supply 'address' parameter for %s syslog", l.network)
+		}
+	default:
+		return nil, fmt.Errorf("unknown syslog network %#v, expected 'unix', 'udp', 'tcp' or 'tls'", l.network)
+	}
+
+	// Local daemons listening on a stream socket expect one message per line
+	framing := FramingOctetCounting
+	if l.network == "unix" {
+		framing = FramingLF
+	}
+	l.framing = strings.ToLower(config.StringDefault("framing", framing))
+	if l.framing != FramingOctetCounting && l.framing != FramingLF {
+		return nil, fmt.Errorf("unknown syslog framing %#v, expected 'octet-counting' or 'lf'", l.framing)
+	}
+
+	if l.network == "tls" {
+		host, _, err := net.SplitHostPort(l.address)
+		if err != nil {
+			return nil, err
+		}
+		l.tlsConfig = &tls.Config{ServerName: host}
+		if ca, ok := config.String("ca"); ok {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			l.tlsConfig.RootCAs = x509.NewCertPool()
+			if !l.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", ca)
+			}
+		}
+	}
+
+	l.hostname = config.StringDefault("hostname", "")
+	if l.hostname == "" {
+		l.hostname, _ = os.Hostname()
+	}
+
+	// Fail at startup rather than with the first message when the endpoint is unreachable
+	err = l.connect()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func parseLevel(config pggateway.ConfigMap) (severity, error) {
+	level := strings.ToLower(config.StringDefault("level", "warn"))
+	sev, ok := levels[level]
+	if !ok {
+		return 0, fmt.Errorf("unknown logging level: %#v", level)
+	}
+	return sev, nil
+}
+
+// Reload applies a new level, other changes require a restart
+func (l *LoggingPlugin) Reload(config interface{}) error {
+	c, _ := config.(pggateway.ConfigMap)
+	level, err := parseLevel(c)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&l.level, int32(level))
+	return nil
+}
+
+// Health reports the error of the last write, if it failed
+func (l *LoggingPlugin) Health() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.lastErr
+}
+
+func (l *LoggingPlugin) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
+}
+
+func (l *LoggingPlugin) connect() error {
+	var err error
+	switch l.network {
+	case "unix":
+		// syslog daemons usually listen on a datagram socket, but some use a stream one
+		l.conn, err = net.Dial("unixgram", l.address)
+		l.datagram = err == nil
+		if err != nil {
+			l.conn, err = net.Dial("unix", l.address)
+		}
+	case "tls":
+		l.conn, err = tls.Dial("tcp", l.address, l.tlsConfig)
+	default:
+		l.conn, err = net.Dial(l.network, l.address)
+		l.datagram = l.network == "udp"
+	}
+	return err
+}
+
+// framed returns msg as it is written to the connection, with octet counting (RFC 6587, RFC 5425)
+// or LF framing for stream transports
+func (l *LoggingPlugin) framed(msg []byte) []byte {
+	if l.datagram {
+		return msg
+	}
+	if l.framing == FramingLF {
+		// A line break would end the message early
+		return append(bytes.ReplaceAll(msg, []byte("\n"), []byte(" ")), '\n')
+	}
+	return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+}
+
+func (l *LoggingPlugin) write(msg []byte) (err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	defer func() { l.lastErr = err }()
+	if l.closed {
+		return errClosed
+	}
+
+	// Reconnect once when the daemon was restarted or the connection dropped
+	for attempt := 0; attempt < 2; attempt++ {
+		if l.conn == nil {
+			err = l.connect()
+			if err != nil {
+				continue
+			}
+		}
+		if !l.datagram && l.writeTimeout > 0 {
+			l.conn.SetWriteDeadline(time.Now().Add(l.writeTimeout))
+		}
+		_, err = l.conn.Write(l.framed(msg))
+		if err == nil {
+			return nil
+		}
+		l.conn.Close()
+		l.conn = nil
+	}
+	return err
+}
+
+// format builds an RFC 5424 message
+func (l *LoggingPlugin) format(sev severity, context pggateway.LoggingContext, msg string, args ...interface{}) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s - ",
+		l.facility*8+int(sev),
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerField(l.hostname, 255),
+		headerField(l.appName, 48),
+		headerField(l.procID, 128),
+	)
+	b.WriteString(l.structuredData(context))
+	b.WriteByte(' ')
+	b.WriteString(fmt.Sprintf(msg, args...))
+	return []byte(b.String())
+}
+
+// structuredData returns context as a single SD-ELEMENT, with parameters sorted by name
+func (l *LoggingPlugin) structuredData(context pggateway.LoggingContext) string {
+	if len(context) == 0 {
+		return "-"
+	}
+
+	names := make([]string, 0, len(context))
+	for name := range context {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("[" + l.sdID)
+	for _, name := range names {
+		var value string
+		switch v := context[name].(type) {
+		case string:
+			value = v
+		case fmt.Stringer:
+			value = v.String()
+		case map[string]interface{}, []interface{}:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			value = string(encoded)
+		default:
+			value = fmt.Sprint(v)
+		}
+		fmt.Fprintf(&b, ` %s="%s"`, paramName(name), paramValueEscaper.Replace(value))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// paramValueEscaper escapes PARAM-VALUE, RFC 5424 section 6.3.3
+var paramValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// paramName drops the characters not allowed in SD-NAME, RFC 5424 section 6.3.3
+func paramName(name string) string {
+	var b strings.Builder
+	for _, ch := range name {
+		if ch > 32 && ch < 127 && ch != '=' && ch != ']' && ch != '"' && b.Len() < 32 {
+			b.WriteRune(ch)
+		}
+	}
+	return b.String()
+}
+
+// headerField replaces the characters not allowed in header fields and truncates to max
+func headerField(value string, max int) string {
+	var b strings.Builder
+	for _, ch := range value {
+		if ch > 32 && ch < 127 && b.Len() < max {
+			b.WriteRune(ch)
+		}
+	}
+	if b.Len() == 0 {
+		return "-"
+	}
+	return b.String()
+}
+
+func (l *LoggingPlugin) log(sev severity, context pggateway.LoggingContext, msg string, args ...interface{}) {
+	if int32(sev) > atomic.LoadInt32(&l.level) {
+		return
+	}
+	err := l.write(l.format(sev, context, msg, args...))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing to syslog %s: %s\n", l.address, err)
+	}
+}
+
+func (l *LoggingPlugin) LogInfo(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	l.log(SeverityInfo, context, msg, args...)
+}
+
+func (l *LoggingPlugin) LogError(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	l.log(SeverityError, context, msg, args...)
+}
+
+func (l *LoggingPlugin) LogDebug(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	l.log(SeverityDebug, context, msg, args...)
+}
+
+func (l *LoggingPlugin) LogFatal(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	l.log(SeverityCritical, context, msg, args...)
+}
+
+func (l *LoggingPlugin) LogWarn(context pggateway.LoggingContext, msg string, args ...interface{}) {
+	l.log(SeverityWarning, context, msg, args...)
+}
@@ -0,0 +1,242 @@
+package logging_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	_ "github.com/c653labs/pggateway/plugins/passthrough-authentication"
+	_ "github.com/c653labs/pggateway/plugins/syslog-logging"
+)
+
+// collector is a syslog daemon reading octet counted or LF framed messages from a stream socket
+type collector struct {
+	l        net.Listener
+	lines    bool
+	mutex    sync.Mutex
+	messages []string
+	wg       sync.WaitGroup
+}
+
+func newCollector(t *testing.T, network string, address string, lines bool) *collector {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &collector{l: l, lines: lines}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.wg.Add(1)
+			go func() {
+				defer c.wg.Done()
+				defer conn.Close()
+				c.read(conn)
+			}()
+		}
+	}()
+	return c
+}
+
+func (c *collector) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for c.lines {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		c.mutex.Lock()
+		c.messages = append(c.messages, strings.TrimSuffix(line, "\n"))
+		c.mutex.Unlock()
+	}
+	for {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			return
+		}
+		msg := make([]byte, n)
+		_, err = io.ReadFull(r, msg)
+		if err != nil {
+			return
+		}
+		c.mutex.Lock()
+		c.messages = append(c.messages, string(msg))
+		c.mutex.Unlock()
+	}
+}
+
+func (c *collector) close() []string {
+	c.l.Close()
+	c.wg.Wait()
+	return c.messages
+}
+
+func TestSyslogLogging(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	socket := filepath.Join(t.TempDir(), "log")
+	tests := []struct {
+		name    string
+		network string
+		address string
+		framing string
+		lines   bool
+	}{
+		{name: "tcp", network: "tcp", address: "127.0.0.1:0"},
+		{name: "tcp lf", network: "tcp", address: "127.0.0.1:0", framing: "lf", lines: true},
+		{name: "unix stream", network: "unix", address: socket, lines: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newCollector(t, test.network, test.address, test.lines)
+			config := pggateway.ConfigMap{"network": test.network, "address": c.l.Addr().String(), "level": "info", "hostname": "gateway"}
+			if test.framing != "" {
+				config["framing"] = test.framing
+			}
+			gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+				Authentication: map[string]interface{}{
+					"passthrough": map[string]interface{}{
+						"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port()},
+					},
+				},
+				Logging: map[string]pggateway.ConfigMap{"syslog": config},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Close()
+			// Closing the gateway delivers the queued messages and closes the connection
+			err = gw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var found bool
+			for _, msg := range c.close() {
+				if !strings.HasSuffix(msg, "] new client session") {
+					continue
+				}
+				// local0.info is priority 16*8+6
+				if !strings.HasPrefix(msg, "<134>1 ") || !strings.Contains(msg, " gateway pggateway ") {
+					t.Errorf("unexpected syslog header %q", msg)
+				}
+				found = strings.Contains(msg, `user="app"`) && strings.Contains(msg, `database="app"`)
+			}
+			if !found {
+				t.Fatal("no new client session message with the session's structured data")
+			}
+		})
+	}
+}
+
+func TestSyslogClose(t *testing.T) {
+	c := newCollector(t, "tcp", "127.0.0.1:0", false)
+	p, err := pggateway.NewLoggingPlugin("syslog", pggateway.ConfigMap{"network": "tcp", "address": c.l.Addr().String(), "level": "info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.LogInfo(nil, "before close")
+	err = p.(pggateway.PluginCloser).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries logged after Close don't open a new connection
+	p.LogInfo(nil, "after close")
+	if err := p.(pggateway.PluginHealthChecker).Health(); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Fatalf("expected writes to be refused once closed, got %v", err)
+	}
+	messages := c.close()
+	if len(messages) != 1 || !strings.HasSuffix(messages[0], " before close") {
+		t.Fatalf("unexpected messages %q", messages)
+	}
+}
+
+func TestSyslogWriteTimeout(t *testing.T) {
+	// An endpoint that accepts connections but never reads from them
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var conns []net.Conn
+	var mutex sync.Mutex
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, conn)
+			mutex.Unlock()
+		}
+	}()
+	p, err := pggateway.NewLoggingPlugin("syslog", pggateway.ConfigMap{
+		"network":       "tcp",
+		"address":       l.Addr().String(),
+		"level":         "info",
+		"write_timeout": "50ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// Unblock writes first, should they not time out
+		mutex.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mutex.Unlock()
+		p.(pggateway.PluginCloser).Close()
+	}()
+
+	// Once the socket buffers are full writes time out instead of blocking, and the connection is replaced
+	msg := strings.Repeat("x", 64*1024)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		done := make(chan struct{})
+		go func() {
+			p.LogInfo(nil, "%s", msg)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("write to a stalled endpoint blocked")
+		}
+		mutex.Lock()
+		reconnected := len(conns) > 1
+		mutex.Unlock()
+		if reconnected {
+			return
+		}
+	}
+	t.Fatal("writes to a stalled endpoint never timed out")
+}
@@ -58,7 +58,7 @@ func (p *VirtualuserAuthentications) Authenticate(sess *pggateway.Session) (bool
 	if err != nil {
 		return false, err
 	}
-	err = sess.DialToS(vuauth.Target.Host, vuauth.Target.Port)
+	err = sess.DialTarget(vuauth.Target)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,104 @@
+package virtualuser_authentication_test
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	_ "github.com/c653labs/pggateway/plugins/virtualuser-authentication"
+	"github.com/xdg/scram"
+)
+
+// scramVerifier is the rolpassword PostgreSQL stores for a SCRAM-SHA-256 password
+func scramVerifier(t *testing.T, user string, password string) string {
+	client, err := scram.SHA256.NewClient(user, password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kf := scram.KeyFactors{Salt: "0123456789abcdef", Iters: 4096}
+	creds := client.GetStoredCredentials(kf)
+	enc := base64.StdEncoding
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", kf.Iters, enc.EncodeToString([]byte(kf.Salt)),
+		enc.EncodeToString(creds.StoredKey), enc.EncodeToString(creds.ServerKey))
+}
+
+func md5Verifier(user string, password string) string {
+	sum := md5.Sum([]byte(password + user))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+func TestVirtualUser(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.AuthMethod = pgtest.AuthMD5
+	srv.Users["app"] = "secret"
+	srv.SetResult("SELECT current_user", pgtest.Result{Columns: []string{"current_user"}, Rows: [][]string{{"app"}}})
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{
+			"virtualuser-authentication": []interface{}{
+				map[string]interface{}{
+					"name": "app",
+					"target": map[string]interface{}{
+						"host":      srv.Host(),
+						"port":      srv.Port(),
+						"user":      "app",
+						"password":  "secret",
+						"databases": []string{"app"},
+					},
+					"users": map[string]interface{}{
+						"plain": "plain-password",
+						"md5":   md5Verifier("md5", "md5-password"),
+						"scram": scramVerifier(t, "scram", "scram-password"),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	for _, user := range []string{"plain", "md5", "scram"} {
+		t.Run(user, func(t *testing.T) {
+			client, err := pgtest.Connect(gw.Addr(), user, user+"-password", "app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			rows, err := client.Query("SELECT current_user")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 || rows[0][0] != "app" {
+				t.Fatalf("unexpected rows %v", rows)
+			}
+
+			_, err = pgtest.Connect(gw.Addr(), user, "wrong", "app")
+			if err == nil {
+				t.Fatal("connected with a wrong password")
+			}
+		})
+	}
+
+	t.Run("unknown user", func(t *testing.T) {
+		_, err := pgtest.Connect(gw.Addr(), "nobody", "", "app")
+		if err == nil {
+			t.Fatal("connected as an unknown user")
+		}
+	})
+	t.Run("database not allowed", func(t *testing.T) {
+		_, err := pgtest.Connect(gw.Addr(), "plain", "plain-password", "other")
+		if err == nil {
+			t.Fatal("connected to a database that is not allowed")
+		}
+	})
+}
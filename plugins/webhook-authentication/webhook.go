@@ -0,0 +1,366 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pgproto"
+)
+
+const (
+	defaultTimeout         = 5 * time.Second
+	defaultMaxCacheEntries = 10000
+)
+
+// SQLSTATEs sent to denied clients
+const (
+	codeInvalidAuthorization = "28000"
+	codeInvalidPassword      = "28P01"
+)
+
+// Config
+type Config struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Timeout of each request, default 5s; requests timing out deny access
+	Timeout string `json:"timeout"`
+	// CacheTTL is how long decisions are reused for the same request, caching is disabled when empty
+	CacheTTL        string `json:"cache_ttl"`
+	MaxCacheEntries int    `json:"max_cache_entries"`
+	// CA verifies the endpoint's certificate instead of the system roots
+	CA string `json:"ca"`
+	// AllowInsecure accepts clients not using SSL, whose passwords are then sent in the clear
+	AllowInsecure bool `json:"allow_insecure"`
+	// Target is the default target, the endpoint's response overrides it
+	Target pggateway.TargetConfig `json:"target"`
+}
+
+// Request is the body POSTed to the endpoint for every session
+type Request struct {
+	User              string            `json:"user"`
+	Password          string            `json:"password"`
+	Database          string            `json:"database"`
+	ClientAddress     string            `json:"client_address"`
+	SSL               bool              `json:"ssl"`
+	ServerName        string            `json:"server_name,omitempty"`
+	ClientCertificate *Certificate      `json:"client_certificate,omitempty"`
+	StartupParameters map[string]string `json:"startup_parameters"`
+}
+
+// Certificate describes the verified certificate the client presented
+type Certificate struct {
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serial_number"`
+	FingerprintSHA256 string    `json:"fingerprint_sha256"`
+	DNSNames          []string  `json:"dns_names,omitempty"`
+	EmailAddresses    []string  `json:"email_addresses,omitempty"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+}
+
+// Response is the endpoint's decision
+type Response struct {
+	Allow bool `json:"allow"`
+	// Reason is returned to denied clients
+	Reason string  `json:"reason"`
+	Target *Target `json:"target"`
+}
+
+// Target overrides the fields of the default target that are set,
+// the client's user and password are used when neither sets them
+type Target struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+type cacheEntry struct {
+	response Response
+	expires  time.Time
+}
+
+// Webhook authorizes sessions with an HTTP endpoint
+type Webhook struct {
+	config          Config
+	client          *http.Client
+	timeout         time.Duration
+	cacheTTL        time.Duration
+	maxCacheEntries int
+
+	mutex sync.Mutex
+	cache map[string]cacheEntry
+}
+
+func init() {
+	pggateway.RegisterAuthPlugin("webhook", newWebhookPlugin)
+}
+
+func newWebhookPlugin(config interface{}) (pggateway.AuthenticationPlugin, error) {
+	p := &Webhook{
+		timeout:         defaultTimeout,
+		maxCacheEntries: defaultMaxCacheEntries,
+		cache:           make(map[string]cacheEntry),
+	}
+	err := pggateway.FillStruct(config, &p.config)
+	if err != nil {
+		return nil, err
+	}
+	if p.config.URL == "" {
+		return nil, fmt.Errorf("webhook authentication requires a url")
+	}
+
+	if p.config.Timeout != "" {
+		p.timeout, err = time.ParseDuration(p.config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook timeout: %s", err)
+		}
+	}
+	if p.config.CacheTTL != "" {
+		p.cacheTTL, err = time.ParseDuration(p.config.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook cache_ttl: %s", err)
+		}
+	}
+	if p.config.MaxCacheEntries > 0 {
+		p.maxCacheEntries = p.config.MaxCacheEntries
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if p.config.CA != "" {
+		pem, err := ioutil.ReadFile(p.config.CA)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in webhook ca %s", p.config.CA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	p.client = &http.Client{Timeout: p.timeout, Transport: transport}
+	return p, nil
+}
+
+func (p *Webhook) Authenticate(sess *pggateway.Session) (bool, error) {
+	// The client's password is sent to the endpoint, don't ask for it in the clear
+	if !sess.IsSSL && !p.config.AllowInsecure {
+		return false, p.deny(sess, codeInvalidAuthorization, "webhook authentication requires an SSL session")
+	}
+
+	_, passwd, err := sess.GetUserPassword(pgproto.AuthenticationMethodPlaintext)
+	if err != nil {
+		return false, err
+	}
+
+	req := newRequest(sess, string(passwd.HeaderMessage))
+	resp, err := p.authorize(req)
+	if err != nil {
+		// Fail closed, the client never reaches the target without a decision
+		return false, p.deny(sess, codeInvalidAuthorization, fmt.Sprintf("authorization failed: %s", err))
+	}
+	if !resp.Allow {
+		reason := resp.Reason
+		if reason == "" {
+			reason = "access denied"
+		}
+		return false, p.deny(sess, codeInvalidPassword, reason)
+	}
+
+	target := p.config.Target
+	user, password := req.User, req.Password
+	if target.User != "" {
+		user, password = target.User, target.Password
+	}
+	if t := resp.Target; t != nil {
+		if t.Host != "" {
+			target.Host = t.Host
+		}
+		if t.Port != 0 {
+			target.Port = t.Port
+		}
+		if t.User != "" {
+			user, password = t.User, t.Password
+		}
+	}
+	if !pggateway.IsDatabaseAllowed(target.Databases, sess.Database) {
+		return false, p.deny(sess, codeInvalidAuthorization, fmt.Sprintf("database %s is not allowed", sess.Database))
+	}
+
+	err = sess.DialTarget(target)
+	if err != nil {
+		return false, err
+	}
+	err = sess.AuthOnServer(user, password)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *Webhook) deny(sess *pggateway.Session, code string, reason string) error {
+	_ = sess.WriteToClient(&pgproto.Error{
+		Severity: []byte("FATAL"),
+		Code:     []byte(code),
+		Message:  []byte(reason),
+	})
+	return fmt.Errorf("webhook authentication of user %s failed: %s", sess.User, reason)
+}
+
+func newRequest(sess *pggateway.Session, password string) *Request {
+	info := sess.Info()
+	req := &Request{
+		User:              info.User,
+		Password:          password,
+		Database:          info.Database,
+		SSL:               info.SSL,
+		ServerName:        info.ServerName,
+		StartupParameters: info.StartupParameters,
+	}
+	if info.ClientAddr != nil {
+		req.ClientAddress = info.ClientAddr.String()
+	}
+	// Only certificates verified against ssl.client_ca are passed on
+	if state := sess.TLSConnectionState(); state != nil && len(state.VerifiedChains) > 0 {
+		cert := state.PeerCertificates[0]
+		fingerprint := sha256.Sum256(cert.Raw)
+		req.ClientCertificate = &Certificate{
+			Subject:           cert.Subject.String(),
+			Issuer:            cert.Issuer.String(),
+			SerialNumber:      cert.SerialNumber.String(),
+			FingerprintSHA256: hex.EncodeToString(fingerprint[:]),
+			DNSNames:          cert.DNSNames,
+			EmailAddresses:    cert.EmailAddresses,
+			NotBefore:         cert.NotBefore,
+			NotAfter:          cert.NotAfter,
+		}
+	}
+	return req
+}
+
+// cacheKey identifies the requests the endpoint decides alike, leaving out the client's port
+// which changes with every connection. Keys are hashed so the cache never holds passwords.
+func cacheKey(req *Request) (string, error) {
+	host := req.ClientAddress
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var fingerprint string
+	if req.ClientCertificate != nil {
+		fingerprint = req.ClientCertificate.FingerprintSHA256
+	}
+
+	fields, err := json.Marshal([]interface{}{
+		req.User, req.Password, req.Database, host, req.SSL, req.ServerName, fingerprint, req.StartupParameters,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(fields)
+	return string(sum[:]), nil
+}
+
+// authorize returns the endpoint's decision for req, from the cache when it was asked recently
+func (p *Webhook) authorize(req *Request) (Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Response{}, err
+	}
+	key, err := cacheKey(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if p.cacheTTL > 0 {
+		p.mutex.Lock()
+		entry, ok := p.cache[key]
+		p.mutex.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			return entry.response, nil
+		}
+	}
+
+	resp, err := p.post(body)
+	if err != nil {
+		return resp, err
+	}
+
+	if p.cacheTTL > 0 {
+		p.store(key, resp)
+	}
+	return resp, nil
+}
+
+func (p *Webhook) post(body []byte) (Response, error) {
+	var resp Response
+	httpReq, err := http.NewRequest(http.MethodPost, p.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	for name, value := range p.config.Headers {
+		httpReq.Header.Set(name, value)
+	}
+
+	httpResp, err := p.client.Do(httpReq)
+	if err != nil {
+		return resp, err
+	}
+	defer httpResp.Body.Close()
+	defer io.Copy(ioutil.Discard, httpResp.Body)
+
+	switch {
+	case httpResp.StatusCode == http.StatusUnauthorized || httpResp.StatusCode == http.StatusForbidden:
+		// A denial, optionally with a Response giving its reason
+		_ = json.NewDecoder(httpResp.Body).Decode(&resp)
+		resp.Allow = false
+		return resp, nil
+	case httpResp.StatusCode != http.StatusOK:
+		return resp, fmt.Errorf("unexpected status %s from %s", httpResp.Status, p.config.URL)
+	}
+
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return resp, fmt.Errorf("invalid response from %s: %s", p.config.URL, err)
+	}
+	return resp, nil
+}
+
+func (p *Webhook) store(key string, resp Response) {
+	now := time.Now()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.cache) >= p.maxCacheEntries {
+		for k, entry := range p.cache {
+			if now.After(entry.expires) {
+				delete(p.cache, k)
+			}
+		}
+	}
+	// Still full of live decisions, forget an arbitrary one
+	for k := range p.cache {
+		if len(p.cache) < p.maxCacheEntries {
+			break
+		}
+		delete(p.cache, k)
+	}
+	p.cache[key] = cacheEntry{response: resp, expires: now.Add(p.cacheTTL)}
+}
+
+func (p *Webhook) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
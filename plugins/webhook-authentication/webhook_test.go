@@ -0,0 +1,243 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pggateway/plugins/webhook-authentication"
+	"github.com/c653labs/pgproto"
+)
+
+// endpoint allows the user "app" with the password "secret", sending it to target
+type endpoint struct {
+	*httptest.Server
+	target *pgtest.Server
+
+	mutex    sync.Mutex
+	requests []webhook.Request
+}
+
+func newEndpoint(t *testing.T, target *pgtest.Server) *endpoint {
+	e := &endpoint{target: target}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serve))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *endpoint) serve(w http.ResponseWriter, r *http.Request) {
+	var req webhook.Request
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.mutex.Lock()
+	e.requests = append(e.requests, req)
+	e.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "missing token", http.StatusInternalServerError)
+		return
+	}
+	if req.User != "app" || req.Password != "secret" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(webhook.Response{Reason: "unknown user or password"})
+		return
+	}
+	json.NewEncoder(w).Encode(webhook.Response{
+		Allow:  true,
+		Target: &webhook.Target{Host: e.target.Host(), Port: e.target.Port(), User: "owner", Password: "owner-secret"},
+	})
+}
+
+func (e *endpoint) received() []webhook.Request {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]webhook.Request(nil), e.requests...)
+}
+
+func startGateway(t *testing.T, e *endpoint, config map[string]interface{}) *pgtest.Gateway {
+	c := map[string]interface{}{
+		"url":            e.URL,
+		"headers":        map[string]string{"Authorization": "Bearer token"},
+		"allow_insecure": true,
+	}
+	for name, value := range config {
+		c[name] = value
+	}
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{"webhook": c},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gw.Close() })
+	return gw
+}
+
+func newTarget(t *testing.T) *pgtest.Server {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	srv.AuthMethod = pgtest.AuthSCRAMSHA256
+	srv.Users["owner"] = "owner-secret"
+	srv.SetResult("SELECT current_user", pgtest.Result{Columns: []string{"current_user"}, Rows: [][]string{{"owner"}}})
+	return srv
+}
+
+func TestWebhook(t *testing.T) {
+	target := newTarget(t)
+	e := newEndpoint(t, target)
+	gw := startGateway(t, e, nil)
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "secret", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rows, err := client.Query("SELECT current_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0][0] != "owner" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+
+	requests := e.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected a single request, got %v", requests)
+	}
+	req := requests[0]
+	if req.Database != "app" || req.SSL || !strings.HasPrefix(req.ClientAddress, "127.0.0.1:") {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	if req.StartupParameters["user"] != "app" {
+		t.Fatalf("startup parameters missing from %+v", req)
+	}
+}
+
+func TestWebhookDeny(t *testing.T) {
+	target := newTarget(t)
+	e := newEndpoint(t, target)
+	gw := startGateway(t, e, nil)
+
+	_, err := pgtest.Connect(gw.Addr(), "app", "wrong", "app")
+	if err == nil || !strings.Contains(err.Error(), "unknown user or password") {
+		t.Fatalf("expected the endpoint's reason, got %v", err)
+	}
+	if queries := target.Queries(); len(queries) != 0 {
+		t.Fatalf("denied client reached the target: %v", queries)
+	}
+}
+
+func TestWebhookFailsClosed(t *testing.T) {
+	target := newTarget(t)
+	e := newEndpoint(t, target)
+	gw := startGateway(t, e, map[string]interface{}{"headers": map[string]string{}})
+
+	_, err := pgtest.Connect(gw.Addr(), "app", "secret", "app")
+	if err == nil || !strings.Contains(err.Error(), "authorization failed") {
+		t.Fatalf("expected the endpoint's failure to deny access, got %v", err)
+	}
+}
+
+func TestWebhookRequiresSSL(t *testing.T) {
+	target := newTarget(t)
+	e := newEndpoint(t, target)
+	gw := startGateway(t, e, map[string]interface{}{"allow_insecure": false})
+
+	_, err := pgtest.Connect(gw.Addr(), "app", "secret", "app")
+	if err == nil || !strings.Contains(err.Error(), "requires an SSL session") {
+		t.Fatalf("expected an SSL error, got %v", err)
+	}
+	if requests := e.received(); len(requests) != 0 {
+		t.Fatalf("password sent to the endpoint without SSL: %v", requests)
+	}
+}
+
+func TestWebhookCache(t *testing.T) {
+	target := newTarget(t)
+	e := newEndpoint(t, target)
+	gw := startGateway(t, e, map[string]interface{}{"cache_ttl": "1m"})
+
+	for i := 0; i < 3; i++ {
+		client, err := pgtest.Connect(gw.Addr(), "app", "secret", "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+	}
+	_, err := pgtest.Connect(gw.Addr(), "app", "wrong", "app")
+	if err == nil {
+		t.Fatal("a cached decision was reused for another password")
+	}
+
+	if requests := e.received(); len(requests) != 2 {
+		t.Fatalf("expected a request for each password, got %d", len(requests))
+	}
+}
+
+// startupError authenticates with password and returns the error the gateway answers with
+func startupError(t *testing.T, gw *pgtest.Gateway, password string) *pgproto.Error {
+	conn, err := net.Dial("tcp", gw.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msgs := []pgproto.Message{
+		&pgproto.StartupMessage{Options: map[string][]byte{"user": []byte("app"), "database": []byte("app")}},
+		&pgproto.PasswordMessage{HeaderMessage: []byte(password)},
+	}
+	for _, msg := range msgs {
+		_, err = pgproto.WriteMessage(msg, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		msg, err := pgproto.ParseServerMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch m := msg.(type) {
+		case *pgproto.Error:
+			return m
+		case *pgproto.ReadyForQuery:
+			t.Fatal("authenticated without an error")
+		}
+	}
+}
+
+func TestWebhookDenyCodes(t *testing.T) {
+	target := newTarget(t)
+	e := newEndpoint(t, target)
+
+	tests := []struct {
+		name     string
+		config   map[string]interface{}
+		password string
+		code     string
+	}{
+		{name: "denied", password: "wrong", code: "28P01"},
+		{name: "fails closed", config: map[string]interface{}{"headers": map[string]string{}}, password: "secret", code: "28000"},
+		{name: "requires SSL", config: map[string]interface{}{"allow_insecure": false}, password: "secret", code: "28000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gw := startGateway(t, e, test.config)
+			if m := startupError(t, gw, test.password); string(m.Code) != test.code {
+				t.Fatalf("denied with SQLSTATE %q (%s), expected %s", m.Code, m.Message, test.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package pggateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a trusted proxy has to send its header
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolConfig
+type ProxyProtocolConfig struct {
+	Enabled bool     `yaml:"enabled,omitempty"`
+	Trusted []string `yaml:"trusted,omitempty"`
+}
+
+func (c ProxyProtocolConfig) trustedNetworks() ([]*net.IPNet, error) {
+	if c.Enabled && len(c.Trusted) == 0 {
+		return nil, fmt.Errorf("proxy_protocol requires at least one trusted network")
+	}
+
+	networks := make([]*net.IPNet, 0, len(c.Trusted))
+	for _, cidr := range c.Trusted {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_protocol trusted network %#v: %s", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedAddr(addr net.Addr, networks []*net.IPNet) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader parses a PROXY protocol v1 or v2 header from conn
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	bc := newBufferedConn(conn)
+	r := bc.reader
+	prefix, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	switch {
+	case string(prefix) == "PROXY":
+		remote, err = readProxyHeaderV1(r)
+	case bytes.Equal(prefix, proxyProtocolV2Signature[:5]):
+		remote, err = readProxyHeaderV2(r)
+	default:
+		return nil, fmt.Errorf("expected PROXY protocol header from %s", conn.RemoteAddr())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bc.remote = remote
+	return bc, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest possible v1 header is 107 bytes
+	line := make([]byte, 0, 107)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, fmt.Errorf("PROXY v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) || header[12]>>4 != 2 {
+		return nil, fmt.Errorf("malformed PROXY v2 header")
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// LOCAL command, the connection was made by the proxy itself
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	}
+	return nil, nil
+}
+
+// writeProxyHeader sends a PROXY protocol header describing the src → dst connection
+func writeProxyHeader(w io.Writer, version string, src net.Addr, dst net.Addr) error {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	isTCP := srcOK && dstOK
+
+	ipv4 := isTCP && srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil
+
+	switch version {
+	case "v1", "1":
+		line := "PROXY UNKNOWN\r\n"
+		switch {
+		case ipv4:
+			line = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)
+		case isTCP:
+			// Both addresses of a TCP6 line must be IPv6, IPv4 ones are mapped
+			line = fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyIPv6(srcAddr.IP), proxyIPv6(dstAddr.IP), srcAddr.Port, dstAddr.Port)
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	case "v2", "2":
+		buf := bytes.NewBuffer(nil)
+		buf.Write(proxyProtocolV2Signature)
+
+		var addrs []byte
+		switch {
+		case ipv4:
+			buf.Write([]byte{0x21, 0x11})
+			addrs = append(addrs, srcAddr.IP.To4()...)
+			addrs = append(addrs, dstAddr.IP.To4()...)
+		case isTCP:
+			buf.Write([]byte{0x21, 0x21})
+			addrs = append(addrs, srcAddr.IP.To16()...)
+			addrs = append(addrs, dstAddr.IP.To16()...)
+		default:
+			// LOCAL command with an unspecified address family
+			buf.Write([]byte{0x20, 0x00})
+		}
+		if isTCP {
+			ports := make([]byte, 4)
+			binary.BigEndian.PutUint16(ports[0:], uint16(srcAddr.Port))
+			binary.BigEndian.PutUint16(ports[2:], uint16(dstAddr.Port))
+			addrs = append(addrs, ports...)
+		}
+		binary.Write(buf, binary.BigEndian, uint16(len(addrs)))
+		buf.Write(addrs)
+
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	return fmt.Errorf("unknown PROXY protocol version %#v, expected 'v1' or 'v2'", version)
+}
+
+// proxyIPv6 formats ip as an IPv6 address, IPv4 addresses in their IPv4-mapped form
+func proxyIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
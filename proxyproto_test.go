@@ -0,0 +1,234 @@
+package pggateway_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+)
+
+// proxyFor listens like a load balancer in front of the gateway at addr, sending header before forwarding
+func proxyFor(t *testing.T, addr string, header []byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			target.Write(header)
+			go func() {
+				io.Copy(target, conn)
+				target.Close()
+			}()
+			go func() {
+				io.Copy(conn, target)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// proxyHeaderV2 builds a PROXY v2 PROXY command for TCP over IPv4 from src to dst
+func proxyHeaderV2(src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	header = append(header, src.IP.To4()...)
+	header = append(header, dst.IP.To4()...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dst.Port))
+	return append(header, ports...)
+}
+
+func startProxyProtocolGateway(t *testing.T, srv *pgtest.Server, trusted string, timeouts pggateway.TimeoutsConfig) (*pgtest.Gateway, *recorder) {
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		ProxyProtocol:  pggateway.ProxyProtocolConfig{Enabled: true, Trusted: []string{trusted}},
+		Timeouts:       timeouts,
+		Authentication: passthrough(srv),
+		Hooks:          map[string]interface{}{"recorder": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gw.Close() })
+	return gw, <-recorders
+}
+
+// clientAddr connects through addr and returns the client address of the session the gateway saw
+func clientAddr(t *testing.T, addr string, r *recorder) string {
+	client, err := pgtest.Connect(addr, "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Query("SELECT 1")
+	client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := r.recorded()
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type == pggateway.SessionConnect {
+			return events[i].Session.ClientAddr.String()
+		}
+	}
+	t.Fatal("no session connected")
+	return ""
+}
+
+// expectClosed checks the gateway closes conn without answering
+func expectClosed(t *testing.T, conn net.Conn, within time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(within))
+	n, err := conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected the connection to be closed, read %d bytes: %v", n, err)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	gw, r := startProxyProtocolGateway(t, srv, "127.0.0.1", pggateway.TimeoutsConfig{})
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432}
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.10 10.0.0.1 50000 5432\r\n"), "192.0.2.10:50000"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::10 2001:db8::1 50001 5432\r\n"), "[2001:db8::10]:50001"},
+		{"v2 TCP4", proxyHeaderV2(&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 50002}, dst), "198.51.100.7:50002"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := clientAddr(t, proxyFor(t, gw.Addr(), test.header), r); got != test.want {
+				t.Fatalf("expected client address %s, got %s", test.want, got)
+			}
+		})
+	}
+
+	// Health checks by the proxy itself keep the proxy's address
+	for _, header := range [][]byte{
+		[]byte("PROXY UNKNOWN\r\n"),
+		[]byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"),
+	} {
+		got := clientAddr(t, proxyFor(t, gw.Addr(), header), r)
+		if host, _, _ := net.SplitHostPort(got); host != "127.0.0.1" {
+			t.Fatalf("expected the proxy's address for %q, got %s", header, got)
+		}
+	}
+}
+
+func TestProxyProtocolMalformed(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	gw, _ := startProxyProtocolGateway(t, srv, "127.0.0.0/8", pggateway.TimeoutsConfig{})
+	headers := map[string][]byte{
+		"missing":     []byte("\x00\x00\x00\x08\x04\xd2\x16\x2f"),
+		"v1 fields":   []byte("PROXY TCP4 192.0.2.10 10.0.0.1 50000\r\n"),
+		"v1 address":  []byte("PROXY TCP4 not-an-ip 10.0.0.1 50000 5432\r\n"),
+		"v1 too long": append([]byte("PROXY TCP4 "), make([]byte, 120)...),
+		"v2 version":  []byte("\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x0c"),
+		"v2 short":    []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x00\x00\x00\x00"),
+	}
+	for name, header := range headers {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", gw.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, err = conn.Write(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectClosed(t, conn, 5*time.Second)
+		})
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	gw, r := startProxyProtocolGateway(t, srv, "192.0.2.0/24", pggateway.TimeoutsConfig{})
+
+	// Untrusted clients connect directly and may not claim another address
+	got := clientAddr(t, gw.Addr(), r)
+	if host, _, _ := net.SplitHostPort(got); host != "127.0.0.1" {
+		t.Fatalf("expected the client's own address, got %s", got)
+	}
+	conn, err := net.Dial("tcp", gw.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("PROXY TCP4 192.0.2.10 10.0.0.1 50000 5432\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, conn, 5*time.Second)
+}
+
+func TestProxyProtocolHeaderDeadline(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// The authentication timeout covers waiting for the header
+	gw, _ := startProxyProtocolGateway(t, srv, "127.0.0.1", pggateway.TimeoutsConfig{Authentication: 100 * time.Millisecond})
+	conn, err := net.Dial("tcp", gw.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("expected the connection to be closed after the authentication timeout: %s", err)
+	}
+
+	if testing.Short() {
+		t.Skip("skipping the header deadline without an authentication timeout in short mode")
+	}
+	// Without one trusted proxies still only get so long to send it
+	gw, _ = startProxyProtocolGateway(t, srv, "127.0.0.1", pggateway.TimeoutsConfig{})
+	conn, err = net.Dial("tcp", gw.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	expectClosed(t, conn, 10*time.Second)
+	if elapsed := time.Since(start); elapsed < 4*time.Second {
+		t.Fatalf("connection closed after %s, before the header deadline", elapsed)
+	}
+}
@@ -0,0 +1,66 @@
+package pggateway
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// plainConn returns the connection underneath conn, writing to a bufferedConn is not buffered
+func plainConn(conn net.Conn) net.Conn {
+	if bc, ok := conn.(*bufferedConn); ok {
+		return bc.Conn
+	}
+	return conn
+}
+
+// spliceConn returns the plain connection to read conn from, so io.Copy between two TCP
+// connections can use splice(2) on Linux. Bytes conn has already buffered are written to w first.
+func spliceConn(conn net.Conn, w io.Writer) (net.Conn, int64, error) {
+	bc, ok := conn.(*bufferedConn)
+	if !ok || bc.reader.Buffered() == 0 {
+		return plainConn(conn), 0, nil
+	}
+	buffered, _ := bc.reader.Peek(bc.reader.Buffered())
+	n, err := w.Write(buffered)
+	bc.reader.Discard(n)
+	return bc.Conn, int64(n), err
+}
+
+// proxyRaw copies bytes between client and target without parsing messages
+func (s *Session) proxyRaw(ctx context.Context) error {
+	g, ctx := newErrGroup(ctx)
+	go func() {
+		<-ctx.Done()
+		s.stop()
+	}()
+
+	g.Go(func() error {
+		n, err := io.Copy(plainConn(s.client), s.target)
+		atomic.AddInt64(&s.bytesToClient, n)
+		// The target hung up, nothing the client still sends can be answered,
+		// closing both connections ends the other direction too
+		s.stop()
+		return err
+	})
+
+	g.Go(func() error {
+		client, n, err := spliceConn(s.client, s.target)
+		atomic.AddInt64(&s.bytesToServer, n)
+		if err != nil {
+			return err
+		}
+		n, err = io.Copy(s.target, client)
+		atomic.AddInt64(&s.bytesToServer, n)
+		// The client hung up, most likely after sending a Termination message,
+		// let the target see the end of the stream too and close its side
+		cw, ok := s.target.(interface{ CloseWrite() error })
+		if !ok || err != nil || cw.CloseWrite() != nil {
+			s.stop()
+		}
+		return err
+	})
+
+	return g.Wait()
+}
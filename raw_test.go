@@ -0,0 +1,169 @@
+package pggateway_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	_ "github.com/c653labs/pggateway/plugins/passthrough-authentication"
+)
+
+// passthrough is the authentication config proxying every session to srv
+func passthrough(srv *pgtest.Server) map[string]interface{} {
+	return map[string]interface{}{
+		"passthrough": map[string]interface{}{
+			"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port()},
+		},
+	}
+}
+
+func BenchmarkProxyThroughput(b *testing.B) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Close()
+
+	const rows, width = 1000, 1024
+	result := pgtest.Result{Columns: []string{"data"}}
+	for i := 0; i < rows; i++ {
+		result.Rows = append(result.Rows, []string{strings.Repeat("x", width)})
+	}
+	srv.SetResult("SELECT data FROM bench", result)
+
+	for _, inspect := range []bool{true, false} {
+		name := "inspect"
+		if !inspect {
+			name = "raw"
+		}
+		inspect := inspect
+		b.Run(name, func(b *testing.B) {
+			gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+				Authentication: passthrough(srv),
+				Inspect:        &inspect,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer gw.Close()
+
+			client, err := pgtest.Connect(gw.Addr(), "bench", "", "bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+
+			b.SetBytes(rows * width)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := client.Query("SELECT data FROM bench")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestRawTargetDisconnect checks raw sessions end when the target hangs up first
+func TestRawTargetDisconnect(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	srv.SetResult("SELECT disconnect", pgtest.Result{Disconnect: true})
+
+	inspect := false
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Inspect:        &inspect,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	const sessions = 50
+	errs := make(chan error, sessions)
+	for i := 0; i < sessions; i++ {
+		go func() {
+			client, err := pgtest.Connect(gw.Addr(), "stress", "", "stress")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer client.Close()
+			_, err = client.Query("SELECT 1")
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = client.Query("SELECT disconnect")
+			if err == nil {
+				errs <- fmt.Errorf("query succeeded after the target disconnected")
+				return
+			}
+			errs <- nil
+		}()
+	}
+
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < sessions; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-timeout:
+			t.Fatalf("%d sessions still open after the target disconnected", sessions-i)
+		}
+	}
+}
+
+// TestServerStartClose checks Close waits for Start however they race
+func TestServerStartClose(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	inspect := false
+	for i := 0; i < 50; i++ {
+		s, err := pggateway.NewServer(&pggateway.Config{
+			Listeners: []*pggateway.ListenerConfig{{
+				Bind:           "127.0.0.1:0",
+				Authentication: passthrough(srv),
+				Inspect:        &inspect,
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		started := make(chan error, 1)
+		go func() {
+			started <- s.Start()
+		}()
+		if i%2 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		err = s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-started:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Start did not return after Close")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package pggateway
+
+import (
+	"strings"
+
+	"github.com/c653labs/pgproto"
+)
+
+// IsReplicationStartup reports whether startup opens a physical (`replication=true`)
+// or logical (`replication=database`) replication connection
+func IsReplicationStartup(startup *pgproto.StartupMessage) bool {
+	value, ok := startup.Options["replication"]
+	if !ok {
+		return false
+	}
+
+	switch strings.ToLower(string(value)) {
+	case "database", "true", "on", "yes", "1":
+		return true
+	}
+	return false
+}
+
+// AllowsReplication reports whether the listener, or any of its routes, accepts replication connections
+func (c *ListenerConfig) AllowsReplication() bool {
+	if c.Replication {
+		return true
+	}
+	for _, route := range c.Routes {
+		if route.Replication != nil && *route.Replication {
+			return true
+		}
+	}
+	return false
+}
+
+// replicationAllowed reports whether user may open a replication connection through route,
+// nil for clients using the listener's defaults
+func (l *Listener) replicationAllowed(route *listenerRoute, user string) bool {
+	allowed, users := l.config.Replication, l.config.ReplicationUsers
+	if route != nil {
+		if route.config.Replication != nil {
+			allowed = *route.config.Replication
+		}
+		if route.config.ReplicationUsers != nil {
+			users = route.config.ReplicationUsers
+		}
+	}
+	if !allowed {
+		return false
+	}
+	if len(users) == 0 {
+		return true
+	}
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
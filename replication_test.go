@@ -0,0 +1,221 @@
+package pggateway_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pgproto"
+)
+
+// copyBothResponse starts streaming like START_REPLICATION does, pgproto has no message for it
+var copyBothResponse = []byte{'W', 0, 0, 0, 7, 0, 0, 0}
+
+// replicationTarget accepts sessions, reporting their startup options, and streams
+// back whatever their clients send
+func replicationTarget(t *testing.T) (string, int, chan map[string][]byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	startups := make(chan map[string][]byte, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				startup, err := pgproto.ParseStartupMessage(conn)
+				if err != nil {
+					return
+				}
+				startups <- startup.Options
+				_, err = pgproto.WriteMessages([]pgproto.Message{
+					&pgproto.AuthenticationRequest{Method: pgproto.AuthenticationMethodOK},
+					&pgproto.ReadyForQuery{Status: 'I'},
+				}, conn)
+				if err != nil {
+					return
+				}
+				conn.Write(copyBothResponse)
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p, startups
+}
+
+// startSession opens a session with the startup options through the gateway at addr,
+// returning its connection once the session is ready
+func startSession(addr string, options map[string]string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	startup := &pgproto.StartupMessage{Options: make(map[string][]byte)}
+	for k, v := range options {
+		startup.Options[k] = []byte(v)
+	}
+	_, err = pgproto.WriteMessage(startup, conn)
+	for err == nil {
+		var msg pgproto.ServerMessage
+		msg, err = pgproto.ParseServerMessage(conn)
+		switch m := msg.(type) {
+		case *pgproto.Error:
+			err = fmt.Errorf("%s", m.Message)
+		case *pgproto.ReadyForQuery:
+			return conn, nil
+		}
+	}
+	conn.Close()
+	return nil, err
+}
+
+func startReplicationGateway(t *testing.T, config *pggateway.ListenerConfig) (*pgtest.Gateway, chan map[string][]byte) {
+	host, port, startups := replicationTarget(t)
+	config.Authentication = map[string]interface{}{
+		"passthrough": map[string]interface{}{
+			"target": map[string]interface{}{"host": host, "port": port},
+		},
+	}
+	gw, err := pgtest.StartGateway(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gw.Close() })
+	return gw, startups
+}
+
+func TestIsReplicationStartup(t *testing.T) {
+	for value, want := range map[string]bool{
+		"database": true,
+		"true":     true,
+		"ON":       true,
+		"1":        true,
+		"false":    false,
+		"0":        false,
+		"":         false,
+	} {
+		startup := &pgproto.StartupMessage{Options: map[string][]byte{"replication": []byte(value)}}
+		if got := pggateway.IsReplicationStartup(startup); got != want {
+			t.Errorf("replication=%q: expected %v, got %v", value, want, got)
+		}
+	}
+	if pggateway.IsReplicationStartup(&pgproto.StartupMessage{Options: map[string][]byte{}}) {
+		t.Error("expected a startup without the replication option to be a normal session")
+	}
+}
+
+func TestReplicationPassthrough(t *testing.T) {
+	gw, startups := startReplicationGateway(t, &pggateway.ListenerConfig{
+		Replication: true,
+		Hooks:       map[string]interface{}{"recorder": ""},
+	})
+	r := <-recorders
+
+	tests := []map[string]string{
+		// Logical replication connects to a database
+		{"user": "replicator", "database": "app", "replication": "database"},
+		// Physical replication does not
+		{"user": "replicator", "replication": "true"},
+	}
+	for _, options := range tests {
+		conn, err := startSession(gw.Addr(), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if forwarded := <-startups; string(forwarded["replication"]) != options["replication"] {
+			t.Fatalf("expected the target to see replication=%s, got %q", options["replication"], forwarded["replication"])
+		}
+
+		// The CopyBoth stream is forwarded byte for byte, without being parsed
+		response := make([]byte, len(copyBothResponse))
+		_, err = io.ReadFull(conn, response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(response, copyBothResponse) {
+			t.Fatalf("expected CopyBothResponse, got %q", response)
+		}
+		stream := []byte("d\x00\x00\x00\x0dr status\x00\xff\x00\x01")
+		_, err = conn.Write(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoed := make([]byte, len(stream))
+		_, err = io.ReadFull(conn, echoed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(echoed, stream) {
+			t.Fatalf("expected the stream back unchanged, got %q", echoed)
+		}
+		conn.Close()
+	}
+
+	replication := 0
+	for _, e := range r.recorded() {
+		if e.Type == pggateway.SessionConnect && e.Session.Replication {
+			replication++
+		}
+	}
+	if replication != len(tests) {
+		t.Fatalf("expected %d replication sessions, got %d", len(tests), replication)
+	}
+}
+
+func TestReplicationNotAllowed(t *testing.T) {
+	gw, _ := startReplicationGateway(t, &pggateway.ListenerConfig{})
+	_, err := startSession(gw.Addr(), map[string]string{"user": "replicator", "replication": "true"})
+	if err == nil || !strings.Contains(err.Error(), "replication connections are not allowed") {
+		t.Fatalf("expected replication to be refused, got %v", err)
+	}
+
+	// Physical replication is the only session without a database
+	_, err = startSession(gw.Addr(), map[string]string{"user": "app"})
+	if err == nil || !strings.Contains(err.Error(), "database startup option is required") {
+		t.Fatalf("expected a missing database to be refused, got %v", err)
+	}
+}
+
+func TestReplicationUsers(t *testing.T) {
+	gw, startups := startReplicationGateway(t, &pggateway.ListenerConfig{
+		Replication:      true,
+		ReplicationUsers: []string{"replicator"},
+	})
+
+	_, err := startSession(gw.Addr(), map[string]string{"user": "app", "replication": "true"})
+	if err == nil || !strings.Contains(err.Error(), "not allowed for user app") {
+		t.Fatalf("expected replication to be refused for app, got %v", err)
+	}
+
+	conn, err := startSession(gw.Addr(), map[string]string{"user": "replicator", "replication": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-startups
+
+	// Other users still open normal sessions
+	conn, err = startSession(gw.Addr(), map[string]string{"user": "app", "database": "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if forwarded := <-startups; forwarded["replication"] != nil {
+		t.Fatalf("expected a normal session, got replication=%q", forwarded["replication"])
+	}
+}
@@ -1,57 +1,164 @@
 package pggateway
 
-import "sync"
+import (
+	"context"
+	"sync"
+	"time"
+)
 
 type Server struct {
 	listeners []*Listener
 	plugins   *PluginRegistry
 	config    *Config
+
+	mutex   sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+
+	shutdownTracing func(context.Context) error
 }
 
 func NewServer(c *Config) (*Server, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
 	registry, err := NewPluginRegistry(nil, c.Logging)
 	if err != nil {
 		return nil, err
 	}
+	var shutdownTracing func(context.Context) error
+	if c.Tracing.Enabled {
+		shutdownTracing, err = SetupTracing(c.Tracing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		listeners: make([]*Listener, 0),
-		plugins:   registry,
-		config:    c,
+		listeners:       make([]*Listener, 0),
+		plugins:         registry,
+		config:          c,
+		ctx:             ctx,
+		cancel:          cancel,
+		shutdownTracing: shutdownTracing,
 	}, nil
 }
 
+// Start serves all listeners until the server is closed or one of them fails
 func (s *Server) Start() error {
-	m := &sync.Mutex{}
-	c := sync.NewCond(m)
-	errs := make([]error, 0)
+	// Close waits for running servers, it must see this one unless it was already closed
+	s.mutex.Lock()
+	if s.ctx.Err() != nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.running.Add(1)
+	s.mutex.Unlock()
+	defer s.running.Done()
+	g, ctx := newErrGroup(s.ctx)
 
-	s.listeners = s.config.GetListeners()
-	for _, l := range s.listeners {
+	listeners := s.config.GetListeners()
+	s.mutex.Lock()
+	s.listeners = listeners
+	s.mutex.Unlock()
+
+	if s.config.Admin.Bind != "" {
+		err := s.startAdmin(ctx)
+		if err != nil {
+			s.cancel()
+			return err
+		}
+	}
+
+	for _, l := range listeners {
 		err := l.Listen()
 		if err != nil {
 			s.plugins.LogError(nil, "error binding to %s: %s", l, err)
+			s.cancel()
+			g.Wait()
 			return err
 		}
 
 		s.plugins.LogWarn(nil, "listening for connections: %v", l.String())
-		go func(l *Listener) {
-			err := l.Handle()
-			errs = append(errs, err)
-			c.Broadcast()
-		}(l)
+		if s.config.Tracing.Enabled && !l.config.InspectMessages() {
+			s.plugins.LogWarn(nil, "statements of %s are not traced without message inspection", l)
+		}
+		l := l
+		g.Go(func() error {
+			return l.Handle(ctx)
+		})
+	}
+
+	return g.Wait()
+}
+
+// Reload applies c to the server's plugins and the running listeners, matched by their bind address
+func (s *Server) Reload(c *Config) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err = s.plugins.Reload(nil, c.Logging, nil, nil)
+	for _, l := range s.listeners {
+		for _, config := range c.Listeners {
+			if config.Bind != l.config.Bind {
+				continue
+			}
+			e := l.Reload(config)
+			if e != nil {
+				err = e
+			}
+		}
 	}
+	return err
+}
 
-	c.L.Lock()
-	c.Wait()
-	c.L.Unlock()
-	if len(errs) > 0 {
-		return errs[0]
+// ReopenLogs reopens the log files of the server and its listeners
+func (s *Server) ReopenLogs() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.plugins.ReopenLogs()
+	for _, l := range s.listeners {
+		e := l.plugins.ReopenLogs()
+		if e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Health checks the plugins of the server and its listeners, returning their errors by plugin
+func (s *Server) Health() map[string]map[string]error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	health := map[string]map[string]error{
+		"server": s.plugins.Health(),
+	}
+	for _, l := range s.listeners {
+		health[l.String()] = l.Health()
+	}
+	return health
+}
+
+// InvalidateCaches empties the query cache of every listener
+func (s *Server) InvalidateCaches() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, l := range s.listeners {
+		l.InvalidateCache()
 	}
-	return nil
 }
 
 func (s *Server) Close() error {
 	s.plugins.LogWarn(nil, "stopping server")
+	s.cancel()
+
+	s.mutex.Lock()
 	var err error
 	for _, l := range s.listeners {
 		e := l.Close()
@@ -59,5 +166,23 @@ func (s *Server) Close() error {
 			err = e
 		}
 	}
+	s.mutex.Unlock()
+	// Listeners flush their logging plugins once their sessions have ended
+	s.running.Wait()
+
+	e := s.plugins.Close()
+	if e != nil {
+		err = e
+	}
+
+	if s.shutdownTracing != nil {
+		// Flush the spans waiting to be exported
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		e := s.shutdownTracing(ctx)
+		if e != nil {
+			err = e
+		}
+	}
 	return err
 }
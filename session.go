@@ -1,6 +1,7 @@
 package pggateway
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/xdg/scram"
@@ -8,9 +9,12 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/c653labs/pgproto"
 	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Session struct {
@@ -18,6 +22,15 @@ type Session struct {
 	User     []byte
 	Database []byte
 
+	// PeerCredentials is only set for clients connected over a Unix domain socket
+	PeerCredentials *PeerCredentials
+	// ServerName is the TLS server name (SNI) requested by SSL clients
+	ServerName string
+	// IsReplication is set for physical and logical replication connections
+	IsReplication bool
+	// Listener is the bind address of the listener that accepted the session
+	Listener string
+
 	IsSSL    bool
 	client   net.Conn
 	target   net.Conn
@@ -25,10 +38,77 @@ type Session struct {
 	password []byte
 
 	startup *pgproto.StartupMessage
+	// targetUser and targetDatabase are those of the startup message sent to the target,
+	// authentication plugins may map the client's to others
+	targetUser     string
+	targetDatabase string
 
-	stopped bool
+	stopped int32
 
 	plugins *PluginRegistry
+
+	limiter  *Limiter
+	pending  int32
+	txStatus int32
+	// batchAcquired is set once the limits let the current extended query batch through, batchRejected
+	// once they refused it, dropping its messages up to its Sync. Both are only used by the client goroutine.
+	batchAcquired bool
+	batchRejected *LimitError
+
+	// responseMutex orders the responses the gateway makes up itself after those of the target,
+	// queued holds them until the target answered the statements sent before them
+	responseMutex sync.Mutex
+	queued        []queuedResponse
+
+	inspect       bool
+	bytesToServer int64
+	bytesToClient int64
+
+	capture *captureWriter
+
+	mirrorConfig MirrorConfig
+	mirror       *mirror
+	// statementSeq counts the statements sent to the target, it is only written by the client goroutine
+	statementSeq int64
+
+	transformers []ResponseTransformer
+
+	cache      *QueryCache
+	cacheMutex sync.Mutex
+	cacheKeys  map[int64]cacheKey
+	// cacheBatch and cacheBypassed are only used by the client goroutine, the cache is bypassed
+	// for the rest of the session once it may have changed its settings
+	cacheBatch    []pgproto.ClientMessage
+	cacheBypassed bool
+	completedSeq  int64
+
+	connected     time.Time
+	authenticated int64
+	statements    int64
+	// targetAuthenticated is set once the target sent AuthenticationOk
+	targetAuthenticated int32
+	// prepared and portals map the names of prepared statements and portals to their queries,
+	// they are only used by the client goroutine
+	prepared map[string]string
+	portals  map[string]*portal
+
+	traceCtx       context.Context
+	statementSpan  trace.Span
+	statementSpans statementSpans
+
+	clientMutex sync.Mutex
+	targetMutex sync.Mutex
+
+	timeouts     TimeoutsConfig
+	timerMutex   sync.Mutex
+	authTimer    *time.Timer
+	idleTimer    *time.Timer
+	sessionTimer *time.Timer
+	// clientBusy is set while a client message is handled, or an extended query batch is open
+	clientBusy bool
+	// batchOpen is set from the first message of an extended query batch up to its Sync,
+	// it is only used by the client goroutine
+	batchOpen bool
 }
 
 func NewSession(startup *pgproto.StartupMessage, user []byte, database []byte, isSSL bool, client net.Conn, target net.Conn, plugins *PluginRegistry) (*Session, error) {
@@ -48,13 +128,25 @@ func NewSession(startup *pgproto.StartupMessage, user []byte, database []byte, i
 		salt:     generateSalt(),
 		startup:  startup,
 		plugins:  plugins,
-		stopped:  false,
+		inspect:  true,
 	}, nil
 }
 
 func (s *Session) Close() {
-	if s.target != nil {
-		s.target.Close()
+	s.stopTimeouts()
+	if s.mirror != nil {
+		s.mirror.close()
+	}
+	if s.capture != nil {
+		if err := s.capture.Close(); err != nil {
+			s.plugins.LogError(s.loggingContext(), "error closing capture file: %s", err)
+		}
+	}
+	if target := s.getTarget(); target != nil {
+		target.Close()
+	}
+	for atomic.LoadInt32(&s.pending) > 0 {
+		s.releaseStatement()
 	}
 }
 
@@ -62,7 +154,44 @@ func (s *Session) String() string {
 	return fmt.Sprintf("Session<ID=%#v, User=%#v, Database=%#v>", s.ID, string(s.User), string(s.Database))
 }
 
-func (s *Session) Handle() error {
+// stop marks the session as stopped and closes both connections,
+// unblocking any goroutine reading from them
+func (s *Session) stop() {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return
+	}
+	s.client.Close()
+	if target := s.getTarget(); target != nil {
+		target.Close()
+	}
+}
+
+func (s *Session) isStopped() bool {
+	return atomic.LoadInt32(&s.stopped) != 0
+}
+
+func (s *Session) setTarget(target net.Conn) {
+	s.targetMutex.Lock()
+	s.target = target
+	s.targetMutex.Unlock()
+}
+
+func (s *Session) getTarget() net.Conn {
+	s.targetMutex.Lock()
+	defer s.targetMutex.Unlock()
+	return s.target
+}
+
+// Handle authenticates the client and proxies the session until either side hangs up,
+// or ctx is cancelled
+func (s *Session) Handle(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		s.stop()
+	}()
+
 	success, err := s.plugins.Authenticate(s)
 	if err != nil {
 		return err
@@ -73,7 +202,29 @@ func (s *Session) Handle() error {
 		return nil
 	}
 
-	return s.proxy()
+	// Passthrough authentication only completes once the target accepted the client's credentials,
+	// which proxyServerMessages sees. Sessions forwarded as raw bytes can't wait for that.
+	raw := s.IsReplication || !s.inspect
+	if raw || atomic.LoadInt32(&s.targetAuthenticated) != 0 {
+		err = s.authenticationDone()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Replication streams use CopyBoth sub-protocols that we do not parse
+	if raw {
+		// Without inspection the target's ReadyForQuery can't be seen, authentication ends here
+		s.stopAuthTimeout()
+		s.plugins.LogInfo(s.loggingContext(), "forwarding session without message inspection")
+		return s.proxyRaw(ctx)
+	}
+
+	if s.mirrorConfig.Enabled {
+		s.mirror = newMirror(s, s.mirrorConfig)
+	}
+	s.transformers = s.plugins.NewResponseTransformers(s)
+	return s.proxy(ctx)
 }
 
 func (s *Session) GetUserPassword(method pgproto.AuthenticationMethod) (*pgproto.AuthenticationRequest, *pgproto.PasswordMessage, error) {
@@ -127,93 +278,395 @@ func (s *Session) parseStartupMessage() (*pgproto.StartupMessage, error) {
 	return nil, fmt.Errorf("unexpected message type")
 }
 
-func (s *Session) proxy() error {
-	m := &sync.Mutex{}
-	stop := sync.NewCond(m)
-	errs := make([]error, 0)
-
-	go s.proxyClientMessages(stop, errs)
-	go s.proxyServerMessages(stop, errs)
-
-	// Disable message interception
-	// go func() {
-	//	_, err := io.Copy(s.client, s.target)
-	//	errs = append(errs, err)
-	//	stop.Broadcast()
-	// }()
-
-	// go func() {
-	//	_, err := io.Copy(s.target, s.client)
-	//	errs = append(errs, err)
-	//	stop.Broadcast()
-	// }()
-
-	stop.L.Lock()
-	stop.Wait()
-	stop.L.Unlock()
-	s.stopped = true
-
-	if len(errs) > 0 {
-		return errs[0]
-	}
-	return nil
+// proxy forwards messages in both directions, returning the first error from either of them
+func (s *Session) proxy(ctx context.Context) error {
+	g, ctx := newErrGroup(ctx)
+	// Unblock the other direction as soon as one of them fails
+	go func() {
+		<-ctx.Done()
+		s.stop()
+	}()
+
+	g.Go(func() error { return s.proxyClientMessages(ctx) })
+	g.Go(func() error { return s.proxyServerMessages(ctx) })
+	err := g.Wait()
+
+	// Statements still in flight never completed
+	unfinished := fmt.Errorf("session ended before the statement completed")
+	s.statementDone(unfinished)
+	s.statementSpans.close(unfinished)
+	return err
 }
 
-func (s *Session) proxyServerMessages(stop *sync.Cond, errs []error) {
+func (s *Session) proxyServerMessages(ctx context.Context) error {
 	var buf []pgproto.Message
-	for !s.stopped {
+	// The first ReadyForQuery ends the startup, not a statement
+	var seq int64 = -1
+	result := &statementResult{}
+	var cached *cacheRecorder
+	for ctx.Err() == nil {
 		msg, err := s.ParseServerResponse()
 		if err != nil {
-			errs = append(errs, err)
-			stop.Broadcast()
-			break
+			// The target may have closed right after a FATAL error, the client still gets it
+			if len(buf) > 0 {
+				s.writeMessagesToClient(buf)
+			}
+			return err
+		}
+		if _, ok := msg.(*pgproto.ReadyForQuery); !ok || seq >= 0 {
+			s.traceResponse(msg)
+		}
+		switch m := msg.(type) {
+		case *pgproto.Error:
+			s.sessionEvent(SessionError, "", fmt.Errorf("%s: %s", m.Severity, m.Message))
+		case *pgproto.AuthenticationRequest:
+			// Hooks may still reject passthrough sessions before the client learns it was authenticated
+			if m.Method == pgproto.AuthenticationMethodOK && atomic.LoadInt64(&s.authenticated) == 0 {
+				err = s.authenticationDone()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		// Responses are cached before transformers run, they depend on the session
+		if s.cache != nil {
+			if cached == nil {
+				cached = s.cacheRecorder(seq + 1)
+			}
+			cached.add(msg)
+		}
+		for _, t := range s.transformers {
+			msg, err = t.TransformResponse(msg)
+			if err != nil {
+				return err
+			}
+			if msg == nil {
+				break
+			}
+		}
+		if msg == nil {
+			continue
 		}
 		buf = append(buf, msg)
+		if s.mirror != nil {
+			result.add(msg)
+		}
 
 		flush := false
 		switch m := msg.(type) {
 		case *pgproto.ReadyForQuery:
 			flush = true
+			seq++
+			if s.mirror != nil && seq > 0 {
+				s.mirror.primaryResult(seq, result)
+				result = &statementResult{}
+			}
+			atomic.StoreInt32(&s.txStatus, int32(m.Status))
+			if cached != nil {
+				cached.store(s.cache, m.Status)
+				cached = nil
+			}
+			s.releaseStatement()
+			if seq == 0 {
+				// Authentication only completes once the target is ready for the first statement
+				s.stopAuthTimeout()
+			}
+			s.recordCapture(CaptureReadyForQuery, nil)
 		case *pgproto.AuthenticationRequest:
 			flush = m.Method != pgproto.AuthenticationMethodOK
 		}
-		if flush || len(buf) > 15 {
-			pgproto.WriteMessages(buf, s.client)
+		if m, ok := msg.(*pgproto.ReadyForQuery); ok {
+			err = s.writeResponse(buf, seq)
+			if err != nil {
+				return err
+			}
+			buf = nil
+			// Pipelined statements are still running, the session is not idle
+			s.targetReady(seq, m.Status)
+		} else if flush || len(buf) > 15 {
+			err = s.writeMessagesToClient(buf)
+			if err != nil {
+				return err
+			}
 			buf = nil
 		}
 	}
 	if len(buf) > 0 {
-		pgproto.WriteMessages(buf, s.client)
+		return s.writeMessagesToClient(buf)
+	}
+	return nil
+}
+
+// queuedResponse is a response of the gateway waiting for the target to answer statement after
+type queuedResponse struct {
+	after    int64
+	messages []pgproto.Message
+	// ready ends the response with a ReadyForQuery carrying the transaction status of the time it is sent
+	ready bool
+}
+
+func (s *Session) queuedMessages(r queuedResponse) []pgproto.Message {
+	if !r.ready {
+		return r.messages
+	}
+	return append(r.messages, &pgproto.ReadyForQuery{Status: pgproto.ReadyForQueryStatus(atomic.LoadInt32(&s.txStatus))})
+}
+
+// writeResponse writes the target's response up to the ReadyForQuery completing statement seq,
+// followed by the responses of the gateway queued behind it
+func (s *Session) writeResponse(msgs []pgproto.Message, seq int64) error {
+	s.responseMutex.Lock()
+	defer s.responseMutex.Unlock()
+	atomic.StoreInt64(&s.completedSeq, seq)
+	for len(s.queued) > 0 && s.queued[0].after <= seq {
+		msgs = append(msgs, s.queuedMessages(s.queued[0])...)
+		s.queued = s.queued[1:]
 	}
+	return s.writeMessagesToClient(msgs)
 }
 
-func (s *Session) proxyClientMessages(stop *sync.Cond, errs []error) {
-	for !s.stopped {
+// respond sends the client a response made up by the gateway, once the target answered the statements
+// sent before it. With ready set it ends with a ReadyForQuery.
+func (s *Session) respond(msgs []pgproto.Message, ready bool) error {
+	s.responseMutex.Lock()
+	defer s.responseMutex.Unlock()
+	r := queuedResponse{after: atomic.LoadInt64(&s.statementSeq), messages: msgs, ready: ready}
+	if atomic.LoadInt64(&s.completedSeq) < r.after {
+		s.queued = append(s.queued, r)
+		return nil
+	}
+	return s.writeMessagesToClient(s.queuedMessages(r))
+}
+
+func (s *Session) proxyClientMessages(ctx context.Context) error {
+	for ctx.Err() == nil {
 		msg, err := s.ParseClientRequest()
 		if err != nil {
-			errs = append(errs, err)
-			stop.Broadcast()
-			break
+			return err
+		}
+		s.clientActive()
+		switch msg.(type) {
+		case *pgproto.Parse, *pgproto.Bind, *pgproto.Describe, *pgproto.Execute, *pgproto.Close, *pgproto.Flush:
+			s.batchOpen = true
+		case *pgproto.Sync:
+			s.batchOpen = false
 		}
 
-		s.WriteToServer(msg)
+		s.traceStatement(msg)
+		s.trackStatement(msg)
+
+		msgs := []pgproto.ClientMessage{msg}
+		var cacheKey string
+		if s.cache != nil {
+			var served bool
+			served, msgs, cacheKey, err = s.serveFromCache(msg)
+			if err != nil {
+				return err
+			}
+			if served {
+				s.statementCached()
+				s.clientWaiting()
+				continue
+			}
+		}
+		for _, msg := range msgs {
+			err = s.forwardClientMessage(ctx, msg, cacheKey)
+			if err != nil {
+				return err
+			}
+		}
+		// The target runs an open batch's statements before its Sync, the session is not idle
+		if !s.batchOpen {
+			s.clientWaiting()
+		}
 
 		if _, ok := msg.(*pgproto.Termination); ok {
-			break
+			return nil
+		}
+	}
+	return nil
+}
+
+// forwardClientMessage sends msg to the target, storing the response under cacheKey when it is set
+func (s *Session) forwardClientMessage(ctx context.Context, msg pgproto.ClientMessage, cacheKey string) error {
+	forward, err := s.limitStatement(ctx, msg)
+	if !forward || err != nil {
+		return err
+	}
+	s.statementEvent(msg)
+
+	switch msg.(type) {
+	case *pgproto.SimpleQuery, *pgproto.Sync:
+		if cacheKey != "" {
+			s.expectCacheable(s.statementSeq+1, cacheKey)
+		}
+		s.statementSent()
+	}
+	// Hand the message to the mirror first, so it expects the primary's response in time
+	if s.mirror != nil {
+		s.mirror.enqueue(s.statementSeq+1, msg)
+	}
+	// Counted before it is sent, so its response never finds the session idle
+	switch msg.(type) {
+	case *pgproto.SimpleQuery, *pgproto.Sync:
+		atomic.AddInt64(&s.statementSeq, 1)
+	}
+	for _, t := range s.transformers {
+		if o, ok := t.(RequestObserver); ok {
+			o.ObserveRequest(msg)
 		}
 	}
+	// Recorded before it is sent so it always precedes the ReadyForQuery answering it,
+	// passwords exchanged by passthrough authentication must never end up in a capture
+	if _, ok := msg.(*pgproto.PasswordMessage); !ok {
+		s.recordCapture(CaptureClientMessage, msg)
+	}
+	return s.WriteToServer(msg)
 }
 
 func (s *Session) WriteToServer(msg pgproto.ClientMessage) error {
-	_, err := pgproto.WriteMessage(msg, s.target)
+	if m, ok := msg.(*pgproto.StartupMessage); ok && !m.SSLRequest {
+		s.targetUser, s.targetDatabase = string(m.Options["user"]), string(m.Options["database"])
+	}
+	n, err := pgproto.WriteMessage(msg, s.target)
+	atomic.AddInt64(&s.bytesToServer, int64(n))
 	return err
 }
 
 func (s *Session) WriteToClient(msg pgproto.ServerMessage) error {
-	_, err := pgproto.WriteMessage(msg, s.client)
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	n, err := pgproto.WriteMessage(msg, s.client)
+	atomic.AddInt64(&s.bytesToClient, int64(n))
+	return err
+}
+
+func (s *Session) writeMessagesToClient(msgs []pgproto.Message) error {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+	n, err := pgproto.WriteMessages(msgs, s.client)
+	atomic.AddInt64(&s.bytesToClient, int64(n))
 	return err
 }
 
+// BytesToServer is the number of bytes written to the target so far
+func (s *Session) BytesToServer() int64 {
+	return atomic.LoadInt64(&s.bytesToServer)
+}
+
+// BytesToClient is the number of bytes written to the client so far
+func (s *Session) BytesToClient() int64 {
+	return atomic.LoadInt64(&s.bytesToClient)
+}
+
+func (s *Session) recordCapture(kind byte, msg pgproto.Message) {
+	if s.capture == nil {
+		return
+	}
+	err := s.capture.record(kind, msg)
+	if err != nil {
+		s.plugins.LogError(s.loggingContext(), "error capturing message, capture disabled: %s", err)
+	}
+}
+
+func (s *Session) limiterKey() string {
+	return string(s.User) + "/" + string(s.Database)
+}
+
+// limitStatement applies the listener limits to msg, it returns false when msg must not be forwarded.
+// Simple queries are limited on their own, extended query batches as a whole from their first message,
+// as the target runs each message as soon as it arrives, up to the ReadyForQuery answering their Sync.
+func (s *Session) limitStatement(ctx context.Context, msg pgproto.ClientMessage) (bool, error) {
+	switch msg.(type) {
+	case *pgproto.SimpleQuery:
+	case *pgproto.Parse, *pgproto.Bind, *pgproto.Describe, *pgproto.Execute, *pgproto.Close:
+		if s.batchRejected != nil || s.batchAcquired {
+			return s.batchRejected == nil, nil
+		}
+		limitErr, err := s.acquireStatement(ctx, msg)
+		if err != nil {
+			return false, err
+		}
+		if limitErr == nil {
+			s.batchAcquired = true
+			return true, nil
+		}
+		// Like an error of the target, the rest of the batch is discarded up to its Sync
+		s.batchRejected = limitErr
+		return false, s.respond([]pgproto.Message{limitError(limitErr)}, false)
+	case *pgproto.Flush:
+		return s.batchRejected == nil, nil
+	case *pgproto.Sync:
+		if s.batchRejected != nil {
+			s.statementDone(s.batchRejected)
+			s.batchRejected = nil
+			return false, s.respond(nil, true)
+		}
+		if s.batchAcquired {
+			s.batchAcquired = false
+			return true, nil
+		}
+		// A Sync on its own is still answered by a ReadyForQuery, like a statement
+	default:
+		return true, nil
+	}
+
+	limitErr, err := s.acquireStatement(ctx, msg)
+	if limitErr == nil || err != nil {
+		return err == nil, err
+	}
+	s.statementDone(limitErr)
+	return false, s.respond([]pgproto.Message{limitError(limitErr)}, true)
+}
+
+// acquireStatement waits for the listener limits to allow forwarding msg, or returns why they don't
+// when they are set to fail fast
+func (s *Session) acquireStatement(ctx context.Context, msg pgproto.ClientMessage) (*LimitError, error) {
+	if s.limiter == nil || !s.limiter.Config().Enabled() {
+		return nil, nil
+	}
+
+	engaged, err := s.limiter.Acquire(ctx, s.limiterKey(), s.limiter.Config().FailFast)
+	if err == nil {
+		if engaged {
+			s.plugins.LogWarn(s.loggingContextWithMessage(msg), "statement delayed by limits")
+		}
+		atomic.AddInt32(&s.pending, 1)
+		return nil, nil
+	}
+	limitErr, ok := err.(*LimitError)
+	if !ok {
+		// The session or the listener is shutting down
+		return nil, err
+	}
+	s.plugins.LogWarn(s.loggingContextWithMessage(msg), "statement rejected by limits: %s", err)
+	return limitErr, nil
+}
+
+func limitError(err *LimitError) *pgproto.Error {
+	return &pgproto.Error{
+		Severity: []byte("ERROR"),
+		Code:     []byte(err.Code),
+		Message:  []byte(err.Error()),
+	}
+}
+
+func (s *Session) releaseStatement() {
+	if s.limiter == nil {
+		return
+	}
+	for {
+		n := atomic.LoadInt32(&s.pending)
+		if n <= 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&s.pending, n, n-1) {
+			s.limiter.Release(s.limiterKey())
+			return
+		}
+	}
+}
+
 func (s *Session) ParseClientRequest() (pgproto.ClientMessage, error) {
 	msg, err := pgproto.ParseClientMessage(s.client)
 	if err == io.EOF {
@@ -221,10 +674,11 @@ func (s *Session) ParseClientRequest() (pgproto.ClientMessage, error) {
 	}
 
 	if err != nil {
-		if !s.stopped {
+		if !s.isStopped() {
 			s.plugins.LogError(s.loggingContextWithMessage(msg), "error parsing client request: %s", err)
 		}
-	} else {
+	} else if s.plugins.LogEnabled("debug") {
+		// Building the context of every message is expensive
 		s.plugins.LogDebug(s.loggingContextWithMessage(msg), "client request")
 	}
 	return msg, err
@@ -235,12 +689,15 @@ func (s *Session) ParseServerResponse() (pgproto.ServerMessage, error) {
 	if err == io.EOF {
 		return msg, io.EOF
 	}
+	if m, ok := msg.(*pgproto.AuthenticationRequest); ok && m.Method == pgproto.AuthenticationMethodOK {
+		atomic.StoreInt32(&s.targetAuthenticated, 1)
+	}
 
 	if err != nil {
-		if !s.stopped {
+		if !s.isStopped() {
 			s.plugins.LogError(s.loggingContextWithMessage(msg), "error parsing server response: %s", err)
 		}
-	} else {
+	} else if s.plugins.LogEnabled("debug") {
 		s.plugins.LogDebug(s.loggingContextWithMessage(msg), "server response")
 	}
 	return msg, err
@@ -248,13 +705,13 @@ func (s *Session) ParseServerResponse() (pgproto.ServerMessage, error) {
 
 func (s *Session) loggingContext() LoggingContext {
 	var cRA, tRA string
-	if s.target != nil {
-		tRA = s.target.RemoteAddr().String()
+	if target := s.getTarget(); target != nil {
+		tRA = target.RemoteAddr().String()
 	}
 	if s.client != nil {
 		cRA = s.client.RemoteAddr().String()
 	}
-	return LoggingContext{
+	context := LoggingContext{
 		"session_id": s.ID,
 		"user":       string(s.User),
 		"database":   string(s.Database),
@@ -262,6 +719,16 @@ func (s *Session) loggingContext() LoggingContext {
 		"client":     cRA,
 		"target":     tRA,
 	}
+	if s.ServerName != "" {
+		context["server_name"] = s.ServerName
+	}
+	if s.Listener != "" {
+		context["listener"] = s.Listener
+	}
+	if s.IsReplication {
+		context["replication"] = true
+	}
+	return context
 }
 
 func (s *Session) loggingContextWithMessage(msg pgproto.Message) LoggingContext {
@@ -272,16 +739,43 @@ func (s *Session) loggingContextWithMessage(msg pgproto.Message) LoggingContext
 	return context
 }
 
+// codeInvalidAuthorization is the SQLSTATE of authentication failures
+const codeInvalidAuthorization = "28000"
+
+// WriteToClientEf sends the client a FATAL error and returns it, for authentication plugins to fail with
 func (s *Session) WriteToClientEf(format string, a ...interface{}) error {
-	return s.WriteToClientEf(format, a...)
+	reason := fmt.Sprintf(format, a...)
+	err := s.WriteToClient(&pgproto.Error{
+		Severity: []byte("FATAL"),
+		Code:     []byte(codeInvalidAuthorization),
+		Message:  []byte(reason),
+	})
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s", reason)
 }
+
 func (s *Session) ConnectToTarget(addr string) (err error) {
+	network := "tcp"
+	if IsUnixSocketPath(addr) {
+		network = "unix"
+	}
+	endSpan := s.startDialSpan(network, addr)
+	defer func() { endSpan(err) }()
 
-	s.target, err = net.Dial("tcp", addr)
+	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return err
 	}
-	if s.IsSSL {
+	return s.upgradeTarget(conn)
+}
+
+// upgradeTarget sets conn as the target, negotiating SSL when the client session uses SSL
+func (s *Session) upgradeTarget(conn net.Conn) (err error) {
+	s.setTarget(conn)
+	// PostgreSQL does not support SSL over Unix domain sockets
+	if _, isUnix := conn.(*net.UnixConn); s.IsSSL && !isUnix {
 		err = s.WriteToServer(&pgproto.SSLRequest{})
 		if err != nil {
 			return fmt.Errorf("error writing SSLRequest to server: %s", err)
@@ -290,7 +784,7 @@ func (s *Session) ConnectToTarget(addr string) (err error) {
 		if err != nil {
 			return fmt.Errorf("server does not support SSL: %s", err)
 		}
-		s.target = tls.Client(s.target, &tls.Config{InsecureSkipVerify: true})
+		s.setTarget(tls.Client(s.target, &tls.Config{InsecureSkipVerify: true}))
 	}
 
 	return nil
@@ -452,6 +946,25 @@ func (s *Session) GetPasswordMessageFromClient(auth *pgproto.AuthenticationReque
 	return pwdMsg.BodyMessage, nil
 }
 
+// TLSConnectionState returns the state of the client's SSL connection, nil for clients not using SSL
+func (s *Session) TLSConnectionState() *tls.ConnectionState {
+	sslClient, ok := s.client.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := sslClient.ConnectionState()
+	return &state
+}
+
+// targetIdentity names the target the session is connected to, and its user and database there
+func (s *Session) targetIdentity() string {
+	var addr string
+	if target := s.getTarget(); target != nil {
+		addr = target.RemoteAddr().String()
+	}
+	return addr + "\x00" + s.targetUser + "\x00" + s.targetDatabase
+}
+
 func (s *Session) GetStartup() *pgproto.StartupMessage {
 	return s.startup
 }
@@ -460,7 +973,55 @@ func (s *Session) generateSalt() {
 	s.salt = generateSalt()
 }
 
+// DialTarget connects to the target, announcing the client with a PROXY header when configured
+func (s *Session) DialTarget(target TargetConfig) (err error) {
+	network, addr := "tcp", net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+	if IsUnixSocketPath(target.Host) {
+		network, addr = "unix", UnixSocketPath(target.Host, target.Port)
+	}
+	endSpan := s.startDialSpan(network, addr)
+	defer func() { endSpan(err) }()
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return err
+	}
+	if target.ProxyProtocol != "" {
+		err = writeProxyHeader(conn, target.ProxyProtocol, s.client.RemoteAddr(), s.client.LocalAddr())
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if target.SSLNegotiation == "direct" {
+		return s.directSSLTarget(conn)
+	}
+	return s.upgradeTarget(conn)
+}
+
+// directSSLTarget starts TLS straight away, as with sslnegotiation=direct, when the client session uses SSL
+func (s *Session) directSSLTarget(conn net.Conn) error {
+	s.setTarget(conn)
+	if _, isUnix := conn.(*net.UnixConn); !s.IsSSL || isUnix {
+		return nil
+	}
+
+	sslTarget := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{alpnProtocol},
+	})
+	err := sslTarget.Handshake()
+	if err != nil {
+		return fmt.Errorf("direct SSL handshake with server failed: %s", err)
+	}
+	s.setTarget(sslTarget)
+	return nil
+}
+
 func (s *Session) DialToS(host string, port int) error {
+	if IsUnixSocketPath(host) {
+		return s.ConnectToTarget(UnixSocketPath(host, port))
+	}
 	addr := net.JoinHostPort(host, strconv.Itoa(port))
 	return s.ConnectToTarget(addr)
 }
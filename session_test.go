@@ -0,0 +1,170 @@
+package pggateway_test
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pgproto"
+)
+
+// TestInspectedSessionsStress runs concurrent inspected sessions, hung up on by clients and targets
+// mid-statement, for the race detector to check the session's goroutines and shared state
+func TestInspectedSessionsStress(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	srv.SetResult("SELECT slow", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}, Delay: 50 * time.Millisecond})
+	srv.SetResult("SELECT disconnect", pgtest.Result{Disconnect: true})
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Hooks:          map[string]interface{}{"recorder": ""},
+		Timeouts:       pggateway.TimeoutsConfig{Idle: time.Minute, Session: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-recorders
+
+	const sessions = 60
+	var open sync.WaitGroup
+	errs := make(chan error, sessions)
+	for i := 0; i < sessions; i++ {
+		open.Add(1)
+		go func(i int) {
+			conn, err := net.Dial("tcp", gw.Addr())
+			if err != nil {
+				errs <- err
+				open.Done()
+				return
+			}
+			defer conn.Close()
+			client, err := pgtest.ConnectConn(conn, "stress", "", "stress")
+			open.Done()
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- stressSession(i, conn, client)
+		}(i)
+	}
+
+	// Every fourth session is still open when the gateway closes
+	open.Wait()
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < sessions-sessions/4; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-timeout:
+			t.Fatalf("%d sessions did not end", sessions-sessions/4-i)
+		}
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- gw.Close()
+	}()
+	for i := 0; i < sessions/4; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-timeout:
+			t.Fatalf("%d sessions still open after the gateway closed", sessions/4-i)
+		}
+	}
+	select {
+	case <-closed:
+	case <-timeout:
+		t.Fatal("the gateway did not close")
+	}
+
+	ended := 0
+	for _, e := range r.recorded() {
+		if e.Type == pggateway.SessionClose {
+			ended++
+		}
+	}
+	if ended != sessions {
+		t.Fatalf("expected %d sessions to end, got %d", sessions, ended)
+	}
+}
+
+// stressSession runs statements on client, then ends the session the way i selects
+func stressSession(i int, conn net.Conn, client *pgtest.Client) error {
+	_, err := client.Query("SELECT 1")
+	if err != nil {
+		return err
+	}
+	err = client.Send(
+		&pgproto.Parse{Query: []byte("SELECT 1")}, &pgproto.Bind{}, &pgproto.Execute{}, &pgproto.Sync{},
+		&pgproto.Parse{Query: []byte("SELECT slow")}, &pgproto.Bind{}, &pgproto.Execute{}, &pgproto.Sync{},
+	)
+	if err != nil {
+		return err
+	}
+
+	switch i % 4 {
+	case 0:
+		// The client hangs up mid-statement, the target is still answering
+		return conn.Close()
+	case 1:
+		// The target hangs up mid-session
+		err = receiveReady(client, 2)
+		if err != nil {
+			return err
+		}
+		_, err = client.Query("SELECT disconnect")
+		if err == nil {
+			return fmt.Errorf("query succeeded after the target disconnected")
+		}
+		return nil
+	case 2:
+		// A clean Terminate
+		err = receiveReady(client, 2)
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+
+	// The gateway ends the session on Close, answered or not
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, err = client.Receive()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return fmt.Errorf("session not ended when the gateway closed")
+			}
+			return nil
+		}
+	}
+}
+
+// receiveReady reads messages up to the count-th ReadyForQuery
+func receiveReady(client *pgtest.Client, count int) error {
+	for count > 0 {
+		msg, err := client.Receive()
+		if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case *pgproto.Error:
+			return fmt.Errorf("%s", m.Message)
+		case *pgproto.ReadyForQuery:
+			count--
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package pggateway
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SSLCertificateConfig is a certificate presented to clients asking for one of Hosts
+type SSLCertificateConfig struct {
+	Hosts       []string `yaml:"hosts,omitempty"`
+	Certificate string   `yaml:"certificate,omitempty"`
+	Key         string   `yaml:"key,omitempty"`
+}
+
+// RouteConfig selects the authentication configuration for SSL sessions by TLS server name.
+// Routes only override the listener's authentication plugins, the target is the one those plugins dial.
+type RouteConfig struct {
+	ServerName     string                 `yaml:"server_name,omitempty"`
+	Authentication map[string]interface{} `yaml:"authentication,omitempty"`
+	// Replication and ReplicationUsers override the listener's when set
+	Replication      *bool    `yaml:"replication,omitempty"`
+	ReplicationUsers []string `yaml:"replication_users,omitempty"`
+}
+
+type listenerRoute struct {
+	config  *RouteConfig
+	plugins *PluginRegistry
+}
+
+// MatchServerName reports whether name matches pattern, which may start with a `*.` wildcard label
+func MatchServerName(pattern string, name string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if pattern == name {
+		return true
+	}
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+	label := strings.TrimSuffix(name, pattern[1:])
+	return label != name && label != "" && !strings.Contains(label, ".")
+}
+
+func (l *Listener) setupRoutes() error {
+	l.routes = make([]*listenerRoute, 0, len(l.config.Routes))
+	for _, route := range l.config.Routes {
+		if route.ServerName == "" {
+			return fmt.Errorf("route is missing a server_name")
+		}
+		plugins, err := l.plugins.withAuthentication(route.Authentication)
+		if err != nil {
+			return err
+		}
+		l.routes = append(l.routes, &listenerRoute{config: route, plugins: plugins})
+	}
+	return nil
+}
+
+// routeForServerName returns the first route matching serverName, nil when the listener's defaults apply
+func (l *Listener) routeForServerName(serverName string) *listenerRoute {
+	if serverName == "" {
+		return nil
+	}
+	for _, route := range l.routes {
+		if MatchServerName(route.config.ServerName, serverName) {
+			return route
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package pggateway_test
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+)
+
+func TestMatchServerName(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"db.example.com", "db.example.com", true},
+		{"db.example.com", "DB.Example.com.", true},
+		{"db.example.com", "other.example.com", false},
+		{"*.example.com", "db.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.db.example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "db.example.org", false},
+	}
+	for _, test := range tests {
+		if match := pggateway.MatchServerName(test.pattern, test.name); match != test.match {
+			t.Errorf("MatchServerName(%q, %q) = %v, expected %v", test.pattern, test.name, match, test.match)
+		}
+	}
+}
+
+func TestSNIRoutes(t *testing.T) {
+	defaultSrv, tenantSrv, wildcardSrv := newSSLServer(t), newSSLServer(t), newSSLServer(t)
+	dir := t.TempDir()
+	defaultCert, defaultKey := writeCertificate(t, dir, "default", "localhost")
+	tenantCert, tenantKey := writeCertificate(t, dir, "tenant", "tenant.example.com")
+	wildcardCert, wildcardKey := writeCertificate(t, dir, "wildcard", "*.example.com")
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		SSL: pggateway.SSLConfig{
+			Enabled:     true,
+			Certificate: defaultCert,
+			Key:         defaultKey,
+			Certificates: []pggateway.SSLCertificateConfig{
+				{Hosts: []string{"tenant.example.com"}, Certificate: tenantCert, Key: tenantKey},
+				{Hosts: []string{"*.example.com"}, Certificate: wildcardCert, Key: wildcardKey},
+			},
+		},
+		Authentication: passthrough(defaultSrv),
+		Routes: []*pggateway.RouteConfig{
+			{ServerName: "tenant.example.com", Authentication: passthrough(tenantSrv)},
+			{ServerName: "*.example.com", Authentication: passthrough(wildcardSrv)},
+		},
+		Hooks: map[string]interface{}{"recorder": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+	r := <-recorders
+
+	tests := []struct {
+		serverName string
+		cert       string
+		srv        *pgtest.Server
+	}{
+		{"tenant.example.com", "tenant", tenantSrv},
+		{"other.example.com", "wildcard", wildcardSrv},
+		{"localhost", "default", defaultSrv},
+		// Without SNI the listener's defaults apply
+		{"", "default", defaultSrv},
+	}
+	for _, test := range tests {
+		conn, err := dialSSL(gw.Addr(), &tls.Config{InsecureSkipVerify: true, ServerName: test.serverName}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != test.cert {
+			t.Errorf("server name %q got the %s certificate, expected %s", test.serverName, cn, test.cert)
+		}
+		client, err := pgtest.ConnectConn(conn, "app", "", "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := len(test.srv.Queries())
+		_, err = client.Query("SELECT 1")
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(test.srv.Queries()) != before+1 {
+			t.Errorf("server name %q was not routed to its target", test.serverName)
+		}
+	}
+
+	var names []string
+	for _, e := range r.recorded() {
+		if e.Type == pggateway.SessionConnect {
+			names = append(names, e.Session.ServerName)
+		}
+	}
+	if len(names) != len(tests) {
+		t.Fatalf("expected %d sessions, got %v", len(tests), names)
+	}
+	for i, test := range tests {
+		if names[i] != test.serverName {
+			t.Errorf("session %d has server name %q, expected %q", i, names[i], test.serverName)
+		}
+	}
+}
+
+func TestSNIRoutesRequireServerName(t *testing.T) {
+	srv := newSSLServer(t)
+	_, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Routes:         []*pggateway.RouteConfig{{Authentication: passthrough(srv)}},
+	})
+	if err == nil {
+		t.Fatal("expected a route without a server_name to be refused")
+	}
+}
@@ -0,0 +1,180 @@
+package pggateway_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+)
+
+// writeCertificate writes a self-signed certificate for hosts and its key to dir,
+// returning their paths
+func writeCertificate(t *testing.T, dir string, name string, hosts ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// newSSLServer starts a fake server accepting SSL, which the gateway requires of the targets of SSL sessions
+func newSSLServer(t *testing.T) *pgtest.Server {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	cert, err := tls.LoadX509KeyPair(writeCertificate(t, t.TempDir(), "target", "localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	return srv
+}
+
+// dialSSL starts TLS on a new connection to addr, with an SSLRequest first unless direct is set
+func dialSSL(addr string, config *tls.Config, direct bool) (*tls.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if !direct {
+		_, err = conn.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f})
+		if err == nil {
+			var resp [1]byte
+			_, err = conn.Read(resp[:])
+			if err == nil && resp[0] != 'S' {
+				err = errors.New("server does not support SSL")
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	sslConn := tls.Client(conn, config)
+	err = sslConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return sslConn, nil
+}
+
+func TestDirectSSL(t *testing.T) {
+	// SSL sessions are proxied to the target over SSL as well, here negotiated directly
+	srv := newSSLServer(t)
+	certFile, keyFile := writeCertificate(t, t.TempDir(), "gateway", "localhost")
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		SSL: pggateway.SSLConfig{Enabled: true, Certificate: certFile, Key: keyFile},
+		Authentication: map[string]interface{}{
+			"passthrough": map[string]interface{}{
+				"target": map[string]interface{}{"host": srv.Host(), "port": srv.Port(), "sslnegotiation": "direct"},
+			},
+		},
+		Hooks: map[string]interface{}{"recorder": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+	r := <-recorders
+
+	for _, direct := range []bool{true, false} {
+		conn, err := dialSSL(gw.Addr(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"postgresql"}}, direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "postgresql" {
+			t.Fatalf("expected the postgresql ALPN protocol, got %q", protocol)
+		}
+		client, err := pgtest.ConnectConn(conn, "app", "", "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := client.Query("SELECT 1")
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 || rows[0][0] != "1" {
+			t.Fatalf("unexpected rows %v", rows)
+		}
+	}
+	for _, e := range r.recorded() {
+		if e.Type == pggateway.SessionConnect && !e.Session.SSL {
+			t.Fatalf("session not marked as SSL %+v", e.Session)
+		}
+	}
+
+	// Like PostgreSQL, direct SSL without ALPN is refused, it might be another protocol
+	conn, err := dialSSL(gw.Addr(), &tls.Config{InsecureSkipVerify: true}, true)
+	if err == nil {
+		defer conn.Close()
+		_, err = pgtest.ConnectConn(conn, "app", "", "app")
+	}
+	if err == nil {
+		t.Fatal("expected direct SSL without ALPN to be refused")
+	}
+}
+
+func TestDirectSSLDisabled(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{Authentication: passthrough(srv)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	_, err = dialSSL(gw.Addr(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"postgresql"}}, true)
+	if err == nil {
+		t.Fatal("expected direct SSL to be refused without SSL enabled")
+	}
+}
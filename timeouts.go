@@ -0,0 +1,202 @@
+package pggateway
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c653labs/pgproto"
+)
+
+const (
+	authTimeoutMessage = "terminating connection due to authentication timeout"
+	// SQLSTATEs of the FATAL errors sent when a timeout expires
+	codeProtocolViolation        = "08P01"
+	codeAdminShutdown            = "57P01"
+	codeIdleSessionTimeout       = "57P05"
+	codeIdleInTransactionTimeout = "25P03"
+)
+
+// TimeoutsConfig
+type TimeoutsConfig struct {
+	Idle              time.Duration `yaml:"idle,omitempty"`
+	IdleInTransaction time.Duration `yaml:"idle_in_transaction,omitempty"`
+	Session           time.Duration `yaml:"session,omitempty"`
+	Authentication    time.Duration `yaml:"authentication,omitempty"`
+}
+
+// startTimeouts arms the authentication and session lifetime timers
+func (s *Session) startTimeouts(authRemaining time.Duration) {
+	s.timerMutex.Lock()
+	defer s.timerMutex.Unlock()
+
+	if s.timeouts.Authentication > 0 {
+		if authRemaining <= 0 {
+			authRemaining = time.Millisecond
+		}
+		s.authTimer = time.AfterFunc(authRemaining, func() {
+			s.expire(codeProtocolViolation, authTimeoutMessage)
+		})
+	}
+	if s.timeouts.Session > 0 {
+		s.sessionTimer = time.AfterFunc(s.timeouts.Session, func() {
+			s.expire(codeAdminShutdown, "terminating connection due to maximum session age")
+		})
+	}
+}
+
+// HasIdleTimeouts reports whether the timeouts need statements to be inspected to work
+func (c TimeoutsConfig) HasIdleTimeouts() bool {
+	return c.Idle > 0 || c.IdleInTransaction > 0
+}
+
+func (s *Session) stopAuthTimeout() {
+	s.timerMutex.Lock()
+	defer s.timerMutex.Unlock()
+	if s.authTimer != nil {
+		s.authTimer.Stop()
+		s.authTimer = nil
+	}
+}
+
+// armIdleTimeout starts the idle timer matching the transaction status the server reported,
+// the caller holds timerMutex
+func (s *Session) armIdleTimeout(status pgproto.ReadyForQueryStatus) {
+	timeout := s.timeouts.Idle
+	code, reason := codeIdleSessionTimeout, "terminating connection due to idle timeout"
+	switch byte(status) {
+	case 'T', 'E':
+		timeout = s.timeouts.IdleInTransaction
+		code, reason = codeIdleInTransactionTimeout, "terminating connection due to idle-in-transaction timeout"
+	}
+
+	s.stopIdleTimer()
+	if timeout > 0 {
+		s.idleTimer = time.AfterFunc(timeout, func() {
+			s.expire(code, reason)
+		})
+	}
+}
+
+// stopIdleTimer stops the idle timer, the caller holds timerMutex
+func (s *Session) stopIdleTimer() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+}
+
+// clientActive stops the idle timer as a client message arrives. Until clientWaiting the session is busy,
+// so the target answering the statements before can't find it idle while the message is on its way.
+func (s *Session) clientActive() {
+	s.timerMutex.Lock()
+	defer s.timerMutex.Unlock()
+	s.clientBusy = true
+	s.stopIdleTimer()
+}
+
+// clientWaiting ends clientActive once the statement was counted in statementSeq or answered by the gateway,
+// arming the idle timer when the target already answered every statement
+func (s *Session) clientWaiting() {
+	s.timerMutex.Lock()
+	defer s.timerMutex.Unlock()
+	s.clientBusy = false
+	if atomic.LoadInt64(&s.completedSeq) >= atomic.LoadInt64(&s.statementSeq) {
+		s.armIdleTimeout(pgproto.ReadyForQueryStatus(atomic.LoadInt32(&s.txStatus)))
+	}
+}
+
+// targetReady arms the idle timer once the target answered statement seq,
+// unless statements are still running or the client is sending the next one
+func (s *Session) targetReady(seq int64, status pgproto.ReadyForQueryStatus) {
+	s.timerMutex.Lock()
+	defer s.timerMutex.Unlock()
+	if !s.clientBusy && seq >= atomic.LoadInt64(&s.statementSeq) {
+		s.armIdleTimeout(status)
+	}
+}
+
+func (s *Session) stopTimeouts() {
+	s.stopAuthTimeout()
+
+	s.timerMutex.Lock()
+	defer s.timerMutex.Unlock()
+	s.stopIdleTimer()
+	if s.sessionTimer != nil {
+		s.sessionTimer.Stop()
+		s.sessionTimer = nil
+	}
+}
+
+// expire sends a FATAL error with SQLSTATE code to the client and tears down both connections
+func (s *Session) expire(code string, reason string) {
+	s.plugins.LogWarn(s.loggingContext(), reason)
+
+	s.client.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = s.WriteToClient(timeoutError(code, reason))
+
+	s.stop()
+}
+
+func timeoutError(code string, reason string) *pgproto.Error {
+	return &pgproto.Error{
+		Severity: []byte("FATAL"),
+		Code:     []byte(code),
+		Message:  []byte(reason),
+	}
+}
+
+// startupTimeout closes clients that don't get as far as a session before the authentication timeout,
+// sending them a FATAL error whenever the connection is in a state to carry one
+type startupTimeout struct {
+	mutex sync.Mutex
+	raw   net.Conn
+	// conn is where the error is written, nil while SSL is being negotiated
+	conn    net.Conn
+	timer   *time.Timer
+	stopped bool
+}
+
+// startStartupTimeout returns nil when there is no timeout, which the methods accept
+func startStartupTimeout(client net.Conn, timeout time.Duration) *startupTimeout {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &startupTimeout{raw: client, conn: client}
+	t.timer = time.AfterFunc(timeout, t.expire)
+	return t
+}
+
+func (t *startupTimeout) expire() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stopped {
+		return
+	}
+	if t.conn != nil {
+		t.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_, _ = pgproto.WriteMessage(timeoutError(codeProtocolViolation, authTimeoutMessage), t.conn)
+	}
+	t.raw.Close()
+}
+
+// setConn switches the connection errors are written to, e.g. once SSL is established
+func (t *startupTimeout) setConn(conn net.Conn) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	t.conn = conn
+	t.mutex.Unlock()
+}
+
+func (t *startupTimeout) stop() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	t.stopped = true
+	t.mutex.Unlock()
+	t.timer.Stop()
+}
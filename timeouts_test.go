@@ -0,0 +1,157 @@
+package pggateway_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pgproto"
+)
+
+func startTimeoutGateway(t *testing.T, timeouts pggateway.TimeoutsConfig) (*pgtest.Server, *pgtest.Gateway) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+	srv.SetResult("SELECT slow", pgtest.Result{Columns: []string{"slow"}, Rows: [][]string{{"done"}}, Delay: 300 * time.Millisecond})
+	srv.SetResult("BEGIN", pgtest.Result{Tag: "BEGIN"})
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: passthrough(srv),
+		Timeouts:       timeouts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { gw.Close() })
+	return srv, gw
+}
+
+// expectTermination waits for the FATAL error ending the session, returning how long it took
+func expectTermination(t *testing.T, client *pgtest.Client, code string) time.Duration {
+	start := time.Now()
+	for {
+		msg, err := client.Receive()
+		if err != nil {
+			t.Fatalf("session ended without a FATAL error: %s", err)
+		}
+		if m, ok := msg.(*pgproto.Error); ok {
+			if string(m.Severity) != "FATAL" || string(m.Code) != code {
+				t.Fatalf("expected a FATAL %s error, got %s %s: %s", code, m.Severity, m.Code, m.Message)
+			}
+			return time.Since(start)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	_, gw := startTimeoutGateway(t, pggateway.TimeoutsConfig{Idle: 100 * time.Millisecond})
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Statements running for longer than the timeout don't leave the session idle,
+	// neither do pipelined ones answered while the next one runs
+	for i := 0; i < 3; i++ {
+		err = client.Send(
+			&pgproto.SimpleQuery{Query: []byte("SELECT 1")},
+			&pgproto.SimpleQuery{Query: []byte("SELECT slow")},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ready := 0; ready < 2; {
+			msg, err := client.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch m := msg.(type) {
+			case *pgproto.Error:
+				t.Fatalf("running statement ended by %s", m.Message)
+			case *pgproto.ReadyForQuery:
+				ready++
+			}
+		}
+	}
+
+	if took := expectTermination(t, client, "57P05"); took > time.Second {
+		t.Fatalf("idle session terminated after %s", took)
+	}
+}
+
+func TestIdleInTransactionTimeout(t *testing.T) {
+	_, gw := startTimeoutGateway(t, pggateway.TimeoutsConfig{Idle: time.Minute, IdleInTransaction: 100 * time.Millisecond})
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The idle timeout applies outside of transactions
+	time.Sleep(200 * time.Millisecond)
+	_, err = client.Query("BEGIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Query("SELECT slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTermination(t, client, "25P03")
+}
+
+func TestSessionTimeout(t *testing.T) {
+	_, gw := startTimeoutGateway(t, pggateway.TimeoutsConfig{Session: 200 * time.Millisecond})
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTermination(t, client, "57P01")
+}
+
+func TestAuthenticationTimeout(t *testing.T) {
+	_, gw := startTimeoutGateway(t, pggateway.TimeoutsConfig{Authentication: 100 * time.Millisecond})
+
+	// A client that never sends its startup message
+	conn, err := net.Dial("tcp", gw.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := pgproto.ParseServerMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := msg.(*pgproto.Error)
+	if !ok || string(m.Code) != "08P01" || !strings.Contains(string(m.Message), "authentication timeout") {
+		t.Fatalf("expected an authentication timeout error, got %v", msg)
+	}
+
+	// Sessions authenticated in time are not affected
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	time.Sleep(200 * time.Millisecond)
+	_, err = client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package pggateway
+
+import (
+	"strings"
+)
+
+// TokenKind is the kind of a SQL token
+type TokenKind int
+
+const (
+	// TokenWord is a keyword or unquoted identifier
+	TokenWord TokenKind = iota
+	// TokenQuotedIdentifier is a double quoted identifier, quotes included
+	TokenQuotedIdentifier
+	// TokenString is a string literal, with its E, B, X or N prefix, or a dollar-quoted literal
+	TokenString
+	// TokenNumber is a numeric literal
+	TokenNumber
+	// TokenParameter is a positional parameter such as $1
+	TokenParameter
+	// TokenComment is a -- or, possibly nested, /* */ comment
+	TokenComment
+	// TokenSpace is a run of whitespace
+	TokenSpace
+	// TokenPunctuation is any other single byte, such as ;, ( or an operator character
+	TokenPunctuation
+)
+
+// Token is a lexical token of a SQL query
+type Token struct {
+	Kind TokenKind
+	// Text is the token as written, the tokens of a query concatenate back to it
+	Text string
+}
+
+// Tokenize splits query into tokens the way PostgreSQL's lexer does, well enough to tell keywords
+// and identifiers from literals and comments, an unterminated literal or comment runs to the end
+func Tokenize(query string) []Token {
+	var tokens []Token
+	for i := 0; i < len(query); {
+		kind, end := nextToken(query, i)
+		tokens = append(tokens, Token{Kind: kind, Text: query[i:end]})
+		i = end
+	}
+	return tokens
+}
+
+// nextToken returns the kind of the token starting at query[start], and the index just past it
+func nextToken(query string, start int) (TokenKind, int) {
+	ch := query[start]
+	switch {
+	case isSpace(ch):
+		end := start + 1
+		for end < len(query) && isSpace(query[end]) {
+			end++
+		}
+		return TokenSpace, end
+	case ch == '\'':
+		return TokenString, quotedEnd(query, start, false)
+	case ch == '"':
+		return TokenQuotedIdentifier, quotedEnd(query, start, false)
+	case strings.HasPrefix(query[start:], "--"):
+		end := strings.IndexByte(query[start:], '\n')
+		if end < 0 {
+			return TokenComment, len(query)
+		}
+		return TokenComment, start + end
+	case strings.HasPrefix(query[start:], "/*"):
+		return TokenComment, commentEnd(query, start)
+	case ch == '$':
+		if tag := dollarTag(query[start:]); tag != "" {
+			end := strings.Index(query[start+len(tag):], tag)
+			if end < 0 {
+				return TokenString, len(query)
+			}
+			return TokenString, start + len(tag) + end + len(tag)
+		}
+		end := start + 1
+		for end < len(query) && isDigit(query[end]) {
+			end++
+		}
+		if end > start+1 {
+			return TokenParameter, end
+		}
+		return TokenPunctuation, end
+	case isDigit(ch) || ch == '.' && start+1 < len(query) && isDigit(query[start+1]):
+		return TokenNumber, numberEnd(query, start)
+	case isIdentStart(ch):
+		end := start + 1
+		for end < len(query) && isIdentChar(query[end]) {
+			end++
+		}
+		// Prefixed strings, only E'' strings escape quotes with backslashes
+		if end == start+1 && end < len(query) && query[end] == '\'' && strings.IndexByte("EeBbXxNn", ch) >= 0 {
+			return TokenString, quotedEnd(query, end, ch == 'E' || ch == 'e')
+		}
+		return TokenWord, end
+	}
+	return TokenPunctuation, start + 1
+}
+
+// quotedEnd returns the index just past the string or quoted identifier starting at query[start],
+// doubled quotes are part of it
+func quotedEnd(query string, start int, escapes bool) int {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case escapes && query[i] == '\\':
+			i++
+		case query[i] == quote && i+1 < len(query) && query[i+1] == quote:
+			i++
+		case query[i] == quote:
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// commentEnd returns the index just past the, possibly nested, block comment starting at query[start]
+func commentEnd(query string, start int) int {
+	depth := 0
+	for i := start; i < len(query)-1; i++ {
+		switch query[i : i+2] {
+		case "/*":
+			depth++
+			i++
+		case "*/":
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(query)
+}
+
+// dollarTag returns the opening tag of a dollar-quoted literal at the start of s, such as $$ or $body$
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '$':
+			return s[:i+1]
+		case isDigit(ch) && i == 1, !isIdentChar(ch):
+			// $1 is a parameter
+			return ""
+		}
+	}
+	return ""
+}
+
+// numberEnd returns the index just past the number starting at query[start], e.g. 42, 1.5 or 2e-3
+func numberEnd(query string, start int) int {
+	end := start
+	for end < len(query) && (isDigit(query[end]) || query[end] == '.') {
+		end++
+	}
+	if end < len(query) && (query[end] == 'e' || query[end] == 'E') {
+		exp := end + 1
+		if exp < len(query) && (query[exp] == '+' || query[exp] == '-') {
+			exp++
+		}
+		if exp < len(query) && isDigit(query[exp]) {
+			end = exp
+			for end < len(query) && isDigit(query[end]) {
+				end++
+			}
+		}
+	}
+	return end
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f'
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func isIdentStart(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= 0x80
+}
+
+func isIdentChar(ch byte) bool {
+	return isIdentStart(ch) || ch == '$' || isDigit(ch)
+}
@@ -0,0 +1,70 @@
+package pggateway_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+)
+
+func TestTokenize(t *testing.T) {
+	const (
+		word    = pggateway.TokenWord
+		quoted  = pggateway.TokenQuotedIdentifier
+		str     = pggateway.TokenString
+		number  = pggateway.TokenNumber
+		param   = pggateway.TokenParameter
+		comment = pggateway.TokenComment
+		space   = pggateway.TokenSpace
+		punct   = pggateway.TokenPunctuation
+	)
+	tests := []struct {
+		query  string
+		tokens []pggateway.Token
+	}{
+		{"SELECT a1, \"B;c\"", []pggateway.Token{
+			{word, "SELECT"}, {space, " "}, {word, "a1"}, {punct, ","}, {space, " "}, {quoted, `"B;c"`},
+		}},
+		{"'it''s;' E'\\';' x'ff' 1.5e-3 .5 $1", []pggateway.Token{
+			{str, "'it''s;'"}, {space, " "}, {str, `E'\';'`}, {space, " "}, {str, "x'ff'"}, {space, " "},
+			{number, "1.5e-3"}, {space, " "}, {number, ".5"}, {space, " "}, {param, "$1"},
+		}},
+		{"$$a;b$$ $body$ $$ ; $body$ a$b$", []pggateway.Token{
+			{str, "$$a;b$$"}, {space, " "}, {str, "$body$ $$ ; $body$"}, {space, " "}, {word, "a$b$"},
+		}},
+		{"-- a;b\n/* x /* y; */ z */;", []pggateway.Token{
+			{comment, "-- a;b"}, {space, "\n"}, {comment, "/* x /* y; */ z */"}, {punct, ";"},
+		}},
+		// Unterminated literals and comments run to the end
+		{"SELECT 'a; /* b", []pggateway.Token{{word, "SELECT"}, {space, " "}, {str, "'a; /* b"}}},
+		{"SELECT /* 'a", []pggateway.Token{{word, "SELECT"}, {space, " "}, {comment, "/* 'a"}}},
+	}
+	for _, test := range tests {
+		tokens := pggateway.Tokenize(test.query)
+		if !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("%q: got tokens %v, expected %v", test.query, tokens, test.tokens)
+		}
+		var text strings.Builder
+		for _, token := range tokens {
+			text.WriteString(token.Text)
+		}
+		if text.String() != test.query {
+			t.Errorf("%q: tokens concatenate to %q", test.query, text.String())
+		}
+	}
+}
+
+func TestSanitizeQuery(t *testing.T) {
+	queries := map[string]string{
+		"SELECT *\n  FROM users WHERE id = 42;":         "SELECT * FROM users WHERE id = ?",
+		"SELECT E'it\\'s', $tag$secret$tag$, $1, t1.c2": "SELECT ?, ?, $1, t1.c2",
+		"/* it's */ SELECT 1--secret":                   "SELECT ?",
+		"SELECT/*x*/1":                                  "SELECT ?",
+	}
+	for query, want := range queries {
+		if got := pggateway.SanitizeQuery(query); got != want {
+			t.Errorf("%q sanitized to %q, expected %q", query, got, want)
+		}
+	}
+}
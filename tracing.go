@@ -0,0 +1,327 @@
+package pggateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c653labs/pgproto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/c653labs/pggateway"
+
+var (
+	// application_name may be set to a bare W3C traceparent, or contain one
+	traceparentPattern = regexp.MustCompile(`\b[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}\b`)
+	// sqlcommenter comments look like /*traceparent='00-...-01'*/
+	sqlcommenterPattern = regexp.MustCompile(`/\*.*\btraceparent='([0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2})'.*\*/`)
+)
+
+// TracingConfig
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Exporter is "otlp", the default, or "stdout"
+	Exporter    string   `yaml:"exporter,omitempty"`
+	Endpoint    string   `yaml:"endpoint,omitempty"`
+	Insecure    bool     `yaml:"insecure,omitempty"`
+	ServiceName string   `yaml:"service_name,omitempty"`
+	SampleRatio *float64 `yaml:"sample_ratio,omitempty"`
+}
+
+// SetupTracing installs the global tracer provider described by config,
+// the returned function flushes and stops it
+func SetupTracing(config TracingConfig) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "", "otlp":
+		var opts []otlptracegrpc.Option
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(context.Background(), opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", config.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = "pggateway"
+	}
+	sampler := sdktrace.AlwaysSample()
+	if config.SampleRatio != nil {
+		sampler = sdktrace.TraceIDRatioBased(*config.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// tracer uses the global provider, so tests may install their own
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// extractTraceparent returns ctx with the remote span context of traceparent, if it is valid
+func extractTraceparent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func serverAttributes(network string, addr string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("network.transport", network)}
+	if network == "unix" {
+		return append(attrs, attribute.String("server.address", addr))
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return append(attrs, attribute.String("server.address", addr))
+	}
+	return append(attrs, attribute.String("server.address", host), attribute.String("server.port", port))
+}
+
+// startSessionSpan starts the span covering the whole session since it was accepted,
+// joining the trace in the client's application_name if there is one
+func (s *Session) startSessionSpan(ctx context.Context, accepted time.Time) trace.Span {
+	if s.startup != nil {
+		ctx = extractTraceparent(ctx, traceparentPattern.FindString(string(s.startup.Options["application_name"])))
+	}
+
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.namespace", string(s.Database)),
+		attribute.String("db.user", string(s.User)),
+		attribute.String("pggateway.session.id", s.ID),
+		attribute.Bool("pggateway.ssl", s.IsSSL),
+	}
+	if s.client != nil {
+		attrs = append(attrs, attribute.String("client.address", s.client.RemoteAddr().String()))
+	}
+	if s.ServerName != "" {
+		attrs = append(attrs, attribute.String("pggateway.server_name", s.ServerName))
+	}
+
+	var span trace.Span
+	s.traceCtx, span = tracer().Start(ctx, "session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(accepted),
+		trace.WithAttributes(attrs...),
+	)
+	return span
+}
+
+func (s *Session) endSessionSpan(span trace.Span, err error) {
+	span.SetAttributes(
+		attribute.Int64("pggateway.bytes_to_server", s.BytesToServer()),
+		attribute.Int64("pggateway.bytes_to_client", s.BytesToClient()),
+	)
+	if err == io.EOF {
+		err = nil
+	}
+	endSpan(span, err)
+}
+
+// traceContext is the context spans of the session are started in
+func (s *Session) traceContext() context.Context {
+	if s.traceCtx == nil {
+		return context.Background()
+	}
+	return s.traceCtx
+}
+
+// traceAuthentication runs p in its own span, which the spans started by p are children of
+func (s *Session) traceAuthentication(name string, p AuthenticationPlugin) (bool, error) {
+	parent := s.traceCtx
+	ctx, span := tracer().Start(s.traceContext(), "authenticate",
+		trace.WithAttributes(attribute.String("pggateway.auth.plugin", name)),
+	)
+	s.traceCtx = ctx
+	defer func() { s.traceCtx = parent }()
+
+	success, err := p.Authenticate(s)
+	span.SetAttributes(attribute.Bool("pggateway.auth.success", success))
+	endSpan(span, err)
+	return success, err
+}
+
+// startDialSpan starts the span of connecting to the target, which ends by calling the returned function
+func (s *Session) startDialSpan(network string, addr string) func(error) {
+	_, span := tracer().Start(s.traceContext(), "connect",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(serverAttributes(network, addr)...),
+	)
+	return func(err error) { endSpan(span, err) }
+}
+
+// statementSpans are the spans of statements sent to the target, waiting for their ReadyForQuery
+type statementSpans struct {
+	mutex sync.Mutex
+	spans []trace.Span
+}
+
+func (q *statementSpans) push(span trace.Span) {
+	q.mutex.Lock()
+	q.spans = append(q.spans, span)
+	q.mutex.Unlock()
+}
+
+func (q *statementSpans) first() trace.Span {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.spans) == 0 {
+		return nil
+	}
+	return q.spans[0]
+}
+
+func (q *statementSpans) pop() trace.Span {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.spans) == 0 {
+		return nil
+	}
+	span := q.spans[0]
+	q.spans = q.spans[1:]
+	return span
+}
+
+// close ends the spans of statements that will never complete
+func (q *statementSpans) close(err error) {
+	for span := q.pop(); span != nil; span = q.pop() {
+		endSpan(span, err)
+	}
+}
+
+// traceStatement starts the span of the statement msg belongs to, from its first message
+func (s *Session) traceStatement(msg pgproto.ClientMessage) {
+	var query []byte
+	switch m := msg.(type) {
+	case *pgproto.SimpleQuery:
+		query = m.Query
+	case *pgproto.Parse:
+		query = m.Query
+	case *pgproto.Bind, *pgproto.Describe, *pgproto.Execute, *pgproto.Sync:
+	default:
+		return
+	}
+
+	if s.statementSpan == nil {
+		ctx := s.traceContext()
+		if match := sqlcommenterPattern.FindSubmatch(query); match != nil {
+			ctx = extractTraceparent(ctx, string(match[1]))
+		}
+		_, s.statementSpan = tracer().Start(ctx, "statement",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "postgresql"),
+				attribute.String("db.namespace", string(s.Database)),
+				attribute.String("pggateway.session.id", s.ID),
+			),
+		)
+	}
+	if len(query) > 0 {
+		s.statementSpan.SetAttributes(
+			attribute.String("db.query.text", SanitizeQuery(string(query))),
+			attribute.String("db.operation.name", statementOperation(string(query))),
+		)
+	}
+}
+
+// statementSent hands the current statement span over to wait for the target's ReadyForQuery
+func (s *Session) statementSent() {
+	if s.statementSpan != nil {
+		s.statementSpans.push(s.statementSpan)
+		s.statementSpan = nil
+	}
+}
+
+// statementDone ends the current statement span when it was not sent to the target
+func (s *Session) statementDone(err error) {
+	if s.statementSpan != nil {
+		endSpan(s.statementSpan, err)
+		s.statementSpan = nil
+	}
+}
+
+// statementCached ends the current statement span when it was answered from the query cache
+func (s *Session) statementCached() {
+	if s.statementSpan != nil {
+		s.statementSpan.SetAttributes(attribute.Bool("pggateway.cache.hit", true))
+	}
+	s.statementDone(nil)
+}
+
+// traceResponse records msg on the span of the oldest statement sent to the target
+func (s *Session) traceResponse(msg pgproto.ServerMessage) {
+	switch m := msg.(type) {
+	case *pgproto.Error:
+		if span := s.statementSpans.first(); span != nil {
+			span.SetStatus(codes.Error, string(m.Message))
+		}
+	case *pgproto.CommandCompletion:
+		if span := s.statementSpans.first(); span != nil {
+			span.SetAttributes(attribute.String("pggateway.command_tag", string(m.Tag)))
+		}
+	case *pgproto.ReadyForQuery:
+		if span := s.statementSpans.pop(); span != nil {
+			span.End()
+		}
+	}
+}
+
+// statementOperation is the first keyword of query, after any comments
+func statementOperation(query string) string {
+	query = strings.TrimSpace(query)
+	for strings.HasPrefix(query, "/*") || strings.HasPrefix(query, "--") {
+		end := "*/"
+		if strings.HasPrefix(query, "--") {
+			end = "\n"
+		}
+		i := strings.Index(query, end)
+		if i < 0 {
+			return ""
+		}
+		query = strings.TrimSpace(query[i+len(end):])
+	}
+	if i := strings.IndexAny(query, " \t\r\n(;"); i >= 0 {
+		query = query[:i]
+	}
+	return strings.ToUpper(query)
+}
@@ -0,0 +1,132 @@
+package pggateway_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+	"github.com/c653labs/pgproto"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// spanAttribute returns the value of the attribute key of span, empty when it is not set
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+// simpleQuery runs q on conn with the simple query protocol
+func simpleQuery(t *testing.T, conn net.Conn, q string) {
+	_, err := pgproto.WriteMessage(&pgproto.SimpleQuery{Query: []byte(q)}, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := pgproto.ParseServerMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch m := msg.(type) {
+		case *pgproto.Error:
+			t.Fatalf("%s failed: %s", q, m.Message)
+		case *pgproto.ReadyForQuery:
+			return
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	const (
+		sessionTrace  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		sessionParent = "00f067aa0ba902b7"
+		commentTrace  = "0af7651916cd43dd8448eb211c80319c"
+		commentParent = "b7ad6b7169203331"
+	)
+	commented := "/*traceparent='00-" + commentTrace + "-" + commentParent + "-01'*/ SELECT 42"
+
+	spans := pgtest.RecordSpans()
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 42", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"42"}}})
+	srv.SetResult(commented, pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"42"}}})
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{Authentication: passthrough(srv)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := startSession(gw.Addr(), map[string]string{
+		"user":             "app",
+		"database":         "app",
+		"application_name": "billing 00-" + sessionTrace + "-" + sessionParent + "-01",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	simpleQuery(t, conn, "SELECT 42")
+	simpleQuery(t, conn, commented)
+	pgproto.WriteMessage(&pgproto.Termination{}, conn)
+	conn.Close()
+	// Closing the gateway waits for the session, and so its span, to end
+	gw.Close()
+
+	byName := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range spans.Ended() {
+		byName[span.Name()] = append(byName[span.Name()], span)
+	}
+	for name, count := range map[string]int{"session": 1, "authenticate": 1, "connect": 1, "statement": 2} {
+		if len(byName[name]) != count {
+			t.Fatalf("expected %d %s spans, got %d", count, name, len(byName[name]))
+		}
+	}
+
+	// The session joins the trace in application_name, the gateway's other spans are its descendants
+	session := byName["session"][0]
+	if got := session.SpanContext().TraceID().String() + "-" + session.Parent().SpanID().String(); got != sessionTrace+"-"+sessionParent {
+		t.Fatalf("session span has trace and parent %s", got)
+	}
+	if user := spanAttribute(session, "db.user"); user != "app" {
+		t.Errorf("session span has db.user %q", user)
+	}
+	auth, connect := byName["authenticate"][0], byName["connect"][0]
+	if auth.Parent().SpanID() != session.SpanContext().SpanID() {
+		t.Error("authenticate span is not a child of the session span")
+	}
+	if connect.Parent().SpanID() != auth.SpanContext().SpanID() {
+		t.Error("connect span is not a child of the authenticate span")
+	}
+	if port := spanAttribute(connect, "server.port"); port != fmt.Sprint(srv.Port()) {
+		t.Errorf("connect span has server.port %q, expected %d", port, srv.Port())
+	}
+
+	// Statements join the session's trace, unless they carry a sqlcommenter traceparent of their own
+	statements := byName["statement"]
+	if statements[0].Parent().SpanID() != session.SpanContext().SpanID() {
+		t.Error("statement span is not a child of the session span")
+	}
+	if got := statements[1].SpanContext().TraceID().String() + "-" + statements[1].Parent().SpanID().String(); got != commentTrace+"-"+commentParent {
+		t.Errorf("commented statement span has trace and parent %s", got)
+	}
+	// Comments are dropped along with the literals, they may carry data too
+	for i, text := range []string{"SELECT ?", "SELECT ?"} {
+		span := statements[i]
+		if got := spanAttribute(span, "db.query.text"); got != text {
+			t.Errorf("statement span has db.query.text %q, expected %q", got, text)
+		}
+		if op := spanAttribute(span, "db.operation.name"); op != "SELECT" {
+			t.Errorf("statement span has db.operation.name %q", op)
+		}
+		if tag := spanAttribute(span, "pggateway.command_tag"); tag != "SELECT 1" {
+			t.Errorf("statement span has pggateway.command_tag %q", tag)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package pggateway
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const defaultUnixSocketPort = 5432
+
+// UnixSocketConfig
+type UnixSocketConfig struct {
+	Port  int    `yaml:"port,omitempty"`
+	Mode  string `yaml:"mode,omitempty"`
+	Owner string `yaml:"owner,omitempty"`
+	Group string `yaml:"group,omitempty"`
+}
+
+// PeerCredentials of a client connected over a Unix domain socket
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// IsUnixSocketPath reports whether a bind address or target host names a Unix domain socket
+func IsUnixSocketPath(addr string) bool {
+	return strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "@")
+}
+
+// UnixSocketPath follows the PostgreSQL convention of naming the socket `.s.PGSQL.<port>`
+// when path is a directory
+func UnixSocketPath(path string, port int) string {
+	if port == 0 {
+		port = defaultUnixSocketPort
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return filepath.Join(path, ".s.PGSQL."+strconv.Itoa(port))
+	}
+	return path
+}
+
+func listenUnix(path string, config UnixSocketConfig) (net.Listener, error) {
+	path = UnixSocketPath(path, config.Port)
+
+	// Remove a stale socket left behind by a previous process
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(path, "@") {
+		return l, nil
+	}
+
+	err = setSocketPermissions(path, config)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func setSocketPermissions(path string, config UnixSocketConfig) error {
+	if config.Mode != "" {
+		mode, err := strconv.ParseUint(config.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket mode %#v: %s", config.Mode, err)
+		}
+		err = os.Chmod(path, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Owner == "" && config.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if config.Owner != "" {
+		u, err := user.Lookup(config.Owner)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if config.Group != "" {
+		g, err := user.LookupGroup(config.Group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,144 @@
+package pggateway_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/c653labs/pggateway"
+	"github.com/c653labs/pggateway/pgtest"
+)
+
+// unixForwarder listens on a Unix socket in dir and forwards its connections to srv,
+// standing in for a target listening on a Unix socket
+func unixForwarder(t *testing.T, dir string, srv *pgtest.Server) string {
+	path := pggateway.UnixSocketPath(dir, 5432)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", srv.Addr())
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(target, conn)
+				target.Close()
+			}()
+			go func() {
+				io.Copy(conn, target)
+				conn.Close()
+			}()
+		}
+	}()
+	return path
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	// A socket left behind by a process that did not clean up is replaced
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".s.PGSQL.5433")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Bind:           dir,
+		Socket:         pggateway.UnixSocketConfig{Port: 5433, Mode: "0770"},
+		Authentication: passthrough(srv),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0770 {
+		t.Fatalf("expected a socket with mode 0770, got %s", info.Mode())
+	}
+
+	// Like psql -h <dir> -p 5433
+	client, err := pgtest.Connect(pggateway.UnixSocketPath(dir, 5433), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rows, err := client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0][0] != "1" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+
+	// Sockets still in use are left alone
+	_, err = pgtest.StartGateway(&pggateway.ListenerConfig{
+		Bind:           dir,
+		Socket:         pggateway.UnixSocketConfig{Port: 5433},
+		Authentication: passthrough(srv),
+	})
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Fatalf("expected the socket to be in use, got %v", err)
+	}
+}
+
+func TestUnixSocketTarget(t *testing.T) {
+	srv, err := pgtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.SetResult("SELECT 1", pgtest.Result{Columns: []string{"?column?"}, Rows: [][]string{{"1"}}})
+
+	dir := t.TempDir()
+	unixForwarder(t, dir, srv)
+	gw, err := pgtest.StartGateway(&pggateway.ListenerConfig{
+		Authentication: map[string]interface{}{
+			"passthrough": map[string]interface{}{
+				// The socket is named after the default port inside the directory
+				"target": map[string]interface{}{"host": dir},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Close()
+
+	client, err := pgtest.Connect(gw.Addr(), "app", "", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rows, err := client.Query("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0][0] != "1" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+}